@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/personage-hub/metrics-tracker/internal/collector"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+)
+
+// metricBuffer keeps the latest gauge values and, for counters, the delta
+// accumulated since the last report acknowledged by the server. Entries are
+// keyed by series, so samples of one name with different labels are kept
+// apart. Gauges added with AddOnce are dropped once a report carrying them is
+// acknowledged.
+type metricBuffer struct {
+	mu       sync.Mutex
+	gauges   map[string]*bufferEntry
+	counters map[string]*bufferEntry
+}
+
+type bufferEntry struct {
+	name   string
+	labels metrics.Labels
+	value  float64
+	delta  int64
+	once   bool
+}
+
+func newMetricBuffer() *metricBuffer {
+	return &metricBuffer{
+		gauges:   make(map[string]*bufferEntry),
+		counters: make(map[string]*bufferEntry),
+	}
+}
+
+// Add adds samples whose gauges are reported on every report.
+func (b *metricBuffer) Add(samples []collector.Sample) {
+	b.add(samples, false)
+}
+
+// AddOnce adds samples that describe a single interval, such as StatsD
+// aggregates: their gauges are reported until a report is acknowledged.
+func (b *metricBuffer) AddOnce(samples []collector.Sample) {
+	b.add(samples, true)
+}
+
+func (b *metricBuffer) add(samples []collector.Sample, once bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sample := range samples {
+		switch sample.MType {
+		case "gauge":
+			e := b.entry(b.gauges, sample)
+			e.value = sample.Value
+			e.once = once
+		case "counter":
+			b.entry(b.counters, sample).delta += sample.Delta
+		}
+	}
+}
+
+func (b *metricBuffer) entry(entries map[string]*bufferEntry, sample collector.Sample) *bufferEntry {
+	key := metrics.SeriesKey(sample.Name, sample.Labels)
+	e, ok := entries[key]
+	if !ok {
+		e = &bufferEntry{name: sample.Name, labels: sample.Labels}
+		entries[key] = e
+	}
+	return e
+}
+
+// Snapshot returns a consistent copy of the buffer as a batch to report.
+// Counter deltas stay pending until the batch is passed to Ack.
+func (b *metricBuffer) Snapshot() metrics.MetricsList {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batch := make(metrics.MetricsList, 0, len(b.gauges)+len(b.counters))
+	for _, e := range b.gauges {
+		v := e.value
+		batch = append(batch, metrics.Metrics{ID: e.name, MType: "gauge", Value: &v, Labels: e.labels})
+	}
+	for _, e := range b.counters {
+		if e.delta == 0 {
+			continue
+		}
+		d := e.delta
+		batch = append(batch, metrics.Metrics{ID: e.name, MType: "counter", Delta: &d, Labels: e.labels})
+	}
+	sort.Slice(batch, func(i, j int) bool {
+		if batch[i].ID != batch[j].ID {
+			return batch[i].ID < batch[j].ID
+		}
+		return batch[i].Key() < batch[j].Key()
+	})
+	return batch
+}
+
+// Ack subtracts the counter deltas of a batch the server has accepted and
+// drops its gauges added with AddOnce, unless they changed in the meantime.
+// Increments collected while the report was in flight are preserved.
+func (b *metricBuffer) Ack(sent metrics.MetricsList) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range sent {
+		if m.MType == "gauge" && m.Value != nil {
+			key := m.Key()
+			if e, ok := b.gauges[key]; ok && e.once && e.value == *m.Value {
+				delete(b.gauges, key)
+			}
+			continue
+		}
+		if m.MType != "counter" || m.Delta == nil {
+			continue
+		}
+		key := m.Key()
+		e, ok := b.counters[key]
+		if !ok {
+			continue
+		}
+		e.delta -= *m.Delta
+		if e.delta == 0 {
+			delete(b.counters, key)
+		}
+	}
+}
+
+// splitBatch cuts batch into chunks of at most size metrics; a non-positive
+// size keeps the batch whole.
+func splitBatch(batch metrics.MetricsList, size int) []metrics.MetricsList {
+	if size <= 0 || len(batch) <= size {
+		return []metrics.MetricsList{batch}
+	}
+	chunks := make([]metrics.MetricsList, 0, (len(batch)+size-1)/size)
+	for start := 0; start < len(batch); start += size {
+		end := start + size
+		if end > len(batch) {
+			end = len(batch)
+		}
+		chunks = append(chunks, batch[start:end])
+	}
+	return chunks
+}
@@ -2,83 +2,152 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/mailru/easyjson"
+	"github.com/personage-hub/metrics-tracker/internal/collector"
+	"github.com/personage-hub/metrics-tracker/internal/compression"
 	"github.com/personage-hub/metrics-tracker/internal/consts"
 	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/outbox"
+	"github.com/personage-hub/metrics-tracker/internal/signature"
+	"github.com/personage-hub/metrics-tracker/internal/statsd"
 	"github.com/personage-hub/metrics-tracker/internal/storage"
 	"go.uber.org/zap"
-	"math/rand"
 	"net/http"
-	"runtime"
+	"sync"
 	"time"
 )
 
-type metric struct {
-	metricValue float64
-	metricType  string
-}
-
 type MonitoringClient struct {
-	Client        *http.Client
-	Config        Config
-	Storage       storage.Storage
-	metricStorage chan map[string]metric
-	logger        *zap.Logger
+	Client  *http.Client
+	Config  Config
+	Storage storage.Storage
+	// Outbox, when set, persists every batch before it is sent and replays
+	// unsent batches in order once the server is reachable again.
+	Outbox *outbox.Outbox
+	// Keys, when set, signs every request body with the active key.
+	Keys *signature.KeyRing
+	// Labels, when set, are attached to every reported metric. Labels of a
+	// sample take precedence over them.
+	Labels metrics.Labels
+	// StatsD, when set, is flushed into the report on every report interval.
+	StatsD   *statsd.Aggregator
+	buffer   *metricBuffer
+	registry *collector.Registry
+	logger   *zap.Logger
 }
 
-func NewMonitoringClient(client *http.Client, logger *zap.Logger, config Config) *MonitoringClient {
+func NewMonitoringClient(
+	client *http.Client,
+	logger *zap.Logger,
+	config Config,
+	registry *collector.Registry,
+) *MonitoringClient {
 	return &MonitoringClient{
-		Client:        client,
-		Config:        config,
-		metricStorage: make(chan map[string]metric, 1),
-		logger:        logger,
+		Client:   client,
+		Config:   config,
+		buffer:   newMetricBuffer(),
+		registry: registry,
+		logger:   logger,
 	}
 }
 
-func (mc *MonitoringClient) compress(data []byte) ([]byte, error) {
-	var b bytes.Buffer
-	gzw, err := gzip.NewWriterLevel(&b, gzip.BestCompression)
+// SendMetrics posts batch to the server, retrying network errors, 5xx and
+// 429 responses according to the configured RetryPolicy. The returned error,
+// if any, is a *SendError.
+func (mc *MonitoringClient) SendMetrics(ctx context.Context, batch metrics.MetricsList) error {
+	data, err := easyjson.Marshal(batch)
 	if err != nil {
-		return nil, fmt.Errorf("failed init compress writer: %w", err)
+		return &SendError{Err: fmt.Errorf("failed converting data for request: %w", err)}
 	}
+	return mc.sendPayload(ctx, data, "")
+}
 
-	if _, err = gzw.Write(data); err != nil {
-		return nil, fmt.Errorf("failed to write compress data to buffer: %w", err)
+// sendPayload posts an already encoded batch. A non-empty key is sent as
+// Idempotency-Key so the server can skip a batch it has already applied.
+func (mc *MonitoringClient) sendPayload(ctx context.Context, data []byte, key string) error {
+	header := make(http.Header)
+	header.Set("Content-Type", consts.ContentTypeJSON)
+	if key != "" {
+		header.Set(consts.HeaderIdempotencyKey, key)
 	}
-
-	if err = gzw.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close compress writer: %w", err)
+	// The signature covers the plain body, the server verifies it after decompression.
+	if mc.Keys != nil {
+		keyID, sum := mc.Keys.Sign(data)
+		header.Set(signature.HeaderHash, sum)
+		if keyID != "" {
+			header.Set(signature.HeaderKeyID, keyID)
+		}
 	}
+	body := data
+	if encoding := mc.Config.Compression; encoding != "" && encoding != compression.Identity {
+		var err error
+		body, err = compression.Compress(encoding, mc.Config.CompressionLevel, data)
+		if err != nil {
+			return &SendError{Err: err}
+		}
+		header.Set("Content-Encoding", encoding)
+	}
+
+	policy := mc.Config.RetryPolicy
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := mc.send(ctx, body, header)
+		if err == nil {
+			return nil
+		}
+		err.Attempts = attempt + 1
+		if !err.Retriable || attempt >= policy.MaxRetries {
+			return err
+		}
 
-	return b.Bytes(), nil
+		delay := retryDelay(policy, attempt, retryAfter)
+		mc.logger.Warn(
+			"retrying metrics batch",
+			zap.Int("attempt", attempt+1),
+			zap.Duration("delay", delay),
+			zap.Error(err.Err),
+		)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &SendError{Attempts: attempt + 1, Err: ctx.Err()}
+		case <-timer.C:
+		}
+	}
 }
 
-func (mc *MonitoringClient) SendMetric(metric metrics.Metrics) error {
-	url := fmt.Sprintf("http://%s/update/", mc.Config.ServerAddress)
+// send makes a single attempt bounded by the request timeout. For a
+// throttled or unavailable server it also returns the Retry-After delay.
+func (mc *MonitoringClient) send(ctx context.Context, body []byte, header http.Header) (time.Duration, *SendError) {
+	url := fmt.Sprintf("http://%s/updates/", mc.Config.ServerAddress)
 
-	data, err := easyjson.Marshal(metric)
-	if err != nil {
-		return fmt.Errorf("failed converting data for request: %w", err)
+	if mc.Config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mc.Config.RequestTimeout)
+		defer cancel()
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("failed creating request: %w", err)
+		return 0, &SendError{Err: fmt.Errorf("failed creating request: %w", err)}
 	}
-
-	req.Header.Set("Content-Type", consts.ContentTypeJSON)
+	req.Header = header.Clone()
 
 	start := time.Now()
 
 	resp, err := mc.Client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed send metric: %w", err)
+		// The caller giving up is final, a timed out or failed attempt is not.
+		parentDone := ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded)
+		return 0, &SendError{Retriable: !parentDone, Err: fmt.Errorf("failed send metrics: %w", err)}
 	}
 	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
 
 	duration := time.Since(start)
 	mc.logger.Info(
@@ -89,106 +158,230 @@ func (mc *MonitoringClient) SendMetric(metric metrics.Metrics) error {
 		zap.String("duration", duration.String()),
 	)
 
-	mc.logger.Info("Response:", zap.Int("status", resp.StatusCode))
-
-	return nil
+	if resp.StatusCode == http.StatusOK {
+		return 0, nil
+	}
+	sendErr := &SendError{
+		StatusCode: resp.StatusCode,
+		Retriable:  retriableStatus(resp.StatusCode),
+		Err:        fmt.Errorf("server rejected metrics: %s", resp.Status),
+	}
+	retryAfter, _ := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return retryAfter, sendErr
 }
 
+// StartMonitoring runs polling and reporting on separate goroutines, so a
+// slow server never delays collection, and returns once both have stopped.
 func (mc *MonitoringClient) StartMonitoring(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		mc.pollLoop(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		mc.reportLoop(ctx)
+	}()
+	wg.Wait()
+}
+
+func (mc *MonitoringClient) pollLoop(ctx context.Context) {
 	tickerPoll := time.NewTicker(mc.Config.PollInterval)
-	tickerReport := time.NewTicker(mc.Config.ReportInterval)
 	defer tickerPoll.Stop()
-	defer tickerReport.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-tickerPoll.C:
-			mc.CollectMetrics()
+			mc.CollectMetrics(ctx)
+		}
+	}
+}
+
+// reportLoop runs one report at a time; ticks that fire while a report is
+// still in flight are dropped by the ticker.
+func (mc *MonitoringClient) reportLoop(ctx context.Context) {
+	tickerReport := time.NewTicker(mc.Config.ReportInterval)
+	defer tickerReport.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
 		case <-tickerReport.C:
-			mc.StartReporting()
+			mc.StartReporting(ctx)
 		}
 	}
 }
 
-func (mc *MonitoringClient) CollectMetrics() {
+func (mc *MonitoringClient) CollectMetrics(ctx context.Context) {
 	mc.logger.Info("starting collecting metrics")
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-
-	var metStorage map[string]metric
-
-	if len(mc.metricStorage) == 0 {
-		metStorage = make(map[string]metric)
-	} else {
-		metStorage = <-mc.metricStorage
-	}
-
-	metStorage["Alloc"] = metric{metricValue: float64(m.Alloc), metricType: "gauge"}
-	metStorage["BuckHashSys"] = metric{metricValue: float64(m.BuckHashSys), metricType: "gauge"}
-	metStorage["Frees"] = metric{metricValue: float64(m.Frees), metricType: "gauge"}
-	metStorage["GCCPUFraction"] = metric{metricValue: m.GCCPUFraction, metricType: "gauge"}
-	metStorage["GCSys"] = metric{metricValue: float64(m.GCSys), metricType: "gauge"}
-	metStorage["HeapAlloc"] = metric{metricValue: float64(m.HeapAlloc), metricType: "gauge"}
-	metStorage["HeapIdle"] = metric{metricValue: float64(m.HeapIdle), metricType: "gauge"}
-	metStorage["HeapInuse"] = metric{metricValue: float64(m.HeapInuse), metricType: "gauge"}
-	metStorage["HeapObjects"] = metric{metricValue: float64(m.HeapObjects), metricType: "gauge"}
-	metStorage["HeapReleased"] = metric{metricValue: float64(m.HeapReleased), metricType: "gauge"}
-	metStorage["HeapSys"] = metric{metricValue: float64(m.HeapSys), metricType: "gauge"}
-	metStorage["LastGC"] = metric{metricValue: float64(m.LastGC), metricType: "gauge"}
-	metStorage["Lookups"] = metric{metricValue: float64(m.Lookups), metricType: "gauge"}
-	metStorage["MCacheInuse"] = metric{metricValue: float64(m.MCacheInuse), metricType: "gauge"}
-	metStorage["MCacheSys"] = metric{metricValue: float64(m.MCacheSys), metricType: "gauge"}
-	metStorage["MSpanInuse"] = metric{metricValue: float64(m.MSpanInuse), metricType: "gauge"}
-	metStorage["MSpanSys"] = metric{metricValue: float64(m.MSpanSys), metricType: "gauge"}
-	metStorage["Mallocs"] = metric{metricValue: float64(m.Mallocs), metricType: "gauge"}
-	metStorage["NextGC"] = metric{metricValue: float64(m.NextGC), metricType: "gauge"}
-	metStorage["NumForcedGC"] = metric{metricValue: float64(m.NumForcedGC), metricType: "gauge"}
-	metStorage["NumGC"] = metric{metricValue: float64(m.NumGC), metricType: "gauge"}
-	metStorage["OtherSys"] = metric{metricValue: float64(m.OtherSys), metricType: "gauge"}
-	metStorage["PauseTotalNs"] = metric{metricValue: float64(m.PauseTotalNs), metricType: "gauge"}
-	metStorage["StackInuse"] = metric{metricValue: float64(m.StackInuse), metricType: "gauge"}
-	metStorage["StackSys"] = metric{metricValue: float64(m.StackSys), metricType: "gauge"}
-	metStorage["Sys"] = metric{metricValue: float64(m.Sys), metricType: "gauge"}
-	metStorage["TotalAlloc"] = metric{metricValue: float64(m.TotalAlloc), metricType: "gauge"}
-	metStorage["RandomValue"] = metric{metricValue: rand.Float64(), metricType: "gauge"}
-
-	pollCount, ok := metStorage["PollCount"]
-	if !ok {
-		metStorage["PollCount"] = metric{metricValue: float64(1), metricType: "counter"}
-	} else {
-		pollCount.metricValue += float64(1)
-		metStorage["PollCount"] = pollCount
-	}
-
-	mc.metricStorage <- metStorage
+	mc.addSamples(mc.registry.Collect(ctx))
 	mc.logger.Info("finish collecting metrics")
 }
 
-func (mc *MonitoringClient) StartReporting() {
+// addSamples attaches the static labels to samples and adds them to the
+// buffer.
+func (mc *MonitoringClient) addSamples(samples []collector.Sample) {
+	mc.buffer.Add(mc.withLabels(samples))
+}
+
+// flushStatsD adds the StatsD aggregates of the interval that just ended to
+// the buffer. They describe that interval only, so their gauges are not
+// reported again once a report with them is acknowledged.
+func (mc *MonitoringClient) flushStatsD() {
+	if mc.StatsD != nil {
+		mc.buffer.AddOnce(mc.withLabels(mc.StatsD.Flush()))
+	}
+}
+
+func (mc *MonitoringClient) withLabels(samples []collector.Sample) []collector.Sample {
+	if len(mc.Labels) > 0 {
+		for i := range samples {
+			samples[i].Labels = mergeLabels(mc.Labels, samples[i].Labels)
+		}
+	}
+	return samples
+}
+
+func mergeLabels(static, own metrics.Labels) metrics.Labels {
+	if len(own) == 0 {
+		return static
+	}
+	merged := make(metrics.Labels, len(static)+len(own))
+	for name, value := range static {
+		merged[name] = value
+	}
+	for name, value := range own {
+		merged[name] = value
+	}
+	return merged
+}
+
+// rejected reports whether the server refused the content of a batch, in
+// which case resending it would fail again.
+func rejected(err error) bool {
+	var sendErr *SendError
+	return errors.As(err, &sendErr) && sendErr.StatusCode != 0 && !sendErr.Retriable
+}
+
+// StartReporting sends a snapshot of the buffer split into batches. Counter
+// deltas of a batch are dropped from the buffer only after the server has
+// accepted it, or after it was persisted when an Outbox is configured.
+func (mc *MonitoringClient) StartReporting(ctx context.Context) {
 	mc.logger.Info("Reporting metrics to server...")
-	metStorage := <-mc.metricStorage
-	for metricName, currentMetric := range metStorage {
-		m := metrics.Metrics{
-			ID:    metricName,
-			MType: currentMetric.metricType,
+	mc.flushStatsD()
+	batch := mc.buffer.Snapshot()
+	if mc.Outbox != nil {
+		if len(batch) > 0 {
+			mc.enqueue(splitBatch(batch, mc.Config.BatchSize))
 		}
-		switch currentMetric.metricType {
-		case "gauge":
-			{
-				m.Value = &currentMetric.metricValue
-			}
-		case "counter":
-			{
-				v := int64(currentMetric.metricValue)
-				m.Delta = &v
+		mc.drainOutbox(ctx)
+		return
+	}
+	if len(batch) == 0 {
+		return
+	}
+	mc.sendConcurrently(ctx, splitBatch(batch, mc.Config.BatchSize))
+}
+
+// sendConcurrently sends chunks through a bounded pool of senders.
+func (mc *MonitoringClient) sendConcurrently(ctx context.Context, chunks []metrics.MetricsList) {
+	workers := mc.Config.ReportWorkers
+	if workers <= 0 || workers > len(chunks) {
+		workers = len(chunks)
+	}
+
+	jobs := make(chan metrics.MetricsList)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for chunk := range jobs {
+				err := mc.SendMetrics(ctx, chunk)
+				switch {
+				case err == nil:
+				case rejected(err):
+					mc.logger.Error("metrics batch rejected, dropping it", zap.Error(err))
+				default:
+					// Counter deltas stay in the buffer and are retried with the next report.
+					mc.logger.Error("error sending metrics batch", zap.Error(err))
+					continue
+				}
+				mc.buffer.Ack(chunk)
 			}
+		}()
+	}
+	for _, chunk := range chunks {
+		jobs <- chunk
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Shutdown moves the metrics collected since the last report into the
+// outbox, where the next agent run picks them up. Without an outbox there is
+// nowhere to keep them and it does nothing.
+func (mc *MonitoringClient) Shutdown() {
+	if mc.Outbox == nil {
+		return
+	}
+	mc.flushStatsD()
+	if batch := mc.buffer.Snapshot(); len(batch) > 0 {
+		mc.enqueue(splitBatch(batch, mc.Config.BatchSize))
+	}
+}
 
+// enqueue persists chunks in the outbox. Once a chunk is on disk its counter
+// deltas belong to the outbox and are removed from the buffer.
+func (mc *MonitoringClient) enqueue(chunks []metrics.MetricsList) {
+	for _, chunk := range chunks {
+		data, err := easyjson.Marshal(chunk)
+		if err != nil {
+			mc.logger.Error("failed converting metrics batch", zap.Error(err))
+			continue
+		}
+		if _, err := mc.Outbox.Append(data); err != nil {
+			mc.logger.Error("failed to store metrics batch in outbox", zap.Error(err))
+			continue
 		}
-		err := mc.SendMetric(m)
+		mc.buffer.Ack(chunk)
+	}
+}
+
+// drainOutbox sends pending outbox records strictly in order and stops at the
+// first one the server could not take.
+func (mc *MonitoringClient) drainOutbox(ctx context.Context) {
+	for ctx.Err() == nil {
+		record, ok, err := mc.Outbox.Peek()
 		if err != nil {
-			mc.logger.Error("error sending gauge metric: %w", zap.Error(err))
+			mc.logger.Error("failed to read outbox", zap.Error(err))
+			return
+		}
+		if !ok {
+			return
+		}
+
+		key := fmt.Sprintf("%s-%d", mc.Outbox.ID(), record.Seq)
+		err = mc.sendPayload(ctx, record.Payload, key)
+		switch {
+		case err == nil:
+		case rejected(err):
+			mc.logger.Error("metrics batch rejected, dropping it", zap.Error(err))
+		default:
+			mc.logger.Error(
+				"error sending metrics batch, keeping it in outbox",
+				zap.Int("pending", mc.Outbox.Len()),
+				zap.Error(err),
+			)
+			return
+		}
+		if err := mc.Outbox.Ack(record.Seq); err != nil {
+			mc.logger.Error("failed to acknowledge outbox record", zap.Error(err))
+			return
 		}
 	}
 }
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/personage-hub/metrics-tracker/internal/collector"
+	"github.com/personage-hub/metrics-tracker/internal/compression"
+	"github.com/personage-hub/metrics-tracker/internal/dumper"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/middlewares"
+	"github.com/personage-hub/metrics-tracker/internal/outbox"
+	"github.com/personage-hub/metrics-tracker/internal/signature"
+	"github.com/personage-hub/metrics-tracker/internal/statsd"
+	"github.com/personage-hub/metrics-tracker/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testServer applies received batches to a MemStorage the same way the
+// metrics server does. It can be switched into a failing mode and can hold
+// requests until release is closed.
+type testServer struct {
+	*httptest.Server
+	storage *storage.MemStorage
+	failing atomic.Bool
+	blocked atomic.Bool
+	entered chan struct{}
+	release chan struct{}
+
+	mu   sync.Mutex
+	keys []string
+}
+
+// seenKeys returns the Idempotency-Key of every request received so far.
+func (ts *testServer) seenKeys() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]string(nil), ts.keys...)
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s, err := storage.NewMemStorage(dumper.NewDumper(t.TempDir()+"/dump.json"), false)
+	require.NoError(t, err)
+	ts := &testServer{
+		storage: s,
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	ts.restart()
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	return ts
+}
+
+// restart replaces the server with a fresh, healthy one sharing the storage.
+func (ts *testServer) restart() {
+	ts.failing.Store(false)
+	ts.blocked.Store(false)
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ts.blocked.Load() {
+			select {
+			case ts.entered <- struct{}{}:
+			default:
+			}
+			select {
+			case <-ts.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		ts.mu.Lock()
+		ts.keys = append(ts.keys, r.Header.Get("Idempotency-Key"))
+		ts.mu.Unlock()
+		if ts.failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var batch metrics.MetricsList
+		if err := easyjson.UnmarshalFromReader(r.Body, &batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		gauges := make(map[string]float64)
+		counters := make(map[string]int64)
+		for _, m := range batch {
+			if m.MType == "gauge" {
+				gauges[m.Key()] = *m.Value
+			} else {
+				counters[m.Key()] += *m.Delta
+			}
+		}
+		_ = ts.storage.BatchUpdate(gauges, counters)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// countingCollector wraps PollCollector and counts how many polls happened.
+// Once stopped it produces no samples, so shutdown cannot discard counted polls.
+type countingCollector struct {
+	collector.PollCollector
+	polls   atomic.Int64
+	stopped atomic.Bool
+}
+
+func (c *countingCollector) Collect(ctx context.Context) ([]collector.Sample, error) {
+	if c.stopped.Load() {
+		return nil, errors.New("collector stopped")
+	}
+	c.polls.Add(1)
+	return c.PollCollector.Collect(ctx)
+}
+
+func newTestClient(ts *testServer, config Config) (*MonitoringClient, *countingCollector) {
+	counting := &countingCollector{}
+	registry := collector.NewRegistry(zap.NewNop(), collector.Options{})
+	registry.Register(counting)
+	config.ServerAddress = strings.TrimPrefix(ts.URL, "http://")
+	return NewMonitoringClient(ts.Client(), zap.NewNop(), config, registry), counting
+}
+
+func pendingPollCount(mc *MonitoringClient) int64 {
+	for _, m := range mc.buffer.Snapshot() {
+		if m.ID == "PollCount" {
+			return *m.Delta
+		}
+	}
+	return 0
+}
+
+func TestPollCountMatchesPolls(t *testing.T) {
+	tests := []struct {
+		name string
+		// steps is a sequence of polls ("p"), successful reports ("r")
+		// and reports while the server is failing ("f").
+		steps string
+		want  int64
+	}{
+		{name: "Single report", steps: "pppr", want: 3},
+		{name: "Several reports", steps: "ppprpprprr", want: 6},
+		{name: "Failed reports carry deltas", steps: "pppfppfpr", want: 6},
+		{name: "Failure after success", steps: "pprpppfr", want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			mc, _ := newTestClient(ts, Config{})
+			for _, step := range tt.steps {
+				switch step {
+				case 'p':
+					mc.CollectMetrics(context.Background())
+				case 'r':
+					ts.failing.Store(false)
+					mc.StartReporting(context.Background())
+				case 'f':
+					ts.failing.Store(true)
+					mc.StartReporting(context.Background())
+				}
+			}
+			value, ok := ts.storage.GetCounterMetric("PollCount")
+			require.True(t, ok)
+			assert.Equal(t, tt.want, value)
+		})
+	}
+}
+
+func TestReportAttachesLabels(t *testing.T) {
+	ts := newTestServer(t)
+	labels, err := Config{Labels: "host=web1, env=prod"}.StaticLabels()
+	require.NoError(t, err)
+	mc, _ := newTestClient(ts, Config{})
+	mc.Labels = labels
+
+	mc.CollectMetrics(context.Background())
+	mc.CollectMetrics(context.Background())
+	mc.StartReporting(context.Background())
+
+	value, ok := ts.storage.GetCounterMetric(`PollCount{env="prod",host="web1"}`)
+	require.True(t, ok)
+	assert.Equal(t, int64(2), value)
+	_, ok = ts.storage.GetCounterMetric("PollCount")
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), pendingPollCount(mc), "labeled deltas are acknowledged")
+}
+
+func TestReportForwardsStatsD(t *testing.T) {
+	ts := newTestServer(t)
+	mc, _ := newTestClient(ts, Config{})
+	mc.Labels = metrics.Labels{"host": "web1"}
+	mc.StatsD = statsd.NewAggregator()
+	for _, line := range []string{"hits:1|c", "hits:2|c|#host:web2", "hits:3|c", "temp:21.5|g"} {
+		parsed, err := statsd.ParseLine(line)
+		require.NoError(t, err)
+		mc.StatsD.Add(parsed)
+	}
+
+	mc.StartReporting(context.Background())
+
+	value, ok := ts.storage.GetCounterMetric(`hits{host="web1"}`)
+	require.True(t, ok)
+	assert.Equal(t, int64(4), value)
+	value, ok = ts.storage.GetCounterMetric(`hits{host="web2"}`)
+	require.True(t, ok)
+	assert.Equal(t, int64(2), value, "tags take precedence over static labels")
+	gauge, ok := ts.storage.GetGaugeMetric(`temp{host="web1"}`)
+	require.True(t, ok)
+	assert.Equal(t, 21.5, gauge)
+
+	assert.Empty(t, mc.buffer.Snapshot(), "reported StatsD gauges leave the buffer")
+
+	mc.StartReporting(context.Background())
+	value, _ = ts.storage.GetCounterMetric(`hits{host="web1"}`)
+	assert.Equal(t, int64(4), value, "a flushed interval is reported once")
+}
+
+func TestStaticLabels(t *testing.T) {
+	labels, err := Config{}.StaticLabels()
+	require.NoError(t, err)
+	assert.Empty(t, labels)
+
+	for _, value := range []string{"host", "host=", "1host=a", "host=a,__name__=b"} {
+		_, err := Config{Labels: value}.StaticLabels()
+		assert.Error(t, err, value)
+	}
+}
+
+func TestOutboxOptions(t *testing.T) {
+	options, err := Config{OutboxPolicy: "drop-newest"}.OutboxOptions()
+	require.NoError(t, err)
+	assert.Equal(t, outbox.DropNewest, options.Policy)
+	options, err = Config{OutboxPolicy: "drop-oldest"}.OutboxOptions()
+	require.NoError(t, err)
+	assert.Equal(t, outbox.DropOldest, options.Policy)
+
+	for _, value := range []string{"", "drop-newset", "newest"} {
+		_, err := Config{OutboxPolicy: value}.OutboxOptions()
+		assert.Error(t, err, value)
+	}
+}
+
+func TestMetricBufferAckDropsOnceGauges(t *testing.T) {
+	b := newMetricBuffer()
+	b.Add([]collector.Sample{collector.Gauge("Alloc", 1)})
+	b.AddOnce([]collector.Sample{collector.Gauge("lat.max", 40), collector.Gauge("users", 2)})
+	sent := b.Snapshot()
+	require.Len(t, sent, 3)
+
+	b.AddOnce([]collector.Sample{collector.Gauge("users", 3)})
+	b.Ack(sent)
+
+	batch := b.Snapshot()
+	require.Len(t, batch, 2, "lat.max was reported, Alloc is kept")
+	assert.Equal(t, "Alloc", batch[0].ID)
+	assert.Equal(t, "users", batch[1].ID)
+	assert.Equal(t, 3.0, *batch[1].Value, "a gauge updated in flight is kept")
+}
+
+func TestMetricBufferAckKeepsNewIncrements(t *testing.T) {
+	b := newMetricBuffer()
+	b.Add([]collector.Sample{collector.Counter("PollCount", 2)})
+	sent := b.Snapshot()
+
+	b.Add([]collector.Sample{collector.Counter("PollCount", 3)})
+	b.Ack(sent)
+
+	batch := b.Snapshot()
+	require.Len(t, batch, 1)
+	assert.Equal(t, int64(3), *batch[0].Delta)
+}
+
+func TestSplitBatch(t *testing.T) {
+	batch := make(metrics.MetricsList, 5)
+	assert.Len(t, splitBatch(batch, 0), 1)
+	assert.Len(t, splitBatch(batch, 5), 1)
+
+	chunks := splitBatch(batch, 2)
+	require.Len(t, chunks, 3)
+	assert.Len(t, chunks[2], 1)
+}
+
+func TestReportWithoutPollsDoesNotBlock(t *testing.T) {
+	ts := newTestServer(t)
+	mc, _ := newTestClient(ts, Config{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mc.StartReporting(context.Background())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("report blocked on an empty buffer")
+	}
+}
+
+func TestSlowServerDoesNotStallPolling(t *testing.T) {
+	ts := newTestServer(t)
+	ts.blocked.Store(true)
+	mc, counting := newTestClient(ts, Config{
+		PollInterval:   5 * time.Millisecond,
+		ReportInterval: 20 * time.Millisecond,
+		ReportWorkers:  2,
+		BatchSize:      1,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mc.StartMonitoring(ctx)
+	}()
+
+	select {
+	case <-ts.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("report never reached the server")
+	}
+	pollsWhenBlocked := counting.polls.Load()
+	require.Eventually(t, func() bool {
+		return counting.polls.Load() >= pollsWhenBlocked+5
+	}, 5*time.Second, time.Millisecond, "polling stalled while the server was slow")
+
+	// The server becomes unavailable: held requests are released with an error.
+	ts.failing.Store(true)
+	close(ts.release)
+	time.Sleep(50 * time.Millisecond)
+
+	counting.stopped.Store(true)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitoring did not stop")
+	}
+
+	// Close waits for requests aborted by the shutdown, so none of them can
+	// be applied after the server recovers.
+	ts.Close()
+	ts.restart()
+	mc.Config.ServerAddress = strings.TrimPrefix(ts.URL, "http://")
+	mc.StartReporting(context.Background())
+
+	value, ok := ts.storage.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, counting.polls.Load(), value)
+	assert.Zero(t, pendingPollCount(mc))
+}
+
+func TestUnreachableServerKeepsDeltas(t *testing.T) {
+	ts := newTestServer(t)
+	mc, counting := newTestClient(ts, Config{})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	mc.Config.ServerAddress = unreachable
+	for i := 0; i < 3; i++ {
+		mc.CollectMetrics(context.Background())
+		mc.StartReporting(context.Background())
+	}
+	assert.Equal(t, counting.polls.Load(), pendingPollCount(mc))
+
+	mc.Config.ServerAddress = strings.TrimPrefix(ts.URL, "http://")
+	mc.StartReporting(context.Background())
+
+	value, ok := ts.storage.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, int64(3), value)
+	assert.Zero(t, pendingPollCount(mc))
+}
+
+func TestOutboxReplaysAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t)
+	ts.failing.Store(true)
+
+	var polls int64
+	for run := 0; run < 2; run++ {
+		// Every run is a fresh agent process sharing the outbox directory.
+		box, err := outbox.Open(dir, outbox.Options{})
+		require.NoError(t, err)
+		mc, counting := newTestClient(ts, Config{BatchSize: 1})
+		mc.Outbox = box
+		for i := 0; i < 3; i++ {
+			mc.CollectMetrics(context.Background())
+			mc.StartReporting(context.Background())
+		}
+		polls += counting.polls.Load()
+		assert.Zero(t, pendingPollCount(mc), "deltas are moved to the outbox")
+		require.NoError(t, box.Close())
+	}
+
+	_, ok := ts.storage.GetCounterMetric("PollCount")
+	require.False(t, ok)
+	failedKeys := ts.seenKeys()
+
+	box, err := outbox.Open(dir, outbox.Options{})
+	require.NoError(t, err)
+	defer box.Close()
+	assert.Equal(t, 12, box.Len())
+
+	ts.failing.Store(false)
+	mc, _ := newTestClient(ts, Config{})
+	mc.Outbox = box
+	mc.StartReporting(context.Background())
+
+	assert.Zero(t, box.Len())
+	value, ok := ts.storage.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, polls, value)
+
+	// The first record was attempted on every report and keeps its key.
+	for _, key := range failedKeys {
+		assert.Equal(t, failedKeys[0], key)
+	}
+	assert.Contains(t, ts.seenKeys(), failedKeys[0])
+	assert.Len(t, ts.seenKeys(), len(failedKeys)+12)
+}
+
+func TestSendMetricsSigned(t *testing.T) {
+	serverKeys, err := signature.ParseKeyRing("new:secret2,old:secret1")
+	require.NoError(t, err)
+	ts := httptest.NewServer(middlewares.HashHandler(serverKeys)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	)))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "Active key", key: "new:secret2"},
+		{name: "Previous key", key: "old:secret1"},
+		{name: "Plain previous secret", key: "secret1"},
+		{name: "Unknown key", key: "other", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := NewMonitoringClient(ts.Client(), zap.NewNop(), Config{
+				ServerAddress: strings.TrimPrefix(ts.URL, "http://"),
+			}, nil)
+			mc.Keys, err = signature.ParseKeyRing(tt.key)
+			require.NoError(t, err)
+
+			value := 1.5
+			err := mc.SendMetrics(context.Background(), metrics.MetricsList{
+				{ID: "Alloc", MType: "gauge", Value: &value},
+			})
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, rejected(err))
+		})
+	}
+}
+
+func TestSendMetricsCompressed(t *testing.T) {
+	var received metrics.MetricsList
+	ts := httptest.NewServer(middlewares.CompressionHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := easyjson.UnmarshalFromReader(r.Body, &received); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		},
+	)))
+	defer ts.Close()
+
+	for _, encoding := range []string{compression.Gzip, compression.Deflate, compression.Zstd, compression.Identity} {
+		t.Run(encoding, func(t *testing.T) {
+			received = nil
+			mc := NewMonitoringClient(ts.Client(), zap.NewNop(), Config{
+				ServerAddress:    strings.TrimPrefix(ts.URL, "http://"),
+				Compression:      encoding,
+				CompressionLevel: compression.DefaultLevel,
+			}, nil)
+
+			value := 1.5
+			batch := metrics.MetricsList{{ID: "Alloc", MType: "gauge", Value: &value}}
+			require.NoError(t, mc.SendMetrics(context.Background(), batch))
+			assert.Equal(t, batch, received)
+		})
+	}
+}
+
+func TestShutdownMovesBufferToOutbox(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t)
+
+	box, err := outbox.Open(dir, outbox.Options{})
+	require.NoError(t, err)
+	mc, counting := newTestClient(ts, Config{})
+	mc.Outbox = box
+	mc.CollectMetrics(context.Background())
+	mc.CollectMetrics(context.Background())
+	mc.Shutdown()
+	assert.Zero(t, pendingPollCount(mc))
+	require.NoError(t, box.Close())
+
+	_, ok := ts.storage.GetCounterMetric("PollCount")
+	require.False(t, ok, "nothing is sent on shutdown")
+
+	box, err = outbox.Open(dir, outbox.Options{})
+	require.NoError(t, err)
+	defer box.Close()
+	mc, _ = newTestClient(ts, Config{})
+	mc.Outbox = box
+	mc.StartReporting(context.Background())
+
+	value, ok := ts.storage.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, counting.polls.Load(), value)
+}
@@ -2,9 +2,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/collector"
+	"github.com/personage-hub/metrics-tracker/internal/compression"
+	"github.com/personage-hub/metrics-tracker/internal/hoststats"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/outbox"
 )
 
 type Config struct {
@@ -14,6 +22,99 @@ type Config struct {
 	ReportInterval      time.Duration
 	PollInterval        time.Duration
 	FlagLogLevel        string
+	ProcRoot            string
+	DisabledCollectors  string
+	CollectorTimeout    time.Duration
+	CollectorTimeouts   string
+	ReportWorkers       int
+	BatchSize           int
+	RequestTimeout      time.Duration
+	RetryPolicy         RetryPolicy
+	OutboxDir           string
+	OutboxMaxSize       int64
+	OutboxMaxAge        time.Duration
+	OutboxPolicy        string
+	Key                 string
+	Compression         string
+	CompressionLevel    int
+	Labels              string
+	StatsDAddresses     string
+}
+
+// OutboxOptions returns the outbox settings; the policy must be drop-oldest
+// or drop-newest.
+func (c Config) OutboxOptions() (outbox.Options, error) {
+	var policy outbox.DropPolicy
+	switch c.OutboxPolicy {
+	case "drop-oldest":
+		policy = outbox.DropOldest
+	case "drop-newest":
+		policy = outbox.DropNewest
+	default:
+		return outbox.Options{}, fmt.Errorf("invalid outbox policy %q: want drop-oldest or drop-newest", c.OutboxPolicy)
+	}
+	return outbox.Options{
+		MaxBytes: c.OutboxMaxSize,
+		MaxAge:   c.OutboxMaxAge,
+		Policy:   policy,
+	}, nil
+}
+
+// parseCollectorSet parses a comma separated list of collector names.
+func parseCollectorSet(value string) map[string]bool {
+	result := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			result[name] = true
+		}
+	}
+	return result
+}
+
+// parseCollectorTimeouts parses "name=duration" pairs separated by commas,
+// e.g. "host=2s,runtime=500ms". Malformed pairs are skipped.
+func parseCollectorTimeouts(value string) map[string]time.Duration {
+	result := make(map[string]time.Duration)
+	for _, pair := range strings.Split(value, ",") {
+		name, rawTimeout, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		timeout, err := time.ParseDuration(rawTimeout)
+		if err != nil {
+			continue
+		}
+		result[strings.TrimSpace(name)] = timeout
+	}
+	return result
+}
+
+func (c Config) CollectorOptions() collector.Options {
+	return collector.Options{
+		Disabled:       parseCollectorSet(c.DisabledCollectors),
+		Timeouts:       parseCollectorTimeouts(c.CollectorTimeouts),
+		DefaultTimeout: c.CollectorTimeout,
+	}
+}
+
+// StaticLabels parses the labels attached to every reported metric, given
+// as "name=value" pairs separated by commas, e.g. "host=web1,env=prod".
+func (c Config) StaticLabels() (metrics.Labels, error) {
+	labels := make(metrics.Labels)
+	for _, pair := range strings.Split(c.Labels, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q: want name=value", pair)
+		}
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	if err := metrics.ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
 }
 
 func parseFlag() Config {
@@ -23,6 +124,77 @@ func parseFlag() Config {
 	flag.IntVar(&config.ReportIntervalParam, "r", 10, "Report interval for sending metrics to the server")
 	flag.IntVar(&config.PollIntervalParam, "p", 2, "Poll interval for collecting metrics")
 	flag.StringVar(&config.FlagLogLevel, "l", "info", "Logging level")
+	flag.StringVar(&config.ProcRoot, "proc", hoststats.DefaultProcRoot, "Mount point of procfs used for host metrics")
+	flag.StringVar(
+		&config.DisabledCollectors,
+		"disable-collectors",
+		"",
+		"Comma separated list of collectors to disable (runtime, poll, host)",
+	)
+	flag.DurationVar(
+		&config.CollectorTimeout,
+		"collector-timeout",
+		collector.DefaultTimeout,
+		"Default time limit for a single collector poll",
+	)
+	flag.StringVar(
+		&config.CollectorTimeouts,
+		"collector-timeouts",
+		"",
+		"Per collector time limits as name=duration pairs, e.g. host=2s,runtime=500ms",
+	)
+	flag.IntVar(&config.ReportWorkers, "w", 2, "Maximum number of concurrent requests to the server")
+	flag.IntVar(&config.BatchSize, "b", 0, "Maximum number of metrics per request (0 sends everything at once)")
+	flag.DurationVar(&config.RequestTimeout, "timeout", 5*time.Second, "Time limit for a single request to the server")
+	flag.IntVar(&config.RetryPolicy.MaxRetries, "retries", 3, "Number of retries for a failed request")
+	flag.DurationVar(&config.RetryPolicy.BaseDelay, "retry-base", time.Second, "Delay before the first retry")
+	flag.DurationVar(&config.RetryPolicy.MaxDelay, "retry-max", 5*time.Second, "Upper limit for the delay between retries")
+	flag.StringVar(
+		&config.OutboxDir,
+		"outbox",
+		"",
+		"Directory of the on-disk queue for unsent metrics (an empty value keeps them in memory only)",
+	)
+	flag.Int64Var(&config.OutboxMaxSize, "outbox-max-size", 64<<20, "Maximum size in bytes of unsent metrics on disk")
+	flag.DurationVar(&config.OutboxMaxAge, "outbox-max-age", 24*time.Hour, "Unsent metrics older than this are discarded")
+	flag.StringVar(
+		&config.OutboxPolicy,
+		"outbox-policy",
+		"drop-oldest",
+		"What to discard when the outbox is full: drop-oldest or drop-newest",
+	)
+	flag.StringVar(
+		&config.Key,
+		"k",
+		"",
+		"Key for HMAC-SHA256 signatures, either a single secret or comma separated id:secret pairs "+
+			"with the signing key first (an empty value disables signatures)",
+	)
+	flag.StringVar(
+		&config.Compression,
+		"compress",
+		compression.Gzip,
+		"Request body compression: gzip, deflate, zstd or identity",
+	)
+	flag.IntVar(
+		&config.CompressionLevel,
+		"compress-level",
+		compression.DefaultLevel,
+		"Compression level, 1-9 for gzip and deflate, 1-22 for zstd (-1 selects the default)",
+	)
+	flag.StringVar(
+		&config.Labels,
+		"labels",
+		"",
+		"Labels attached to every reported metric as name=value pairs, e.g. host=web1,env=prod",
+	)
+	flag.StringVar(
+		&config.StatsDAddresses,
+		"statsd",
+		"",
+		"Comma separated StatsD listen addresses, e.g. udp://:8125,unixgram:///run/statsd.sock "+
+			"(an empty value disables the StatsD listener)",
+	)
 	flag.Parse()
 
 	if envValue := os.Getenv("ADDRESS"); envValue != "" {
@@ -38,6 +210,85 @@ func parseFlag() Config {
 			config.PollIntervalParam = intValue
 		}
 	}
+	if envValue := os.Getenv("HOST_PROC"); envValue != "" {
+		config.ProcRoot = envValue
+	}
+	if envValue := os.Getenv("DISABLE_COLLECTORS"); envValue != "" {
+		config.DisabledCollectors = envValue
+	}
+	if envValue := os.Getenv("COLLECTOR_TIMEOUT"); envValue != "" {
+		if duration, err := time.ParseDuration(envValue); err == nil {
+			config.CollectorTimeout = duration
+		}
+	}
+	if envValue := os.Getenv("COLLECTOR_TIMEOUTS"); envValue != "" {
+		config.CollectorTimeouts = envValue
+	}
+
+	if envValue := os.Getenv("REPORT_WORKERS"); envValue != "" {
+		if intValue, err := strconv.Atoi(envValue); err == nil {
+			config.ReportWorkers = intValue
+		}
+	}
+	if envValue := os.Getenv("BATCH_SIZE"); envValue != "" {
+		if intValue, err := strconv.Atoi(envValue); err == nil {
+			config.BatchSize = intValue
+		}
+	}
+	if envValue := os.Getenv("REQUEST_TIMEOUT"); envValue != "" {
+		if duration, err := time.ParseDuration(envValue); err == nil {
+			config.RequestTimeout = duration
+		}
+	}
+	if envValue := os.Getenv("SEND_RETRIES"); envValue != "" {
+		if intValue, err := strconv.Atoi(envValue); err == nil {
+			config.RetryPolicy.MaxRetries = intValue
+		}
+	}
+	if envValue := os.Getenv("RETRY_BASE_DELAY"); envValue != "" {
+		if duration, err := time.ParseDuration(envValue); err == nil {
+			config.RetryPolicy.BaseDelay = duration
+		}
+	}
+	if envValue := os.Getenv("RETRY_MAX_DELAY"); envValue != "" {
+		if duration, err := time.ParseDuration(envValue); err == nil {
+			config.RetryPolicy.MaxDelay = duration
+		}
+	}
+	if envValue := os.Getenv("OUTBOX_DIR"); envValue != "" {
+		config.OutboxDir = envValue
+	}
+	if envValue := os.Getenv("OUTBOX_MAX_SIZE"); envValue != "" {
+		if intValue, err := strconv.ParseInt(envValue, 10, 64); err == nil {
+			config.OutboxMaxSize = intValue
+		}
+	}
+	if envValue := os.Getenv("OUTBOX_MAX_AGE"); envValue != "" {
+		if duration, err := time.ParseDuration(envValue); err == nil {
+			config.OutboxMaxAge = duration
+		}
+	}
+	if envValue := os.Getenv("OUTBOX_POLICY"); envValue != "" {
+		config.OutboxPolicy = envValue
+	}
+	if envValue := os.Getenv("KEY"); envValue != "" {
+		config.Key = envValue
+	}
+	if envValue := os.Getenv("COMPRESSION"); envValue != "" {
+		config.Compression = envValue
+	}
+	if envValue := os.Getenv("COMPRESSION_LEVEL"); envValue != "" {
+		if intValue, err := strconv.Atoi(envValue); err == nil {
+			config.CompressionLevel = intValue
+		}
+	}
+
+	if envValue := os.Getenv("LABELS"); envValue != "" {
+		config.Labels = envValue
+	}
+	if envValue := os.Getenv("STATSD_ADDRESS"); envValue != "" {
+		config.StatsDAddresses = envValue
+	}
 
 	config.ReportInterval = time.Duration(config.ReportIntervalParam) * time.Second
 	config.PollInterval = time.Duration(config.PollIntervalParam) * time.Second
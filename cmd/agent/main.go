@@ -2,11 +2,18 @@ package main
 
 import (
 	"context"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"github.com/personage-hub/metrics-tracker/internal/collector"
+	"github.com/personage-hub/metrics-tracker/internal/compression"
 	"github.com/personage-hub/metrics-tracker/internal/logger"
+	"github.com/personage-hub/metrics-tracker/internal/outbox"
+	"github.com/personage-hub/metrics-tracker/internal/signature"
+	"github.com/personage-hub/metrics-tracker/internal/statsd"
 	"go.uber.org/zap"
 	"net/http"
 )
@@ -21,11 +28,65 @@ func main() {
 
 	log.Info("Running agent", zap.String("Server address", config.ServerAddress))
 
-	mc := NewMonitoringClient(http.DefaultClient, log, config)
+	registry := collector.NewRegistry(log, config.CollectorOptions())
+	registry.Register(collector.NewRuntimeCollector())
+	registry.Register(collector.NewPollCollector())
+	registry.Register(collector.NewHostCollector(config.ProcRoot))
+	log.Info("Collectors enabled", zap.Strings("collectors", registry.Names()))
+
+	if !compression.Supported(config.Compression) {
+		log.Fatal("unsupported compression", zap.String("compression", config.Compression))
+	}
+	// An invalid level would make every send fail, check it once up front.
+	if w, err := compression.NewWriter(config.Compression, io.Discard, config.CompressionLevel); err != nil {
+		log.Fatal("invalid compression level", zap.Int("level", config.CompressionLevel), zap.Error(err))
+	} else {
+		w.Close()
+	}
+
+	keys, err := signature.ParseKeyRing(config.Key)
+	if err != nil {
+		log.Fatal("invalid signature key", zap.Error(err))
+	}
+
+	labels, err := config.StaticLabels()
+	if err != nil {
+		log.Fatal("invalid labels", zap.Error(err))
+	}
+
+	outboxOptions, err := config.OutboxOptions()
+	if err != nil {
+		log.Fatal("invalid outbox settings", zap.Error(err))
+	}
+
+	mc := NewMonitoringClient(http.DefaultClient, log, config, registry)
+	mc.Keys = keys
+	mc.Labels = labels
+	if config.StatsDAddresses != "" {
+		stop, err := startStatsD(config.StatsDAddresses, mc, log)
+		if err != nil {
+			log.Fatal("failed to start StatsD listener", zap.Error(err))
+		}
+		defer stop()
+	}
+	if config.OutboxDir != "" {
+		box, err := outbox.Open(config.OutboxDir, outboxOptions)
+		if err != nil {
+			log.Error("outbox unavailable, unsent metrics are kept in memory only", zap.Error(err))
+		} else {
+			defer box.Close()
+			log.Info("Outbox opened", zap.String("dir", config.OutboxDir), zap.Int("pending", box.Len()))
+			mc.Outbox = box
+		}
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go mc.StartMonitoring(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mc.StartMonitoring(ctx)
+	}()
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -33,4 +94,42 @@ func main() {
 	sig := <-sigCh
 	log.Info("Received signal", zap.String("signal", sig.String()))
 	cancel()
+	<-done
+	mc.Shutdown()
+}
+
+// startStatsD listens on every address and makes mc report the aggregated
+// StatsD metrics. The returned func closes the listeners.
+func startStatsD(addresses string, mc *MonitoringClient, log *zap.Logger) (func(), error) {
+	aggregator := statsd.NewAggregator()
+	var listeners []*statsd.Listener
+	stop := func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}
+	for _, value := range strings.Split(addresses, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		network, address, err := statsd.ParseAddress(value)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		l, err := statsd.Listen(network, address, aggregator, log)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		log.Info("StatsD listener started", zap.String("network", network), zap.String("address", address))
+		go func() {
+			if err := l.Serve(); err != nil {
+				log.Error("StatsD listener failed", zap.Error(err))
+			}
+		}()
+	}
+	mc.StatsD = aggregator
+	return stop, nil
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/retry"
+)
+
+// SendError describes a batch the server did not accept. StatusCode is zero
+// when no response was received at all.
+type SendError struct {
+	StatusCode int
+	Retriable  bool
+	Attempts   int
+	Err        error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("failed send metrics after %d attempt(s): %v", e.Attempts, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetriable reports whether err is a SendError worth repeating later.
+func IsRetriable(err error) bool {
+	var sendErr *SendError
+	return errors.As(err, &sendErr) && sendErr.Retriable
+}
+
+// retriableStatus reports whether a response status is a transient failure:
+// server errors and throttling are retried, other client errors are not.
+func retriableStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+}
+
+type RetryPolicy = retry.Policy
+
+// maxRetryAfter bounds the delay a server can ask for with Retry-After.
+const maxRetryAfter = 10 * time.Minute
+
+// retryDelay returns the wait before retry number attempt. A longer
+// Retry-After delay from the server is honored up to MaxDelay, or up to
+// maxRetryAfter without one.
+func retryDelay(p RetryPolicy, attempt int, retryAfter time.Duration) time.Duration {
+	delay := p.Backoff(attempt)
+	if retryAfter <= delay {
+		return delay
+	}
+	limit := p.MaxDelay
+	if limit <= 0 || limit > maxRetryAfter {
+		limit = maxRetryAfter
+	}
+	if retryAfter > limit {
+		retryAfter = limit
+	}
+	if retryAfter > delay {
+		return retryAfter
+	}
+	return delay
+}
+
+// parseRetryAfter understands both forms of the Retry-After header: a number
+// of seconds and an HTTP date. Delays beyond maxRetryAfter are cut to it.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int(maxRetryAfter/time.Second) {
+			return maxRetryAfter, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		switch {
+		case delay <= 0:
+			return 0, true
+		case delay > maxRetryAfter:
+			return maxRetryAfter, true
+		}
+		return delay, true
+	}
+	return 0, false
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSendMetricsRetries(t *testing.T) {
+	type want struct {
+		err        bool
+		retriable  bool
+		statusCode int
+		attempts   int64
+	}
+	tests := []struct {
+		name     string
+		statuses []int
+		delay    time.Duration
+		want     want
+	}{
+		{
+			name:     "Success without retries",
+			statuses: []int{http.StatusOK},
+			want:     want{attempts: 1},
+		},
+		{
+			name:     "Server errors are retried",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK},
+			want:     want{attempts: 3},
+		},
+		{
+			name:     "Throttling is retried",
+			statuses: []int{http.StatusTooManyRequests, http.StatusOK},
+			want:     want{attempts: 2},
+		},
+		{
+			name:     "Validation errors are not retried",
+			statuses: []int{http.StatusBadRequest},
+			want:     want{err: true, statusCode: http.StatusBadRequest, attempts: 1},
+		},
+		{
+			name: "Retries are exhausted",
+			statuses: []int{
+				http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway,
+			},
+			want: want{err: true, retriable: true, statusCode: http.StatusBadGateway, attempts: 4},
+		},
+		{
+			name:     "Slow responses time out",
+			statuses: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK},
+			delay:    time.Second,
+			want:     want{err: true, retriable: true, attempts: 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := attempts.Add(1)
+				if tt.delay > 0 {
+					select {
+					case <-time.After(tt.delay):
+					case <-r.Context().Done():
+						return
+					}
+				}
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer ts.Close()
+
+			mc := NewMonitoringClient(ts.Client(), zap.NewNop(), Config{
+				ServerAddress:  strings.TrimPrefix(ts.URL, "http://"),
+				RequestTimeout: 50 * time.Millisecond,
+				RetryPolicy: RetryPolicy{
+					MaxRetries: 3,
+					BaseDelay:  time.Millisecond,
+					MaxDelay:   5 * time.Millisecond,
+				},
+			}, nil)
+
+			err := mc.SendMetrics(context.Background(), metrics.MetricsList{})
+			assert.Equal(t, tt.want.attempts, attempts.Load())
+			if !tt.want.err {
+				require.NoError(t, err)
+				return
+			}
+			var sendErr *SendError
+			require.ErrorAs(t, err, &sendErr)
+			assert.Equal(t, tt.want.retriable, IsRetriable(err))
+			assert.Equal(t, tt.want.statusCode, sendErr.StatusCode)
+			assert.Equal(t, int(tt.want.attempts), sendErr.Attempts)
+		})
+	}
+}
+
+func TestSendMetricsHonorsRetryAfter(t *testing.T) {
+	var attempts atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	mc := NewMonitoringClient(ts.Client(), zap.NewNop(), Config{
+		ServerAddress: strings.TrimPrefix(ts.URL, "http://"),
+		RetryPolicy:   RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond},
+	}, nil)
+
+	start := time.Now()
+	require.NoError(t, mc.SendMetrics(context.Background(), metrics.MetricsList{}))
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Equal(t, int64(2), attempts.Load())
+}
+
+func TestSendMetricsCapsRetryAfter(t *testing.T) {
+	var attempts atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	mc := NewMonitoringClient(ts.Client(), zap.NewNop(), Config{
+		ServerAddress: strings.TrimPrefix(ts.URL, "http://"),
+		RetryPolicy:   RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond},
+	}, nil)
+
+	start := time.Now()
+	require.NoError(t, mc.SendMetrics(context.Background(), metrics.MetricsList{}))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, int64(2), attempts.Load())
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	assert.Equal(t, 500*time.Millisecond, retryDelay(policy, 0, 500*time.Millisecond))
+	assert.Equal(t, time.Second, retryDelay(policy, 0, time.Hour))
+	assert.LessOrEqual(t, retryDelay(policy, 0, time.Millisecond), 100*time.Millisecond)
+
+	unbounded := RetryPolicy{BaseDelay: time.Millisecond}
+	assert.Equal(t, maxRetryAfter, retryDelay(unbounded, 0, time.Hour))
+}
+
+func TestSendMetricsStopsOnCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	mc := NewMonitoringClient(ts.Client(), zap.NewNop(), Config{
+		ServerAddress: strings.TrimPrefix(ts.URL, "http://"),
+		RetryPolicy:   RetryPolicy{MaxRetries: 10, BaseDelay: time.Hour},
+	}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := mc.SendMetrics(ctx, metrics.MetricsList{})
+	require.Error(t, err)
+	assert.False(t, IsRetriable(err))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "3", want: 3 * time.Second, ok: true},
+		{value: "-1", ok: false},
+		{value: "Fri, 01 Sep 2023 12:00:05 GMT", want: 5 * time.Second, ok: true},
+		{value: "Fri, 01 Sep 2023 11:00:00 GMT", want: 0, ok: true},
+		{value: "soon", ok: false},
+		{value: "86400", want: maxRetryAfter, ok: true},
+		{value: "99999999999999999", want: maxRetryAfter, ok: true},
+		{value: "Sat, 02 Sep 2023 12:00:00 GMT", want: maxRetryAfter, ok: true},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		assert.Equal(t, tt.ok, ok, tt.value)
+		assert.Equal(t, tt.want, got, tt.value)
+	}
+}
@@ -5,6 +5,11 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/history"
+	"github.com/personage-hub/metrics-tracker/internal/notify"
+	"github.com/personage-hub/metrics-tracker/internal/wal"
 )
 
 type Config struct {
@@ -13,6 +18,27 @@ type Config struct {
 	StoreInterval int64
 	FileStorage   string
 	Restore       bool
+	Key           string
+	// ShutdownTimeout bounds how long in-flight requests are drained on exit.
+	ShutdownTimeout time.Duration
+	// WALDir enables the write-ahead log of the storage when set.
+	WALDir         string
+	WALSync        string
+	WALSegmentSize int64
+	// DatabaseDSN selects a database storage, sqlite:///path or bolt:///path,
+	// instead of the in-memory one.
+	DatabaseDSN string
+	// HistoryRetention enables metric history for range queries when set.
+	HistoryRetention time.Duration
+	HistorySamples   int
+	// AlertRules is the rules file of the alerting engine, which is off
+	// when it is empty.
+	AlertRules    string
+	AlertInterval time.Duration
+	// AlertWebhooks lists the URLs notified of alert state changes.
+	AlertWebhooks       string
+	AlertRepeatInterval time.Duration
+	AlertWebhookRetries int
 }
 
 func isValidPath(path string) bool {
@@ -56,6 +82,89 @@ func parseFlags() Config {
 		true,
 		"A boolean setting that dictates if the server should load values saved earlier from storage upon startup ",
 	)
+	flag.StringVar(
+		&config.Key,
+		"k",
+		"",
+		"Key for HMAC-SHA256 signatures, either a single secret or comma separated id:secret pairs "+
+			"with the signing key first (an empty value disables signatures)",
+	)
+
+	flag.DurationVar(
+		&config.ShutdownTimeout,
+		"shutdown-timeout",
+		10*time.Second,
+		"How long to wait for in-flight requests on shutdown",
+	)
+	flag.StringVar(
+		&config.WALDir,
+		"wal",
+		"",
+		"Directory of the write-ahead log replayed on top of the saved data at startup "+
+			"(an empty value disables the log)",
+	)
+	flag.StringVar(
+		&config.WALSync,
+		"wal-sync",
+		"always",
+		"When the write-ahead log is synced to disk: always, os, or an interval such as 100ms",
+	)
+	flag.Int64Var(
+		&config.WALSegmentSize,
+		"wal-segment-size",
+		wal.DefaultSegmentSize,
+		"Size in bytes after which the write-ahead log starts a new segment file",
+	)
+	flag.StringVar(
+		&config.DatabaseDSN,
+		"d",
+		"",
+		"Database to keep metrics in, sqlite:///path/metrics.db or bolt:///path/metrics.bolt "+
+			"(an empty value keeps them in memory)",
+	)
+
+	flag.DurationVar(
+		&config.HistoryRetention,
+		"history-retention",
+		0,
+		"How long samples are kept for range queries (a value of 0 disables metric history)",
+	)
+	flag.IntVar(
+		&config.HistorySamples,
+		"history-samples",
+		history.DefaultMaxSamples,
+		"The most samples kept in metric history across all metrics",
+	)
+	flag.StringVar(
+		&config.AlertRules,
+		"alert-rules",
+		"",
+		"JSON file of alert rules, reloaded when it changes or on SIGHUP (an empty value disables alerting)",
+	)
+	flag.DurationVar(
+		&config.AlertInterval,
+		"alert-interval",
+		15*time.Second,
+		"How often alert rules are evaluated",
+	)
+	flag.StringVar(
+		&config.AlertWebhooks,
+		"alert-webhooks",
+		"",
+		"Comma separated webhook URLs that alert state changes are posted to",
+	)
+	flag.DurationVar(
+		&config.AlertRepeatInterval,
+		"alert-repeat-interval",
+		notify.DefaultRepeatInterval,
+		"How often a still firing alert group is notified again",
+	)
+	flag.IntVar(
+		&config.AlertWebhookRetries,
+		"alert-webhook-retries",
+		notify.DefaultRetryPolicy.MaxRetries,
+		"Number of retries for a failed webhook notification",
+	)
 
 	if envValue := os.Getenv("ADDRESS"); envValue != "" {
 		config.ServerAddress = envValue
@@ -63,10 +172,11 @@ func parseFlags() Config {
 	flag.Parse()
 	if envValue := os.Getenv("STORE_INTERVAL"); envValue != "" {
 		val, err := strconv.ParseInt(envValue, 10, 64)
-		if err == nil {
+		if err != nil {
 			_ = fmt.Errorf("failed parse interval value: %w", err)
+		} else {
+			config.StoreInterval = val
 		}
-		config.StoreInterval = val
 	}
 	if envValue := os.Getenv("FILE_STORAGE_PATH"); envValue != "" {
 		if isValidPath(envValue) {
@@ -80,5 +190,58 @@ func parseFlags() Config {
 		}
 		config.Restore = boolValue
 	}
+	if envValue := os.Getenv("KEY"); envValue != "" {
+		config.Key = envValue
+	}
+	if envValue := os.Getenv("WAL_DIR"); envValue != "" {
+		config.WALDir = envValue
+	}
+	if envValue := os.Getenv("WAL_SYNC"); envValue != "" {
+		config.WALSync = envValue
+	}
+	if envValue := os.Getenv("WAL_SEGMENT_SIZE"); envValue != "" {
+		if size, err := strconv.ParseInt(envValue, 10, 64); err == nil {
+			config.WALSegmentSize = size
+		}
+	}
+	if envValue := os.Getenv("DATABASE_DSN"); envValue != "" {
+		config.DatabaseDSN = envValue
+	}
+	if envValue := os.Getenv("SHUTDOWN_TIMEOUT"); envValue != "" {
+		if timeout, err := time.ParseDuration(envValue); err == nil {
+			config.ShutdownTimeout = timeout
+		}
+	}
+	if envValue := os.Getenv("HISTORY_RETENTION"); envValue != "" {
+		if retention, err := time.ParseDuration(envValue); err == nil {
+			config.HistoryRetention = retention
+		}
+	}
+	if envValue := os.Getenv("HISTORY_SAMPLES"); envValue != "" {
+		if samples, err := strconv.Atoi(envValue); err == nil {
+			config.HistorySamples = samples
+		}
+	}
+	if envValue := os.Getenv("ALERT_RULES"); envValue != "" {
+		config.AlertRules = envValue
+	}
+	if envValue := os.Getenv("ALERT_INTERVAL"); envValue != "" {
+		if interval, err := time.ParseDuration(envValue); err == nil {
+			config.AlertInterval = interval
+		}
+	}
+	if envValue := os.Getenv("ALERT_WEBHOOKS"); envValue != "" {
+		config.AlertWebhooks = envValue
+	}
+	if envValue := os.Getenv("ALERT_REPEAT_INTERVAL"); envValue != "" {
+		if interval, err := time.ParseDuration(envValue); err == nil {
+			config.AlertRepeatInterval = interval
+		}
+	}
+	if envValue := os.Getenv("ALERT_WEBHOOK_RETRIES"); envValue != "" {
+		if retries, err := strconv.Atoi(envValue); err == nil {
+			config.AlertWebhookRetries = retries
+		}
+	}
 	return config
 }
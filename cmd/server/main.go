@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/personage-hub/metrics-tracker/internal/alerting"
 	"github.com/personage-hub/metrics-tracker/internal/dumper"
+	"github.com/personage-hub/metrics-tracker/internal/history"
 	"github.com/personage-hub/metrics-tracker/internal/logger"
 	"github.com/personage-hub/metrics-tracker/internal/middlewares"
+	"github.com/personage-hub/metrics-tracker/internal/notify"
+	"github.com/personage-hub/metrics-tracker/internal/signature"
 	"github.com/personage-hub/metrics-tracker/internal/storage"
+	"github.com/personage-hub/metrics-tracker/internal/wal"
 	"go.uber.org/zap"
 )
 
@@ -18,6 +30,36 @@ func main() {
 		panic(err)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, config, log); err != nil {
+		log.Error("server stopped with error", zap.Error(err))
+		os.Exit(1)
+	}
+	log.Info("server stopped")
+}
+
+// run serves until ctx is done or the data can no longer be saved, then
+// drains in-flight requests and writes a final dump.
+func run(ctx context.Context, config Config, log *zap.Logger) error {
+	if config.StoreInterval < 0 {
+		return fmt.Errorf("store interval must not be negative, got %d", config.StoreInterval)
+	}
+	keys, err := signature.ParseKeyRing(config.Key)
+	if err != nil {
+		return fmt.Errorf("invalid signature key: %w", err)
+	}
+
+	if config.DatabaseDSN != "" {
+		db, closeDB, err := openDatabase(config.DatabaseDSN, log)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+		return serve(ctx, config, log, keys, db)
+	}
+
 	d := dumper.NewDumper(config.FileStorage)
 	s, err := storage.NewMemStorage(d, config.Restore)
 
@@ -27,19 +69,210 @@ func main() {
 		log.Info("restore successfully complete")
 	}
 
-	go s.PeriodicSave(config.StoreInterval)
+	if config.WALDir != "" {
+		if config.FileStorage == "" {
+			return errors.New("the write-ahead log needs a dump file to be truncated into")
+		}
+		policy, interval, err := wal.ParseSyncPolicy(config.WALSync)
+		if err != nil {
+			return err
+		}
+		w, err := wal.Open(config.WALDir, wal.Options{
+			SegmentSize:  config.WALSegmentSize,
+			Sync:         policy,
+			SyncInterval: interval,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to open wal: %w", err)
+		}
+		defer w.Close()
+		if err := s.AttachWAL(w, config.Restore); err != nil {
+			return err
+		}
+	}
 
-	log.Info("Running server", zap.String("address", config.ServerAddress))
-	server := NewServer(s, log)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	saveErr := make(chan error, 1)
+	switch {
+	case config.FileStorage == "":
+		log.Info("disk writing disabled")
+	case config.StoreInterval == 0:
+		// Synchronous mode has to be on before the first request arrives.
+		s.PeriodicSave(ctx, 0)
+	default:
+		go func() {
+			err := s.PeriodicSave(ctx, config.StoreInterval)
+			saveErr <- err
+			if err != nil {
+				cancel()
+			}
+		}()
+	}
+
+	runErr := serve(ctx, config, log, keys, s)
+
+	cancel()
+	if config.FileStorage == "" {
+		return runErr
+	}
+	if config.StoreInterval != 0 {
+		if err := <-saveErr; err != nil {
+			runErr = errors.Join(runErr, err)
+		}
+	}
+	if err := s.Save(); err != nil {
+		return errors.Join(runErr, fmt.Errorf("failed to write final dump: %w", err))
+	}
+	log.Info("final dump written", zap.String("path", config.FileStorage))
+	return runErr
+}
+
+// openDatabase opens the storage named by a DSN such as sqlite:///path or
+// bolt:///path.
+func openDatabase(dsn string, log *zap.Logger) (storage.Storage, func() error, error) {
+	scheme, path, ok := strings.Cut(dsn, "://")
+	if !ok || path == "" {
+		return nil, nil, fmt.Errorf("invalid database DSN %q: want scheme://path", dsn)
+	}
+	switch scheme {
+	case "sqlite":
+		s, err := storage.NewSQLiteStorage(path, log)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Info("using sqlite storage", zap.String("path", path))
+		return s, s.Close, nil
+	case "bolt":
+		s, err := storage.NewBoltStorage(path, log)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Info("using bolt storage", zap.String("path", path))
+		return s, s.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported database %q", scheme)
+}
+
+// startAlerting loads the alert rules and evaluates them in the background,
+// notifying the configured webhooks. The returned func stops evaluation and
+// then the notifier, so no notification is queued after it is closed; its
+// ctx bounds how long queued notifications are still delivered.
+func startAlerting(ctx context.Context, config Config, log *zap.Logger, s storage.Storage) (*alerting.Engine, func(context.Context), error) {
+	if config.AlertInterval <= 0 {
+		return nil, nil, errors.New("alert interval must be positive")
+	}
+	engine, err := alerting.NewEngine(config.AlertRules, s, log)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load alert rules: %w", err)
+	}
+
+	var notifier *notify.Notifier
+	if config.AlertWebhooks != "" {
+		var receivers []notify.Receiver
+		for _, url := range strings.Split(config.AlertWebhooks, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				retry := notify.DefaultRetryPolicy
+				retry.MaxRetries = config.AlertWebhookRetries
+				receivers = append(receivers, notify.Receiver{URL: url, Retry: retry})
+			}
+		}
+		notifier = notify.New(notify.Options{
+			Receivers:      receivers,
+			RepeatInterval: config.AlertRepeatInterval,
+		}, log)
+		engine.SetNotifier(notifier)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		engine.Run(ctx, config.AlertInterval)
+	}()
+	go reloadOnHangup(ctx, engine, log)
+	return engine, func(closeCtx context.Context) {
+		cancel()
+		<-done
+		if notifier != nil {
+			notifier.Close(closeCtx)
+		}
+	}, nil
+}
+
+// reloadOnHangup reloads the alert rules on every SIGHUP until ctx is done.
+func reloadOnHangup(ctx context.Context, engine *alerting.Engine, log *zap.Logger) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := engine.Reload(); err != nil {
+				log.Error("failed to reload alert rules, keeping the current ones", zap.Error(err))
+				continue
+			}
+			log.Info("alert rules reloaded")
+		}
+	}
+}
+
+// newRouter wraps the metric routes in the middlewares every request goes
+// through. keys may be nil to accept unsigned requests.
+func newRouter(server *Server, keys *signature.KeyRing) http.Handler {
 	r := chi.NewRouter()
 	r.Use(middlewares.RequestWithLogging(server.logger))
-	r.Use(middlewares.GzipHandler)
+	r.Use(middlewares.CompressionHandler)
+	if keys != nil {
+		r.Use(middlewares.HashHandler(keys))
+	}
 	r.Mount("/", server.MetricRoute())
+	return r
+}
 
-	err = http.ListenAndServe(config.ServerAddress, r)
+// serve handles requests until ctx is done, then drains in-flight requests.
+func serve(ctx context.Context, config Config, log *zap.Logger, keys *signature.KeyRing, s storage.Storage) error {
+	log.Info("Running server", zap.String("address", config.ServerAddress))
+	server := NewServer(s, log)
+	if config.HistoryRetention > 0 {
+		server.history = history.New(history.Options{
+			Retention:  config.HistoryRetention,
+			MaxSamples: config.HistorySamples,
+		})
+	}
+	var stopAlerting func(context.Context)
+	if config.AlertRules != "" {
+		engine, stop, err := startAlerting(ctx, config, log, s)
+		if err != nil {
+			return err
+		}
+		stopAlerting = stop
+		server.alerts = engine
+	}
+	httpServer := &http.Server{Addr: config.ServerAddress, Handler: newRouter(server, keys)}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
 
-	if err != nil {
-		log.Fatal("Error in server:", zap.Error(err))
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Info("shutting down server")
+	case err := <-serveErr:
+		runErr = fmt.Errorf("error in server: %w", err)
 	}
 
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Error("failed to drain in-flight requests", zap.Error(err))
+	}
+	if stopAlerting != nil {
+		stopAlerting(shutdownCtx)
+	}
+	return runErr
 }
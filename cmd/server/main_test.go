@@ -4,205 +4,851 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/personage-hub/metrics-tracker/internal/alerting"
 	"github.com/personage-hub/metrics-tracker/internal/dumper"
+	"github.com/personage-hub/metrics-tracker/internal/history"
 	"github.com/personage-hub/metrics-tracker/internal/logger"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/mailru/easyjson"
 	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/middlewares"
+	"github.com/personage-hub/metrics-tracker/internal/signature"
 	"github.com/personage-hub/metrics-tracker/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
-func TestUpdateMetricFunc(t *testing.T) {
-	keeper := dumper.NewDumper("/tmp/temp.json")
-	s, _ := storage.NewMemStorage(keeper, false)
-	log, _ := logger.Initialize("info")
-	server := NewServer(s, log)
-	type want struct {
-		statusCode int
-	}
-	tests := []struct {
-		name    string
-		request string
-		server  *Server
-		method  string
-		metric  metrics.Metrics
-		want    want
-	}{
-		{
-			name:    "Success Update gauge value",
-			request: "/update",
-			server:  server,
-			method:  http.MethodPost,
-			metric: metrics.Metrics{
-				ID:    "someMetric",
-				MType: "gauge",
-				Value: func() *float64 { v := 543.01; return &v }(),
-			},
-			want: want{
-				statusCode: http.StatusOK,
-			},
-		},
-		{
-			name:    "Fail Update gauge value",
-			request: "/update",
-			server:  server,
-			method:  http.MethodPost,
-			metric: metrics.Metrics{
-				ID:    "someMetric",
-				MType: "gauge",
-			},
-			want: want{
-				statusCode: http.StatusBadRequest,
-			},
+type testBackend struct {
+	name string
+	open func(t *testing.T) storage.Storage
+}
+
+// testBackends lists the storages the handler tests run against.
+var testBackends = []testBackend{
+	{
+		name: "memory",
+		open: func(t *testing.T) storage.Storage {
+			s, _ := storage.NewMemStorage(dumper.NewDumper(t.TempDir()+"/dump.json"), false)
+			return s
 		},
-		{
-			name:    "Success Counter gauge value",
-			request: "/update",
-			server:  server,
-			method:  http.MethodPost,
-			metric: metrics.Metrics{
-				ID:    "someMetric",
-				MType: "counter",
-				Delta: func() *int64 { v := int64(5456); return &v }(),
-			},
-			want: want{
-				statusCode: http.StatusOK,
-			},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T) storage.Storage {
+			s, err := storage.NewSQLiteStorage(t.TempDir()+"/metrics.db", zap.NewNop())
+			require.NoError(t, err)
+			t.Cleanup(func() { s.Close() })
+			return s
 		},
-		{
-			name:    "Fail Update Counter value",
-			request: "/update",
-			server:  server,
-			method:  http.MethodPost,
-			metric: metrics.Metrics{
-				ID:    "someMetric",
-				MType: "counter",
-			},
-			want: want{
-				statusCode: http.StatusBadRequest,
-			},
+	},
+	{
+		name: "bolt",
+		open: func(t *testing.T) storage.Storage {
+			s, err := storage.NewBoltStorage(t.TempDir()+"/metrics.bolt", zap.NewNop())
+			require.NoError(t, err)
+			t.Cleanup(func() { s.Close() })
+			return s
 		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			jsonMetric, _ := json.Marshal(tt.metric)
-			request := httptest.NewRequest(tt.method, tt.request, bytes.NewBuffer(jsonMetric))
-			response := httptest.NewRecorder()
+	},
+}
+
+func TestUpdateMetricFunc(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := backend.open(t)
+			log, _ := logger.Initialize("info")
+			server := NewServer(s, log)
+			type want struct {
+				statusCode int
+			}
+			tests := []struct {
+				name    string
+				request string
+				server  *Server
+				method  string
+				metric  metrics.Metrics
+				want    want
+			}{
+				{
+					name:    "Success Update gauge value",
+					request: "/update",
+					server:  server,
+					method:  http.MethodPost,
+					metric: metrics.Metrics{
+						ID:    "someMetric",
+						MType: "gauge",
+						Value: func() *float64 { v := 543.01; return &v }(),
+					},
+					want: want{
+						statusCode: http.StatusOK,
+					},
+				},
+				{
+					name:    "Fail Update gauge value",
+					request: "/update",
+					server:  server,
+					method:  http.MethodPost,
+					metric: metrics.Metrics{
+						ID:    "someMetric",
+						MType: "gauge",
+					},
+					want: want{
+						statusCode: http.StatusBadRequest,
+					},
+				},
+				{
+					name:    "Success Counter gauge value",
+					request: "/update",
+					server:  server,
+					method:  http.MethodPost,
+					metric: metrics.Metrics{
+						ID:    "someMetric",
+						MType: "counter",
+						Delta: func() *int64 { v := int64(5456); return &v }(),
+					},
+					want: want{
+						statusCode: http.StatusOK,
+					},
+				},
+				{
+					name:    "Fail Update Counter value",
+					request: "/update",
+					server:  server,
+					method:  http.MethodPost,
+					metric: metrics.Metrics{
+						ID:    "someMetric",
+						MType: "counter",
+					},
+					want: want{
+						statusCode: http.StatusBadRequest,
+					},
+				},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					jsonMetric, _ := json.Marshal(tt.metric)
+					request := httptest.NewRequest(tt.method, tt.request, bytes.NewBuffer(jsonMetric))
+					response := httptest.NewRecorder()
 
-			ctx := context.WithValue(request.Context(), chi.RouteCtxKey, chi.NewRouteContext())
-			request = request.WithContext(ctx)
+					ctx := context.WithValue(request.Context(), chi.RouteCtxKey, chi.NewRouteContext())
+					request = request.WithContext(ctx)
 
-			server.updateMetricJSON(response, request)
-			result := response.Result()
-			assert.Equal(t, tt.want.statusCode, result.StatusCode)
-			defer result.Body.Close()
+					server.updateMetricJSON(response, request)
+					result := response.Result()
+					assert.Equal(t, tt.want.statusCode, result.StatusCode)
+					defer result.Body.Close()
+				})
+			}
 		})
 	}
 }
 
 func TestUpdateGaugeMetricStorage(t *testing.T) {
-	type want struct {
-		statusCode int
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			type want struct {
+				statusCode int
+			}
+			tests := []struct {
+				name   string
+				metric string
+				want   want
+			}{
+				{
+					name:   "Success Update gauge value",
+					metric: "{\n    \"id\": \"someMetric\",\n    \"type\": \"gauge\",\n    \"value\": 456.3\n}",
+					want: want{
+						statusCode: http.StatusOK,
+					},
+				},
+				{
+					name:   "Fail Update gauge value",
+					metric: "{\n    \"id\": \"someMetric\",\n    \"type\": \"gauge\",\n    \"value\": \"inconvertible\"\n}",
+
+					want: want{
+						statusCode: http.StatusBadRequest,
+					},
+				},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					s := backend.open(t)
+					log, _ := logger.Initialize("info")
+					server := NewServer(s, log)
+					uri := "/update/"
+					request := httptest.NewRequest(http.MethodPost, uri, bytes.NewBuffer([]byte(tt.metric)))
+					response := httptest.NewRecorder()
+
+					ctx := context.WithValue(request.Context(), chi.RouteCtxKey, chi.NewRouteContext())
+
+					request = request.WithContext(ctx)
+
+					server.updateMetricJSON(response, request)
+					result := response.Result()
+					require.Equal(t, tt.want.statusCode, result.StatusCode)
+					var m metrics.Metrics
+					_ = easyjson.Unmarshal([]byte(tt.metric), &m)
+					resultValue, _ := s.GetGaugeMetric(m.ID)
+					assert.Equal(t, *m.Value, resultValue)
+					defer result.Body.Close()
+				})
+			}
+		})
 	}
-	tests := []struct {
-		name   string
-		metric string
-		want   want
-	}{
-		{
-			name:   "Success Update gauge value",
-			metric: "{\n    \"id\": \"someMetric\",\n    \"type\": \"gauge\",\n    \"value\": 456.3\n}",
-			want: want{
-				statusCode: http.StatusOK,
-			},
-		},
-		{
-			name:   "Fail Update gauge value",
-			metric: "{\n    \"id\": \"someMetric\",\n    \"type\": \"gauge\",\n    \"value\": \"inconvertible\"\n}",
+}
 
-			want: want{
-				statusCode: http.StatusBadRequest,
-			},
-		},
+func TestUpdateCounterMetricStorage(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			type want struct {
+				statusCode int
+			}
+			tests := []struct {
+				name   string
+				metric string
+				want   want
+			}{
+				{
+					name:   "Success Update counter value",
+					metric: "{\n    \"id\": \"someMetric\",\n    \"type\": \"counter\",\n    \"delta\": 456\n}",
+					want: want{
+						statusCode: http.StatusOK,
+					},
+				},
+				{
+					name:   "Fail Update counter value",
+					metric: "{\n    \"id\": \"someMetric\",\n    \"type\": \"counter\",\n    \"delta\": \"inconvertible\"\n}",
+					want: want{
+						statusCode: http.StatusBadRequest,
+					},
+				},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					s := backend.open(t)
+					log, _ := logger.Initialize("info")
+					server := NewServer(s, log)
+					uri := "/update/"
+					request := httptest.NewRequest(http.MethodPost, uri, bytes.NewBuffer([]byte(tt.metric)))
+					response := httptest.NewRecorder()
+
+					ctx := context.WithValue(request.Context(), chi.RouteCtxKey, chi.NewRouteContext())
+
+					request = request.WithContext(ctx)
+
+					server.updateMetricJSON(response, request)
+					result := response.Result()
+					require.Equal(t, tt.want.statusCode, result.StatusCode)
+					var m metrics.Metrics
+					_ = easyjson.Unmarshal([]byte(tt.metric), &m)
+					resultValue, _ := s.GetCounterMetric(m.ID)
+					assert.Equal(t, *m.Delta, resultValue)
+					defer result.Body.Close()
+				})
+			}
+		})
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			keeper := dumper.NewDumper("/tmp/temp.json")
-			s, _ := storage.NewMemStorage(keeper, false)
+}
+
+func TestUpdateMetricsBatch(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			type want struct {
+				statusCode int
+				gauge      map[string]float64
+				counter    map[string]int64
+				failed     []int
+			}
+			tests := []struct {
+				name    string
+				payload string
+				want    want
+			}{
+				{
+					name: "Success batch update",
+					payload: `[{"id":"someGauge","type":"gauge","value":1.5},` +
+						`{"id":"someCounter","type":"counter","delta":2},` +
+						`{"id":"someCounter","type":"counter","delta":3}]`,
+					want: want{
+						statusCode: http.StatusOK,
+						gauge:      map[string]float64{"someGauge": 1.5},
+						counter:    map[string]int64{"someCounter": 5},
+					},
+				},
+				{
+					name: "Fail batch with invalid items",
+					payload: `[{"id":"someGauge","type":"gauge","value":1.5},` +
+						`{"id":"someCounter","type":"counter"},` +
+						`{"id":"other","type":"unknown","delta":1}]`,
+					want: want{
+						statusCode: http.StatusBadRequest,
+						gauge:      map[string]float64{},
+						counter:    map[string]int64{},
+						failed:     []int{1, 2},
+					},
+				},
+				{
+					name:    "Fail empty batch",
+					payload: `[]`,
+					want: want{
+						statusCode: http.StatusBadRequest,
+						gauge:      map[string]float64{},
+						counter:    map[string]int64{},
+					},
+				},
+				{
+					name:    "Fail malformed batch",
+					payload: `{"id":"someGauge","type":"gauge","value":1.5}`,
+					want: want{
+						statusCode: http.StatusBadRequest,
+						gauge:      map[string]float64{},
+						counter:    map[string]int64{},
+					},
+				},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					s := backend.open(t)
+					log, _ := logger.Initialize("info")
+					server := NewServer(s, log)
+					request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(tt.payload))
+					response := httptest.NewRecorder()
+
+					server.updateMetricsBatch(response, request)
+					result := response.Result()
+					defer result.Body.Close()
+					require.Equal(t, tt.want.statusCode, result.StatusCode)
+					assert.Equal(t, tt.want.gauge, s.GaugeMap())
+					assert.Equal(t, tt.want.counter, s.CounterMap())
+
+					if len(tt.want.failed) > 0 {
+						var report []batchItemError
+						require.NoError(t, json.NewDecoder(result.Body).Decode(&report))
+						var failed []int
+						for _, item := range report {
+							failed = append(failed, item.Index)
+						}
+						assert.Equal(t, tt.want.failed, failed)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestUpdateMetricsBatchIdempotency(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := backend.open(t)
 			log, _ := logger.Initialize("info")
 			server := NewServer(s, log)
-			uri := "/update/"
-			request := httptest.NewRequest(http.MethodPost, uri, bytes.NewBuffer([]byte(tt.metric)))
-			response := httptest.NewRecorder()
+			payload := `[{"id":"someCounter","type":"counter","delta":2}]`
 
-			ctx := context.WithValue(request.Context(), chi.RouteCtxKey, chi.NewRouteContext())
+			for _, key := range []string{"agent-1", "agent-1", "agent-2", ""} {
+				request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(payload))
+				request.Header.Set("Idempotency-Key", key)
+				response := httptest.NewRecorder()
 
-			request = request.WithContext(ctx)
+				server.updateMetricsBatch(response, request)
+				result := response.Result()
+				require.Equal(t, http.StatusOK, result.StatusCode)
+				result.Body.Close()
+			}
 
-			server.updateMetricJSON(response, request)
-			result := response.Result()
-			require.Equal(t, tt.want.statusCode, result.StatusCode)
-			var m metrics.Metrics
-			_ = easyjson.Unmarshal([]byte(tt.metric), &m)
-			resultValue, _ := s.GetGaugeMetric(m.ID)
-			assert.Equal(t, *m.Value, resultValue)
-			defer result.Body.Close()
+			value, ok := s.GetCounterMetric("someCounter")
+			require.True(t, ok)
+			assert.Equal(t, int64(6), value)
 		})
 	}
 }
 
-func TestUpdateCounterMetricStorage(t *testing.T) {
-	type want struct {
-		statusCode int
+func TestMetricsExposition(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := backend.open(t)
+			log, _ := logger.Initialize("info")
+			server := NewServer(s, log)
+			s.GaugeUpdate("Alloc", 2.5)
+			s.CounterUpdate("PollCount", 4)
+
+			tests := []struct {
+				name        string
+				accept      string
+				contentType string
+				body        string
+			}{
+				{
+					name:        "Prometheus text",
+					contentType: "text/plain; version=0.0.4; charset=utf-8",
+					body: "# HELP Alloc gauge metric Alloc\n# TYPE Alloc gauge\nAlloc 2.5\n" +
+						"# HELP PollCount counter metric PollCount\n# TYPE PollCount counter\nPollCount 4\n",
+				},
+				{
+					name:        "OpenMetrics",
+					accept:      "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5",
+					contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+					body: "# HELP Alloc gauge metric Alloc\n# TYPE Alloc gauge\nAlloc 2.5\n" +
+						"# HELP PollCount counter metric PollCount\n# TYPE PollCount counter\nPollCount_total 4\n# EOF\n",
+				},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+					request.Header.Set("Accept", tt.accept)
+					response := httptest.NewRecorder()
+
+					server.MetricRoute().ServeHTTP(response, request)
+					result := response.Result()
+					defer result.Body.Close()
+					require.Equal(t, http.StatusOK, result.StatusCode)
+					assert.Equal(t, tt.contentType, result.Header.Get("Content-Type"))
+					assert.Equal(t, tt.body, response.Body.String())
+				})
+			}
+		})
+	}
+}
+
+func TestUpdateMetricSynchronousSave(t *testing.T) {
+	path := t.TempDir() + "/dump.json"
+	s, _ := storage.NewMemStorage(dumper.NewDumper(path), false)
+	s.PeriodicSave(context.Background(), 0)
+	log, _ := logger.Initialize("info")
+	server := NewServer(s, log)
+
+	request := httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/5", nil)
+	response := httptest.NewRecorder()
+	server.MetricRoute().ServeHTTP(response, request)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	_, counters, err := dumper.NewDumper(path).RestoreData()
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), counters["PollCount"])
+
+	// A dump that cannot be written fails the request.
+	s, _ = storage.NewMemStorage(dumper.NewDumper(t.TempDir()+"/missing/dump.json"), false)
+	s.PeriodicSave(context.Background(), 0)
+	server = NewServer(s, log)
+	request = httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBufferString(`{"id":"Alloc","type":"gauge","value":1}`))
+	response = httptest.NewRecorder()
+	server.MetricRoute().ServeHTTP(response, request)
+	assert.Equal(t, http.StatusInternalServerError, response.Code)
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestRunWritesFinalDump(t *testing.T) {
+	config := Config{
+		ServerAddress:   freeAddress(t),
+		FlagLogLevel:    "info",
+		StoreInterval:   300,
+		FileStorage:     t.TempDir() + "/dump.json",
+		ShutdownTimeout: time.Second,
+	}
+	log, _ := logger.Initialize("info")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, config, log)
+	}()
+
+	url := "http://" + config.ServerAddress + "/update/counter/PollCount/7"
+	require.Eventually(t, func() bool {
+		resp, err := http.Post(url, "text/plain", nil)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 2*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not shut down")
 	}
+
+	_, counters, err := dumper.NewDumper(config.FileStorage).RestoreData()
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), counters["PollCount"])
+
+	_, err = http.Post(url, "text/plain", nil)
+	assert.Error(t, err, "server must stop accepting connections")
+}
+
+func TestRunRejectsNegativeStoreInterval(t *testing.T) {
+	config := Config{
+		ServerAddress:   freeAddress(t),
+		StoreInterval:   -1,
+		FileStorage:     t.TempDir() + "/dump.json",
+		ShutdownTimeout: time.Second,
+	}
+	assert.Error(t, run(context.Background(), config, zap.NewNop()))
+}
+
+func TestOpenDatabase(t *testing.T) {
+	dir := t.TempDir()
 	tests := []struct {
-		name   string
-		metric string
-		want   want
+		name    string
+		dsn     string
+		wantErr bool
 	}{
-		{
-			name:   "Success Update counter value",
-			metric: "{\n    \"id\": \"someMetric\",\n    \"type\": \"counter\",\n    \"delta\": 456\n}",
-			want: want{
-				statusCode: http.StatusOK,
-			},
-		},
-		{
-			name:   "Fail Update counter value",
-			metric: "{\n    \"id\": \"someMetric\",\n    \"type\": \"counter\",\n    \"delta\": \"inconvertible\"\n}",
-			want: want{
-				statusCode: http.StatusBadRequest,
-			},
-		},
+		{name: "SQLite absolute path", dsn: "sqlite://" + dir + "/metrics.db"},
+		{name: "Bolt absolute path", dsn: "bolt://" + dir + "/metrics.bolt"},
+		{name: "Missing path", dsn: "sqlite://", wantErr: true},
+		{name: "Missing scheme", dsn: dir + "/metrics.db", wantErr: true},
+		{name: "Unsupported scheme", dsn: "postgres://localhost/metrics", wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			keeper := dumper.NewDumper("/tmp/temp.json")
-			s, _ := storage.NewMemStorage(keeper, false)
-			log, _ := logger.Initialize("info")
-			server := NewServer(s, log)
-			uri := "/update/"
-			request := httptest.NewRequest(http.MethodPost, uri, bytes.NewBuffer([]byte(tt.metric)))
+			s, closeDB, err := openDatabase(tt.dsn, zap.NewNop())
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer closeDB()
+			require.NoError(t, s.CounterUpdate("PollCount", 1))
+		})
+	}
+}
+
+func TestConcurrentCounterUpdates(t *testing.T) {
+	s, _ := storage.NewMemStorage(dumper.NewDumper(t.TempDir()+"/dump.json"), false)
+	server := NewServer(s, zap.NewNop())
+	router := server.MetricRoute()
+
+	const requests = 5000
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			defer wg.Done()
+			<-start
+			request := httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/2", nil)
 			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			assert.Equal(t, http.StatusOK, response.Code)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	value, ok := s.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, int64(2*requests), value)
+}
+
+func TestQueryRange(t *testing.T) {
+	s, _ := storage.NewMemStorage(dumper.NewDumper(t.TempDir()+"/dump.json"), false)
+	server := NewServer(s, zap.NewNop())
+	router := server.MetricRoute()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, url, nil))
+		return response
+	}
+	post := func(url string, body string) {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodPost, url, bytes.NewBufferString(body)))
+		require.Equal(t, http.StatusOK, response.Code)
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/query_range?name=Alloc&type=gauge").Code,
+		"history is off by default")
+
+	server.history = history.New(history.Options{Retention: time.Hour})
+	post("/update/gauge/Alloc/1.5", "")
+	post("/update/", `{"id":"Alloc","type":"gauge","value":2.5}`)
+	post("/update/counter/PollCount/2", "")
+	post("/updates/", `[{"id":"PollCount","type":"counter","delta":3},{"id":"Alloc","type":"gauge","value":3.5}]`)
+
+	t.Run("Raw samples", func(t *testing.T) {
+		response := get("/api/v1/query_range?name=Alloc&type=gauge")
+		require.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+		var result rangeResult
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+		assert.Equal(t, "Alloc", result.Name)
+		assert.Empty(t, result.Step)
+		var values []float64
+		for _, point := range result.Points {
+			values = append(values, point.Value)
+		}
+		assert.Equal(t, []float64{1.5, 2.5, 3.5}, values)
+	})
+
+	t.Run("Counters record totals", func(t *testing.T) {
+		response := get("/api/v1/query_range?name=PollCount&type=counter")
+		require.Equal(t, http.StatusOK, response.Code)
+		var result rangeResult
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+		require.Len(t, result.Points, 2)
+		assert.Equal(t, 2.0, result.Points[0].Value)
+		assert.Equal(t, 5.0, result.Points[1].Value)
+	})
+
+	t.Run("Step", func(t *testing.T) {
+		end := time.Now().Add(time.Minute).Unix()
+		url := fmt.Sprintf("/api/v1/query_range?name=Alloc&type=gauge&start=%d&end=%d&step=30s", end-120, end)
+		response := get(url)
+		require.Equal(t, http.StatusOK, response.Code)
+		var result rangeResult
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+		assert.Equal(t, "30s", result.Step)
+		require.NotEmpty(t, result.Points)
+		last := result.Points[len(result.Points)-1]
+		assert.Equal(t, time.Unix(end, 0).UTC(), last.Timestamp)
+		assert.Equal(t, 3.5, last.Value, "a step takes the latest sample before it")
+	})
+
+	t.Run("Labels", func(t *testing.T) {
+		post("/update/", `{"id":"Alloc","type":"gauge","value":9,"labels":{"host":"a"}}`)
+		response := get(`/api/v1/query_range?name=Alloc&type=gauge&labels={host="a"}`)
+		require.Equal(t, http.StatusOK, response.Code)
+		var result rangeResult
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+		assert.Equal(t, metrics.Labels{"host": "a"}, result.Labels)
+		require.Len(t, result.Points, 1)
+		assert.Equal(t, 9.0, result.Points[0].Value)
+	})
+
+	for _, tt := range []struct {
+		url  string
+		code int
+	}{
+		{"/api/v1/query_range?name=Missing&type=gauge", http.StatusNotFound},
+		{`/api/v1/query_range?name=Alloc&type=gauge&labels={host="b"}`, http.StatusNotFound},
+		{`/api/v1/query_range?name=Alloc&type=gauge&labels={host}`, http.StatusBadRequest},
+		{"/api/v1/query_range?name=Alloc", http.StatusBadRequest},
+		{"/api/v1/query_range?name=Alloc&type=gauge&start=yesterday", http.StatusBadRequest},
+		{"/api/v1/query_range?name=Alloc&type=gauge&start=200&end=100", http.StatusBadRequest},
+		{"/api/v1/query_range?name=Alloc&type=gauge&step=-1s", http.StatusBadRequest},
+		{"/api/v1/query_range?name=Alloc&type=gauge&start=0&end=100000&step=1", http.StatusBadRequest},
+		{"/api/v1/query_range?name=Alloc&type=gauge&start=2024-01-01T00:00:00Z&end=2024-01-01T01:00:00Z&step=1m", http.StatusOK},
+	} {
+		assert.Equal(t, tt.code, get(tt.url).Code, tt.url)
+	}
+}
 
-			ctx := context.WithValue(request.Context(), chi.RouteCtxKey, chi.NewRouteContext())
+func TestLabels(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := backend.open(t)
+			router := NewServer(s, zap.NewNop()).MetricRoute()
+			do := func(method, url, body string) *httptest.ResponseRecorder {
+				response := httptest.NewRecorder()
+				router.ServeHTTP(response, httptest.NewRequest(method, url, bytes.NewBufferString(body)))
+				return response
+			}
 
-			request = request.WithContext(ctx)
+			require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/1", "").Code)
+			require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/",
+				`{"id":"Alloc","type":"gauge","value":2,"labels":{"host":"a"}}`).Code)
+			require.Equal(t, http.StatusOK, do(http.MethodPost, "/updates/",
+				`[{"id":"Alloc","type":"gauge","value":3,"labels":{"host":"b","env":"prod"}},`+
+					`{"id":"PollCount","type":"counter","delta":4,"labels":{"host":"a"}},`+
+					`{"id":"PollCount","type":"counter","delta":5}]`).Code)
 
-			server.updateMetricJSON(response, request)
-			result := response.Result()
-			require.Equal(t, tt.want.statusCode, result.StatusCode)
-			var m metrics.Metrics
-			_ = easyjson.Unmarshal([]byte(tt.metric), &m)
-			resultValue, _ := s.GetCounterMetric(m.ID)
-			assert.Equal(t, *m.Delta, resultValue)
-			defer result.Body.Close()
+			t.Run("Series are kept apart", func(t *testing.T) {
+				assert.Equal(t, map[string]float64{
+					"Alloc":                      1,
+					`Alloc{host="a"}`:            2,
+					`Alloc{env="prod",host="b"}`: 3,
+				}, s.GaugeMap())
+				assert.Equal(t, map[string]int64{"PollCount": 5, `PollCount{host="a"}`: 4}, s.CounterMap())
+			})
+
+			t.Run("Value by labels", func(t *testing.T) {
+				assert.Equal(t, "1.", do(http.MethodGet, "/value/gauge/Alloc", "").Body.String())
+				assert.Equal(t, "2.", do(http.MethodGet, `/value/gauge/Alloc?labels={host="a"}`, "").Body.String())
+				assert.Equal(t, http.StatusNotFound, do(http.MethodGet, `/value/gauge/Alloc?labels={host="c"}`, "").Code)
+				assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, `/value/gauge/Alloc?labels={host=c}`, "").Code)
+
+				response := do(http.MethodPost, "/value/", `{"id":"Alloc","type":"gauge","labels":{"env":"prod","host":"b"}}`)
+				require.Equal(t, http.StatusOK, response.Code)
+				var metric metrics.Metrics
+				require.NoError(t, easyjson.Unmarshal(response.Body.Bytes(), &metric))
+				require.NotNil(t, metric.Value)
+				assert.Equal(t, 3.0, *metric.Value)
+				assert.Equal(t, metrics.Labels{"env": "prod", "host": "b"}, metric.Labels)
+			})
+
+			t.Run("Selectors", func(t *testing.T) {
+				assert.Equal(t, "Gauge list: Alloc{host=\"a\"}\nCounter list: PollCount{host=\"a\"}",
+					do(http.MethodGet, `/?match={host="a"}`, "").Body.String())
+				assert.Equal(t, "Gauge list: Alloc, Alloc{env=\"prod\",host=\"b\"}, Alloc{host=\"a\"}\nCounter list: PollCount, PollCount{host=\"a\"}",
+					do(http.MethodGet, "/", "").Body.String())
+				assert.Equal(t, "# HELP Alloc gauge metric Alloc\n# TYPE Alloc gauge\nAlloc 1\nAlloc{host=\"a\"} 2\n"+
+					"# HELP PollCount counter metric PollCount\n# TYPE PollCount counter\nPollCount 5\nPollCount{host=\"a\"} 4\n",
+					do(http.MethodGet, `/metrics?match={env!="prod"}`, "").Body.String())
+				assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/metrics?match={host}", "").Code)
+			})
+
+			t.Run("Invalid labels are rejected", func(t *testing.T) {
+				for _, body := range []string{
+					`{"id":"Alloc","type":"gauge","value":1,"labels":{"1host":"a"}}`,
+					`{"id":"Alloc","type":"gauge","value":1,"labels":{"host":""}}`,
+					`{"id":"Al{loc","type":"gauge","value":1,"labels":{"host":"a"}}`,
+				} {
+					assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/update/", body).Code, body)
+				}
+			})
 		})
 	}
 }
+
+func TestUnlabeledIDsWithBraces(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := backend.open(t)
+			router := NewServer(s, zap.NewNop()).MetricRoute()
+			do := func(method, url, body string) *httptest.ResponseRecorder {
+				response := httptest.NewRecorder()
+				router.ServeHTTP(response, httptest.NewRequest(method, url, bytes.NewBufferString(body)))
+				return response
+			}
+
+			require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/foo{bar/1", "").Code)
+			require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/",
+				`{"id":"foo{host=\"a\"}","type":"gauge","value":2}`).Code)
+			require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/",
+				`{"id":"foo","type":"gauge","value":3,"labels":{"host":"a"}}`).Code)
+			require.Equal(t, http.StatusOK, do(http.MethodPost, "/updates/",
+				`[{"id":"}count","type":"counter","delta":4}]`).Code)
+
+			assert.Equal(t, "1.", do(http.MethodGet, "/value/gauge/foo{bar", "").Body.String())
+			assert.Equal(t, "3.", do(http.MethodGet, `/value/gauge/foo?labels={host="a"}`, "").Body.String())
+			assert.Equal(t, "4", do(http.MethodGet, "/value/counter/}count", "").Body.String())
+
+			response := do(http.MethodPost, "/value/", `{"id":"foo{host=\"a\"}","type":"gauge"}`)
+			require.Equal(t, http.StatusOK, response.Code)
+			var metric metrics.Metrics
+			require.NoError(t, easyjson.Unmarshal(response.Body.Bytes(), &metric))
+			require.NotNil(t, metric.Value)
+			assert.Equal(t, 2.0, *metric.Value)
+			assert.Empty(t, metric.Labels)
+
+			assert.Equal(t, "Gauge list: foo{bar, foo{host=\"a\"}, foo{host=\"a\"}\nCounter list: }count",
+				do(http.MethodGet, "/", "").Body.String())
+		})
+	}
+}
+
+func TestAlertList(t *testing.T) {
+	s, _ := storage.NewMemStorage(dumper.NewDumper(t.TempDir()+"/dump.json"), false)
+	server := NewServer(s, zap.NewNop())
+	router := server.MetricRoute()
+	get := func() *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/api/v1/alerts", nil))
+		return response
+	}
+	assert.Equal(t, http.StatusNotFound, get().Code, "alerting is off by default")
+
+	path := t.TempDir() + "/rules.json"
+	require.NoError(t, os.WriteFile(path, []byte(`{"rules": [
+		{"name": "HighHeap", "type": "gauge", "metric": "HeapAlloc", "op": ">", "threshold": 100, "severity": "critical"}
+	]}`), 0644))
+	engine, err := alerting.NewEngine(path, s, zap.NewNop())
+	require.NoError(t, err)
+	server.alerts = engine
+	require.NoError(t, s.GaugeUpdate(metrics.SeriesKey("HeapAlloc", metrics.Labels{"host": "a"}), 150))
+	require.NoError(t, engine.Evaluate())
+
+	response := get()
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+	var result struct {
+		Alerts []alerting.Alert `json:"alerts"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+	require.Len(t, result.Alerts, 1)
+	alert := result.Alerts[0]
+	assert.Equal(t, "HighHeap", alert.Rule)
+	assert.Equal(t, "critical", alert.Severity)
+	assert.Equal(t, alerting.StateFiring, alert.State)
+	assert.Equal(t, metrics.Labels{"host": "a"}, alert.Labels)
+	assert.Equal(t, 150.0, alert.Value)
+	assert.NotNil(t, alert.FiredAt)
+	assert.Nil(t, alert.ResolvedAt)
+}
+
+func TestRouterRequiresSignatures(t *testing.T) {
+	keys, err := signature.ParseKeyRing("secret")
+	require.NoError(t, err)
+	s := testBackends[0].open(t)
+	router := newRouter(NewServer(s, zap.NewNop()), keys)
+	do := func(url, sum string) int {
+		request := httptest.NewRequest(http.MethodPost, url, nil)
+		if sum != "" {
+			request.Header.Set(signature.HeaderHash, sum)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do("/update/counter/evil/1000", ""))
+	assert.Equal(t, http.StatusBadRequest, do("/update/counter/evil/1000", signature.Sum([]byte("other"), nil)))
+	_, ok := s.GetCounterMetric("evil")
+	assert.False(t, ok, "an unsigned update is not stored")
+
+	assert.Equal(t, http.StatusOK, do("/update/counter/PollCount/3", signature.Sum([]byte("secret"), nil)))
+	value, ok := s.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, int64(3), value)
+}
+
+// countingReader yields zeros up to size and counts what was read.
+type countingReader struct {
+	size, read int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.read >= r.size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if n > r.size-r.read {
+		n = r.size - r.read
+	}
+	for i := range p[:n] {
+		p[i] = 0
+	}
+	r.read += n
+	return n, nil
+}
+
+func TestRouterLimitsRequestBodies(t *testing.T) {
+	router := newRouter(NewServer(testBackends[0].open(t), zap.NewNop()), nil)
+	body := &countingReader{size: 4 * middlewares.MaxRequestBody}
+	request := httptest.NewRequest(http.MethodPost, "/updates/", body)
+	response := httptest.NewRecorder()
+
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+	assert.Less(t, body.read, middlewares.MaxRequestBody+64<<10, "the body is not read past the limit")
+}
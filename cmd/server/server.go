@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/personage-hub/metrics-tracker/internal/consts"
 	"go.uber.org/zap"
@@ -8,15 +10,23 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/mailru/easyjson"
+	"github.com/personage-hub/metrics-tracker/internal/alerting"
+	"github.com/personage-hub/metrics-tracker/internal/exposition"
+	"github.com/personage-hub/metrics-tracker/internal/history"
 	"github.com/personage-hub/metrics-tracker/internal/metrics"
 	"github.com/personage-hub/metrics-tracker/internal/storage"
 )
 
 type Server struct {
 	storage storage.Storage
+	// history is nil unless metric history is enabled.
+	history *history.Store
+	// alerts is nil unless alerting is enabled.
+	alerts *alerting.Engine
 
 	logger *zap.Logger
 }
@@ -28,38 +38,107 @@ func NewServer(storage storage.Storage, logger *zap.Logger) *Server {
 	}
 }
 
+type batchItemError struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+func validateMetric(metric metrics.Metrics) error {
+	switch metric.MType {
+	case "gauge":
+		if metric.Value == nil {
+			return errors.New("Missing value for gauge metric")
+		}
+	case "counter":
+		if metric.Delta == nil {
+			return errors.New("Missing delta for counter metric")
+		}
+	default:
+		return errors.New("Invalid metric type")
+	}
+	if len(metric.Labels) > 0 {
+		if strings.ContainsAny(metric.ID, "{}") {
+			return errors.New("Labeled metric ID must not contain braces")
+		}
+		if err := metrics.ValidateLabels(metric.Labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidPayload answers a request whose body could not be decoded: 413 when
+// it was cut off at the body limit, 400 otherwise.
+func invalidPayload(rw http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(rw, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	rw.WriteHeader(http.StatusBadRequest)
+	rw.Write([]byte("Invalid request payload"))
+}
+
+// seriesKey returns the series key addressed by a request: the metric name
+// with the labels of the optional labels query parameter, e.g.
+// labels={host="a"}.
+func seriesKey(r *http.Request, name string) (string, error) {
+	labels, err := metrics.ParseLabels(r.URL.Query().Get("labels"))
+	if err != nil {
+		return "", err
+	}
+	return metrics.SeriesKey(name, labels), nil
+}
+
+// selectSeries returns the series of a snapshot map whose labels match the
+// selector.
+func selectSeries[V any](series map[string]V, selector metrics.Selector) map[string]V {
+	if len(selector) == 0 {
+		return series
+	}
+	result := make(map[string]V)
+	for key, value := range series {
+		if _, labels := metrics.ParseSeriesKey(key); selector.Matches(labels) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
 func (s *Server) updateMetricJSON(res http.ResponseWriter, req *http.Request) {
 	var metric metrics.Metrics
 
 	err := easyjson.UnmarshalFromReader(req.Body, &metric)
 	if err != nil {
+		invalidPayload(res, err)
+		return
+	}
+
+	if err := validateMetric(metric); err != nil {
 		res.WriteHeader(http.StatusBadRequest)
-		res.Write([]byte("Invalid request payload"))
+		res.Write([]byte(err.Error()))
 		return
 	}
 
+	key := metric.Key()
 	switch metric.MType {
 	case "gauge":
-		if metric.Value != nil {
-			s.storage.GaugeUpdate(metric.ID, *metric.Value)
-		} else {
-			res.WriteHeader(http.StatusBadRequest)
-			res.Write([]byte("Missing value for gauge metric"))
-			return
-		}
+		err = s.storage.GaugeUpdate(key, *metric.Value)
 	case "counter":
-		if metric.Delta != nil {
-			s.storage.CounterUpdate(metric.ID, *metric.Delta)
-		} else {
-			res.WriteHeader(http.StatusBadRequest)
-			res.Write([]byte("Missing delta for counter metric"))
-			return
-		}
-	default:
-		res.WriteHeader(http.StatusBadRequest)
-		res.Write([]byte("Invalid metric type"))
+		err = s.storage.CounterUpdate(key, *metric.Delta)
+	}
+	if err != nil {
+		s.logger.Error("failed to save metric", zap.Error(err))
+		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	switch metric.MType {
+	case "gauge":
+		s.recordGauge(key, *metric.Value)
+	case "counter":
+		s.recordCounter(key)
+	}
 
 	data, _ := easyjson.Marshal(metric)
 	res.WriteHeader(http.StatusOK)
@@ -67,6 +146,68 @@ func (s *Server) updateMetricJSON(res http.ResponseWriter, req *http.Request) {
 	res.Write(data)
 }
 
+func (s *Server) updateMetricsBatch(res http.ResponseWriter, req *http.Request) {
+	var batch metrics.MetricsList
+
+	err := easyjson.UnmarshalFromReader(req.Body, &batch)
+	if err != nil {
+		invalidPayload(res, err)
+		return
+	}
+	if len(batch) == 0 {
+		res.WriteHeader(http.StatusBadRequest)
+		res.Write([]byte("Empty metrics batch"))
+		return
+	}
+
+	var report []batchItemError
+	for i, metric := range batch {
+		if err := validateMetric(metric); err != nil {
+			report = append(report, batchItemError{Index: i, ID: metric.ID, Error: err.Error()})
+		}
+	}
+	if len(report) > 0 {
+		data, _ := json.Marshal(report)
+		res.Header().Set("Content-Type", consts.ContentTypeJSON)
+		res.WriteHeader(http.StatusBadRequest)
+		res.Write(data)
+		return
+	}
+
+	gauges := make(map[string]float64)
+	counters := make(map[string]int64)
+	for _, metric := range batch {
+		switch metric.MType {
+		case "gauge":
+			gauges[metric.Key()] = *metric.Value
+		case "counter":
+			counters[metric.Key()] += *metric.Delta
+		}
+	}
+	key := req.Header.Get(consts.HeaderIdempotencyKey)
+	applied, err := s.storage.BatchUpdateOnce(key, gauges, counters)
+	if err != nil {
+		s.logger.Error("failed to apply metrics batch", zap.Error(err))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !applied {
+		s.logger.Info("skipping already applied metrics batch", zap.String("key", key))
+	} else {
+		for name, value := range gauges {
+			s.recordGauge(name, value)
+		}
+		for name := range counters {
+			s.recordCounter(name)
+		}
+	}
+
+	data, _ := easyjson.Marshal(batch)
+	res.Header().Set("Content-Type", consts.ContentTypeJSON)
+	res.WriteHeader(http.StatusOK)
+	res.Write(data)
+}
+
 func (s *Server) updateMetric(res http.ResponseWriter, req *http.Request) {
 	metricType := strings.ToLower(chi.URLParam(req, "metricType"))
 	metricName := chi.URLParam(req, "metricName")
@@ -76,6 +217,7 @@ func (s *Server) updateMetric(res http.ResponseWriter, req *http.Request) {
 		res.Write([]byte(fmt.Errorf("metric unkwon").Error()))
 		return
 	}
+	key := metrics.SeriesKey(metricName, nil)
 	switch metricType {
 	case "gauge":
 		floatValue, err := strconv.ParseFloat(metricValue, 64)
@@ -84,7 +226,12 @@ func (s *Server) updateMetric(res http.ResponseWriter, req *http.Request) {
 			res.Write([]byte(fmt.Errorf("invalid metric type: %s", metricType).Error()))
 			return
 		}
-		s.storage.GaugeUpdate(metricName, floatValue)
+		if err := s.storage.GaugeUpdate(key, floatValue); err != nil {
+			s.logger.Error("failed to save metric", zap.Error(err))
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.recordGauge(key, floatValue)
 	case "counter":
 		intValue, err := strconv.ParseInt(metricValue, 10, 64)
 		if err != nil {
@@ -92,7 +239,12 @@ func (s *Server) updateMetric(res http.ResponseWriter, req *http.Request) {
 			res.Write([]byte(fmt.Errorf("invalid metric type: %s", metricType).Error()))
 			return
 		}
-		s.storage.CounterUpdate(metricName, intValue)
+		if err := s.storage.CounterUpdate(key, intValue); err != nil {
+			s.logger.Error("failed to save metric", zap.Error(err))
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.recordCounter(key)
 
 	default:
 		res.WriteHeader(http.StatusBadRequest)
@@ -104,7 +256,11 @@ func (s *Server) updateMetric(res http.ResponseWriter, req *http.Request) {
 
 func (s *Server) metricGet(writer http.ResponseWriter, request *http.Request) {
 	metricType := strings.ToLower(chi.URLParam(request, "metricType"))
-	metricName := chi.URLParam(request, "metricName")
+	metricName, err := seriesKey(request, chi.URLParam(request, "metricName"))
+	if err != nil {
+		http.Error(writer, "invalid labels: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	switch metricType {
 	case "gauge":
@@ -138,47 +294,238 @@ func (s *Server) metricGet(writer http.ResponseWriter, request *http.Request) {
 	}
 }
 
-func (s *Server) metricsList(metricType string) []string {
-	var list []string
-	switch metricType {
-	case "gauge":
-		for metricName := range s.storage.GaugeMap() {
-			list = append(list, metricName)
-		}
-	case "counter":
-		for metricName := range s.storage.CounterMap() {
-			list = append(list, metricName)
-		}
-	}
-
-	return list
-}
-
+// metricsHandle lists the series keys of one snapshot, so a batch written
+// meanwhile shows up in both lists or in neither. The optional match
+// parameter, e.g. match={host="a"}, filters series by labels.
 func (s *Server) metricsHandle(rw http.ResponseWriter, r *http.Request) {
-	gaugeList := s.metricsList("gauge")
-	counterList := s.metricsList("counter")
+	selector, err := metrics.ParseSelector(r.URL.Query().Get("match"))
+	if err != nil {
+		http.Error(rw, "invalid selector: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshot, err := s.storage.Snapshot()
+	if err != nil {
+		s.logger.Error("failed to take snapshot", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	result := "Gauge list: " +
-		strings.Join(gaugeList, ", ") +
+		strings.Join(selectNames(snapshot.GaugeNames(), selector), ", ") +
 		"\n" +
 		"Counter list: " +
-		strings.Join(counterList, ", ")
+		strings.Join(selectNames(snapshot.CounterNames(), selector), ", ")
 	rw.Header().Set("Content-Type", consts.ContentTypeHTML)
 	_, _ = io.WriteString(rw, result)
 }
 
+// selectNames returns the series matching the selector as shown to users.
+func selectNames(keys []string, selector metrics.Selector) []string {
+	result := keys[:0]
+	for _, key := range keys {
+		if _, labels := metrics.ParseSeriesKey(key); selector.Matches(labels) {
+			result = append(result, metrics.DisplayKey(key))
+		}
+	}
+	return result
+}
+
+// metricsExposition renders all stored metrics for a Prometheus scrape, in
+// OpenMetrics when the Accept header prefers it.
+func (s *Server) metricsExposition(rw http.ResponseWriter, r *http.Request) {
+	selector, err := metrics.ParseSelector(r.URL.Query().Get("match"))
+	if err != nil {
+		http.Error(rw, "invalid selector: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshot, err := s.storage.Snapshot()
+	if err != nil {
+		s.logger.Error("failed to take snapshot", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	format := exposition.Negotiate(r.Header.Get("Accept"))
+	rw.Header().Set("Content-Type", format.ContentType())
+	gauges := selectSeries(snapshot.Gauges(), selector)
+	counters := selectSeries(snapshot.Counters(), selector)
+	if err := exposition.Write(rw, format, gauges, counters); err != nil {
+		s.logger.Error("failed to write metrics exposition", zap.Error(err))
+	}
+}
+
+func (s *Server) recordGauge(name string, value float64) {
+	if s.history != nil {
+		s.history.Add("gauge", name, value)
+	}
+}
+
+// recordCounter adds the counter total left by an update to the history.
+func (s *Server) recordCounter(name string) {
+	if s.history == nil {
+		return
+	}
+	if total, ok := s.storage.GetCounterMetric(name); ok {
+		s.history.Add("counter", name, float64(total))
+	}
+}
+
+// maxRangePoints bounds the points a single range query may ask for.
+const maxRangePoints = 11000
+
+type rangePoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+type rangeResult struct {
+	Name   string         `json:"name"`
+	Labels metrics.Labels `json:"labels,omitempty"`
+	Type   string         `json:"type"`
+	Start  time.Time      `json:"start"`
+	End    time.Time      `json:"end"`
+	Step   string         `json:"step,omitempty"`
+	Points []rangePoint   `json:"points"`
+}
+
+// queryRange returns the history of one series, picked by name, type and
+// the optional labels parameter, between start and end. With
+// a step the series is resampled to one point per step, otherwise every
+// recorded sample is returned. Times are RFC 3339 or Unix seconds; end
+// defaults to now and start to an hour before end.
+func (s *Server) queryRange(rw http.ResponseWriter, r *http.Request) {
+	if s.history == nil {
+		http.Error(rw, "metric history is disabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	name := query.Get("name")
+	metricType := strings.ToLower(query.Get("type"))
+	if name == "" || (metricType != "gauge" && metricType != "counter") {
+		http.Error(rw, "name and type (gauge or counter) are required", http.StatusBadRequest)
+		return
+	}
+	labels, err := metrics.ParseLabels(query.Get("labels"))
+	if err != nil {
+		http.Error(rw, "invalid labels: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := metrics.SeriesKey(name, labels)
+	end, err := parseQueryTime(query.Get("end"), time.Now())
+	if err != nil {
+		http.Error(rw, "invalid end: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, err := parseQueryTime(query.Get("start"), end.Add(-time.Hour))
+	if err != nil {
+		http.Error(rw, "invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if end.Before(start) {
+		http.Error(rw, "end is before start", http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if value := query.Get("step"); value != "" {
+		step, err = parseQueryStep(value)
+		if err != nil {
+			http.Error(rw, "invalid step: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if end.Sub(start)/step >= maxRangePoints {
+			http.Error(rw, fmt.Sprintf("too many points, at most %d are allowed", maxRangePoints), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var samples []history.Sample
+	var ok bool
+	if step > 0 {
+		// The first point takes the last sample before start.
+		samples, ok = s.history.Query(metricType, key, time.Time{}, end)
+		samples = history.Resample(samples, start, end, step)
+	} else {
+		samples, ok = s.history.Query(metricType, key, start, end)
+	}
+	if !ok {
+		http.Error(rw, "no history for metric", http.StatusNotFound)
+		return
+	}
+
+	result := rangeResult{
+		Name:   name,
+		Labels: labels,
+		Type:   metricType,
+		Start:  start.UTC(),
+		End:    end.UTC(),
+		Points: make([]rangePoint, 0, len(samples)),
+	}
+	if step > 0 {
+		result.Step = step.String()
+	}
+	for _, sample := range samples {
+		result.Points = append(result.Points, rangePoint{Timestamp: sample.Time.UTC(), Value: sample.Value})
+	}
+	data, _ := json.Marshal(result)
+	rw.Header().Set("Content-Type", consts.ContentTypeJSON)
+	rw.Write(data)
+}
+
+// alertList returns the pending, firing and recently resolved alerts.
+func (s *Server) alertList(rw http.ResponseWriter, r *http.Request) {
+	if s.alerts == nil {
+		http.Error(rw, "alerting is disabled", http.StatusNotFound)
+		return
+	}
+	data, _ := json.Marshal(struct {
+		Alerts []alerting.Alert `json:"alerts"`
+	}{Alerts: s.alerts.Alerts()})
+	rw.Header().Set("Content-Type", consts.ContentTypeJSON)
+	rw.Write(data)
+}
+
+func parseQueryTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// parseQueryStep reads a duration such as "15s" or a number of seconds.
+func parseQueryStep(value string) (time.Duration, error) {
+	step, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, floatErr := strconv.ParseFloat(value, 64)
+		if floatErr != nil {
+			return 0, err
+		}
+		step = time.Duration(seconds * float64(time.Second))
+	}
+	if step <= 0 {
+		return 0, errors.New("step must be positive")
+	}
+	return step, nil
+}
+
 func (s *Server) metricGetJSON(rw http.ResponseWriter, r *http.Request) {
 	var metric metrics.Metrics
 	err := easyjson.UnmarshalFromReader(r.Body, &metric)
 	if err != nil {
+		invalidPayload(rw, err)
+		return
+	}
+
+	if err := metrics.ValidateLabels(metric.Labels); err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Invalid request payload"))
+		rw.Write([]byte(err.Error()))
 		return
 	}
 
 	switch metric.MType {
 	case "gauge":
-		value, ok := s.storage.GetGaugeMetric(metric.ID)
+		value, ok := s.storage.GetGaugeMetric(metric.Key())
 		if !ok {
 			rw.WriteHeader(http.StatusNotFound)
 			return
@@ -186,7 +533,7 @@ func (s *Server) metricGetJSON(rw http.ResponseWriter, r *http.Request) {
 		metric.Value = &value
 
 	case "counter":
-		value, ok := s.storage.GetCounterMetric(metric.ID)
+		value, ok := s.storage.GetCounterMetric(metric.Key())
 		if !ok {
 			rw.WriteHeader(http.StatusNotFound)
 			return
@@ -206,9 +553,13 @@ func (s *Server) metricGetJSON(rw http.ResponseWriter, r *http.Request) {
 func (s *Server) MetricRoute() *chi.Mux {
 	r := chi.NewRouter()
 	r.Get("/", s.metricsHandle)
+	r.Get("/metrics", s.metricsExposition)
 	r.Get("/value/{metricType}/{metricName}", s.metricGet)
 	r.Post("/update/{metricType}/{metricName}/{metricValue}", s.updateMetric)
 	r.Post("/update/", s.updateMetricJSON)
+	r.Post("/updates/", s.updateMetricsBatch)
 	r.Post("/value/", s.metricGetJSON)
+	r.Get("/api/v1/query_range", s.queryRange)
+	r.Get("/api/v1/alerts", s.alertList)
 	return r
 }
@@ -0,0 +1,274 @@
+// Package alerting evaluates threshold rules against the stored metrics.
+//
+// Every series matched by a rule is an alert of its own. While the rule
+// holds, the alert is pending and, once it has held for the rule's For
+// duration, firing. A firing alert whose rule stops holding is resolved and
+// stays visible for ResolvedRetention; a pending one is simply dropped.
+package alerting
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/storage"
+	"go.uber.org/zap"
+)
+
+// ResolvedRetention is how long a resolved alert is still reported.
+const ResolvedRetention = 15 * time.Minute
+
+type State string
+
+const (
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+type Alert struct {
+	Rule       string         `json:"rule"`
+	Severity   string         `json:"severity,omitempty"`
+	Type       string         `json:"type"`
+	Metric     string         `json:"metric"`
+	Labels     metrics.Labels `json:"labels,omitempty"`
+	Value      float64        `json:"value"`
+	State      State          `json:"state"`
+	ActiveAt   time.Time      `json:"activeAt"`
+	FiredAt    *time.Time     `json:"firedAt,omitempty"`
+	ResolvedAt *time.Time     `json:"resolvedAt,omitempty"`
+
+	series string
+}
+
+// Notifier is given all alerts after every evaluation.
+type Notifier interface {
+	Notify(alerts []Alert)
+}
+
+type alertKey struct {
+	rule   string
+	series string
+}
+
+type Engine struct {
+	mu      sync.Mutex
+	storage storage.Storage
+	path    string
+	modTime time.Time
+	rules   []Rule
+	alerts  map[alertKey]*Alert
+
+	notifier Notifier
+
+	logger *zap.Logger
+	now    func() time.Time
+}
+
+// NewEngine loads the rules in path; an invalid file is an error.
+func NewEngine(path string, s storage.Storage, logger *zap.Logger) (*Engine, error) {
+	e := &Engine{
+		storage: s,
+		path:    path,
+		alerts:  make(map[alertKey]*Alert),
+		logger:  logger,
+		now:     time.Now,
+	}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload reads the rules file again. On error the current rules stay, and
+// Run does not retry until the file changes again.
+func (e *Engine) Reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.modTime = info.ModTime()
+	e.mu.Unlock()
+	rules, err := LoadRules(e.path)
+	if err != nil {
+		return err
+	}
+	return e.SetRules(rules)
+}
+
+// SetRules replaces the rules. Alerts of rules that keep their name keep
+// their state, the alerts of removed rules are dropped.
+func (e *Engine) SetRules(rules []Rule) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		names[rule.Name] = true
+	}
+	for key := range e.alerts {
+		if !names[key.rule] {
+			delete(e.alerts, key)
+		}
+	}
+	e.rules = rules
+	return nil
+}
+
+// Run evaluates the rules every interval until ctx is done, reloading the
+// rules file first whenever it has changed.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if e.changed() {
+				if err := e.Reload(); err != nil {
+					e.logger.Error("failed to reload alert rules, keeping the current ones", zap.Error(err))
+				} else {
+					e.logger.Info("alert rules reloaded", zap.String("path", e.path))
+				}
+			}
+			if err := e.Evaluate(); err != nil {
+				e.logger.Error("failed to evaluate alert rules", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (e *Engine) changed() bool {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !info.ModTime().Equal(e.modTime)
+}
+
+// SetNotifier makes the engine pass the alerts to n after evaluations.
+func (e *Engine) SetNotifier(n Notifier) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.notifier = n
+}
+
+// Evaluate checks every rule against one snapshot of the storage, moves the
+// alerts to their new states and hands them to the notifier, if any.
+func (e *Engine) Evaluate() error {
+	snapshot, err := e.storage.Snapshot()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.evaluate(snapshot)
+	notifier := e.notifier
+	e.mu.Unlock()
+	if notifier != nil {
+		notifier.Notify(e.Alerts())
+	}
+	return nil
+}
+
+func (e *Engine) evaluate(snapshot *storage.Snapshot) {
+	now := e.now()
+
+	active := make(map[alertKey]bool)
+	for i := range e.rules {
+		rule := &e.rules[i]
+		for key, value := range ruleSeries(snapshot, rule) {
+			if !rule.holds(value) {
+				continue
+			}
+			akey := alertKey{rule: rule.Name, series: key}
+			active[akey] = true
+			alert, ok := e.alerts[akey]
+			if !ok || alert.State == StateResolved {
+				_, labels := metrics.ParseSeriesKey(key)
+				alert = &Alert{
+					Rule:     rule.Name,
+					Type:     rule.Type,
+					Metric:   rule.Metric,
+					Labels:   labels,
+					State:    StatePending,
+					ActiveAt: now,
+					series:   key,
+				}
+				e.alerts[akey] = alert
+			}
+			alert.Severity = rule.Severity
+			alert.Value = value
+			if alert.State == StatePending && now.Sub(alert.ActiveAt) >= time.Duration(rule.For) {
+				firedAt := now
+				alert.State = StateFiring
+				alert.FiredAt = &firedAt
+			}
+		}
+	}
+
+	for akey, alert := range e.alerts {
+		if active[akey] {
+			continue
+		}
+		switch alert.State {
+		case StatePending:
+			delete(e.alerts, akey)
+		case StateFiring:
+			resolvedAt := now
+			alert.State = StateResolved
+			alert.ResolvedAt = &resolvedAt
+		case StateResolved:
+			if now.Sub(*alert.ResolvedAt) >= ResolvedRetention {
+				delete(e.alerts, akey)
+			}
+		}
+	}
+}
+
+// ruleSeries returns the values of the series matched by rule.
+func ruleSeries(snapshot *storage.Snapshot, rule *Rule) map[string]float64 {
+	result := make(map[string]float64)
+	if rule.Type == "gauge" {
+		for _, key := range snapshot.GaugeNames() {
+			if id, labels := metrics.ParseSeriesKey(key); id == rule.Metric && rule.selector.Matches(labels) {
+				result[key], _ = snapshot.Gauge(key)
+			}
+		}
+		return result
+	}
+	for _, key := range snapshot.CounterNames() {
+		if id, labels := metrics.ParseSeriesKey(key); id == rule.Metric && rule.selector.Matches(labels) {
+			value, _ := snapshot.Counter(key)
+			result[key] = float64(value)
+		}
+	}
+	return result
+}
+
+// Alerts returns the current alerts sorted by rule and series.
+func (e *Engine) Alerts() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	result := make([]Alert, 0, len(e.alerts))
+	for _, alert := range e.alerts {
+		result = append(result, *alert)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Rule != result[j].Rule {
+			return result[i].Rule < result[j].Rule
+		}
+		return result[i].series < result[j].series
+	})
+	return result
+}
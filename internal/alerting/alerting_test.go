@@ -0,0 +1,188 @@
+package alerting
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/dumper"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const testRules = `{"rules": [
+	{"name": "HighHeap", "type": "gauge", "metric": "HeapAlloc", "op": ">", "threshold": 100, "for": "1m", "severity": "warning"}
+]}`
+
+type testEngine struct {
+	*Engine
+	storage *storage.MemStorage
+	path    string
+	clock   time.Time
+}
+
+func newTestEngine(t *testing.T, rules string) *testEngine {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0644))
+	s, _ := storage.NewMemStorage(dumper.NewDumper(filepath.Join(t.TempDir(), "dump.json")), false)
+	engine, err := NewEngine(path, s, zap.NewNop())
+	require.NoError(t, err)
+	te := &testEngine{Engine: engine, storage: s, path: path, clock: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	engine.now = func() time.Time { return te.clock }
+	return te
+}
+
+// step sets the gauge, advances the clock and evaluates the rules.
+func (te *testEngine) step(t *testing.T, key string, value float64, advance time.Duration) []Alert {
+	require.NoError(t, te.storage.GaugeUpdate(key, value))
+	te.clock = te.clock.Add(advance)
+	require.NoError(t, te.Evaluate())
+	return te.Alerts()
+}
+
+func states(alerts []Alert) []State {
+	result := make([]State, 0, len(alerts))
+	for _, alert := range alerts {
+		result = append(result, alert.State)
+	}
+	return result
+}
+
+func TestStateTransitions(t *testing.T) {
+	te := newTestEngine(t, testRules)
+
+	assert.Empty(t, te.step(t, "HeapAlloc", 50, 0), "no alert while the rule does not hold")
+
+	alerts := te.step(t, "HeapAlloc", 150, 10*time.Second)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StatePending, alerts[0].State)
+	assert.Equal(t, te.clock, alerts[0].ActiveAt)
+	assert.Nil(t, alerts[0].FiredAt)
+	assert.Equal(t, "warning", alerts[0].Severity)
+	assert.Equal(t, 150.0, alerts[0].Value)
+	activeAt := alerts[0].ActiveAt
+
+	assert.Equal(t, []State{StatePending}, states(te.step(t, "HeapAlloc", 160, 30*time.Second)))
+
+	alerts = te.step(t, "HeapAlloc", 170, 30*time.Second)
+	require.Equal(t, []State{StateFiring}, states(alerts), "fires once the rule held for the for duration")
+	assert.Equal(t, activeAt, alerts[0].ActiveAt)
+	require.NotNil(t, alerts[0].FiredAt)
+	assert.Equal(t, te.clock, *alerts[0].FiredAt)
+	assert.Equal(t, 170.0, alerts[0].Value)
+
+	alerts = te.step(t, "HeapAlloc", 90, 10*time.Second)
+	require.Equal(t, []State{StateResolved}, states(alerts))
+	require.NotNil(t, alerts[0].ResolvedAt)
+	assert.Equal(t, te.clock, *alerts[0].ResolvedAt)
+
+	alerts = te.step(t, "HeapAlloc", 200, 10*time.Second)
+	require.Equal(t, []State{StatePending}, states(alerts), "a resolved alert starts over")
+	assert.Equal(t, te.clock, alerts[0].ActiveAt)
+	assert.Nil(t, alerts[0].ResolvedAt)
+}
+
+func TestPendingAlertIsDropped(t *testing.T) {
+	te := newTestEngine(t, testRules)
+	assert.Equal(t, []State{StatePending}, states(te.step(t, "HeapAlloc", 150, 0)))
+	assert.Empty(t, te.step(t, "HeapAlloc", 50, 10*time.Second), "a pending alert never resolves")
+}
+
+func TestResolvedAlertExpires(t *testing.T) {
+	te := newTestEngine(t, `{"rules": [{"name": "High", "type": "gauge", "metric": "HeapAlloc", "op": ">=", "threshold": 100}]}`)
+	assert.Equal(t, []State{StateFiring}, states(te.step(t, "HeapAlloc", 100, 0)), "fires at once without for")
+	assert.Equal(t, []State{StateResolved}, states(te.step(t, "HeapAlloc", 99, time.Second)))
+	assert.Equal(t, []State{StateResolved}, states(te.step(t, "HeapAlloc", 99, ResolvedRetention-time.Second)))
+	assert.Empty(t, te.step(t, "HeapAlloc", 99, time.Second))
+}
+
+func TestAlertPerSeries(t *testing.T) {
+	te := newTestEngine(t, `{"rules": [
+		{"name": "Polls", "type": "counter", "metric": "PollCount", "match": "{env=\"prod\"}", "op": ">", "threshold": 5}
+	]}`)
+	require.NoError(t, te.storage.CounterUpdate(metrics.SeriesKey("PollCount", metrics.Labels{"env": "prod", "host": "a"}), 10))
+	require.NoError(t, te.storage.CounterUpdate(metrics.SeriesKey("PollCount", metrics.Labels{"env": "prod", "host": "b"}), 3))
+	require.NoError(t, te.storage.CounterUpdate(metrics.SeriesKey("PollCount", metrics.Labels{"env": "dev", "host": "c"}), 10))
+	require.NoError(t, te.storage.GaugeUpdate("PollCount", 10))
+	require.NoError(t, te.Evaluate())
+
+	alerts := te.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, metrics.Labels{"env": "prod", "host": "a"}, alerts[0].Labels)
+	assert.Equal(t, "counter", alerts[0].Type)
+	assert.Equal(t, StateFiring, alerts[0].State)
+
+	require.NoError(t, te.storage.CounterUpdate(metrics.SeriesKey("PollCount", metrics.Labels{"env": "prod", "host": "b"}), 3))
+	require.NoError(t, te.Evaluate())
+	assert.Len(t, te.Alerts(), 2, "every series is an alert of its own")
+}
+
+func TestReload(t *testing.T) {
+	te := newTestEngine(t, testRules)
+	assert.Equal(t, []State{StatePending}, states(te.step(t, "HeapAlloc", 150, 0)))
+
+	// Keeping the rule name keeps the state; a lower for makes it fire.
+	require.NoError(t, os.WriteFile(te.path, []byte(`{"rules": [
+		{"name": "HighHeap", "type": "gauge", "metric": "HeapAlloc", "op": ">", "threshold": 100, "for": "5s"},
+		{"name": "LowHeap", "type": "gauge", "metric": "HeapAlloc", "op": "<", "threshold": 10}
+	]}`), 0644))
+	require.NoError(t, te.Reload())
+	alerts := te.step(t, "HeapAlloc", 150, 10*time.Second)
+	assert.Equal(t, []State{StateFiring}, states(alerts))
+
+	require.NoError(t, os.WriteFile(te.path, []byte(`{"rules": [`), 0644))
+	assert.Error(t, te.Reload())
+	assert.Equal(t, []State{StateFiring}, states(te.step(t, "HeapAlloc", 150, time.Second)), "a broken file keeps the rules")
+
+	require.NoError(t, os.WriteFile(te.path, []byte(`{"rules": [
+		{"name": "LowHeap", "type": "gauge", "metric": "HeapAlloc", "op": "<", "threshold": 10}
+	]}`), 0644))
+	require.NoError(t, te.Reload())
+	assert.Empty(t, te.Alerts(), "the alerts of a removed rule are dropped")
+	alerts = te.step(t, "HeapAlloc", 5, time.Second)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "LowHeap", alerts[0].Rule)
+}
+
+func TestChangedFileIsDetected(t *testing.T) {
+	te := newTestEngine(t, testRules)
+	assert.False(t, te.changed())
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(te.path, later, later))
+	assert.True(t, te.changed())
+	require.NoError(t, te.Reload())
+	assert.False(t, te.changed())
+}
+
+func TestLoadRulesRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{name: "Not JSON", rules: `rules`},
+		{name: "Unknown field", rules: `{"rules": [{"name": "a", "type": "gauge", "metric": "m", "op": ">", "treshold": 1}]}`},
+		{name: "No name", rules: `{"rules": [{"type": "gauge", "metric": "m", "op": ">"}]}`},
+		{name: "No metric", rules: `{"rules": [{"name": "a", "type": "gauge", "op": ">"}]}`},
+		{name: "Bad type", rules: `{"rules": [{"name": "a", "type": "histogram", "metric": "m", "op": ">"}]}`},
+		{name: "Bad op", rules: `{"rules": [{"name": "a", "type": "gauge", "metric": "m", "op": "=>"}]}`},
+		{name: "Bad for", rules: `{"rules": [{"name": "a", "type": "gauge", "metric": "m", "op": ">", "for": "soon"}]}`},
+		{name: "Negative for", rules: `{"rules": [{"name": "a", "type": "gauge", "metric": "m", "op": ">", "for": "-1m"}]}`},
+		{name: "Bad match", rules: `{"rules": [{"name": "a", "type": "gauge", "metric": "m", "op": ">", "match": "{host}"}]}`},
+		{name: "Duplicate name", rules: `{"rules": [
+			{"name": "a", "type": "gauge", "metric": "m", "op": ">"},
+			{"name": "a", "type": "gauge", "metric": "n", "op": ">"}
+		]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.rules), 0644))
+			_, err := LoadRules(path)
+			assert.Error(t, err)
+		})
+	}
+}
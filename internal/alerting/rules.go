@@ -0,0 +1,118 @@
+package alerting
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+)
+
+// Duration is a time.Duration written as a string such as "5m" in rule
+// files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Rule fires when a series of the metric matched by Type, Metric and the
+// optional Match selector compares to Threshold with Op for at least For.
+// Every matching series is tracked as a separate alert.
+type Rule struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Metric    string   `json:"metric"`
+	Match     string   `json:"match,omitempty"`
+	Op        string   `json:"op"`
+	Threshold float64  `json:"threshold"`
+	For       Duration `json:"for,omitempty"`
+	Severity  string   `json:"severity,omitempty"`
+
+	selector metrics.Selector
+}
+
+type ruleFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadRules reads and validates a rules file of the form
+// {"rules": [{"name": ..., "metric": ..., ...}]}.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file ruleFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %s: %w", path, err)
+	}
+	names := make(map[string]bool, len(file.Rules))
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i, rule.Name, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %d: duplicate name %q", i, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return file.Rules, nil
+}
+
+// validate checks the rule and prepares its selector.
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if r.Metric == "" {
+		return errors.New("metric is required")
+	}
+	if r.Type != "gauge" && r.Type != "counter" {
+		return fmt.Errorf("invalid type %q: want gauge or counter", r.Type)
+	}
+	if _, ok := comparisons[r.Op]; !ok {
+		return fmt.Errorf("invalid op %q", r.Op)
+	}
+	if r.For < 0 {
+		return errors.New("for must not be negative")
+	}
+	selector, err := metrics.ParseSelector(r.Match)
+	if err != nil {
+		return fmt.Errorf("invalid match: %w", err)
+	}
+	r.selector = selector
+	return nil
+}
+
+var comparisons = map[string]func(value, threshold float64) bool{
+	">":  func(value, threshold float64) bool { return value > threshold },
+	">=": func(value, threshold float64) bool { return value >= threshold },
+	"<":  func(value, threshold float64) bool { return value < threshold },
+	"<=": func(value, threshold float64) bool { return value <= threshold },
+	"==": func(value, threshold float64) bool { return value == threshold },
+	"!=": func(value, threshold float64) bool { return value != threshold },
+}
+
+func (r *Rule) holds(value float64) bool {
+	return comparisons[r.Op](value, r.Threshold)
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+
+	"github.com/personage-hub/metrics-tracker/internal/hoststats"
+)
+
+// RuntimeCollector reports the agent process memory statistics.
+type RuntimeCollector struct{}
+
+func NewRuntimeCollector() *RuntimeCollector {
+	return &RuntimeCollector{}
+}
+
+func (c *RuntimeCollector) Name() string {
+	return "runtime"
+}
+
+func (c *RuntimeCollector) Collect(_ context.Context) ([]Sample, error) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return []Sample{
+		Gauge("Alloc", float64(m.Alloc)),
+		Gauge("BuckHashSys", float64(m.BuckHashSys)),
+		Gauge("Frees", float64(m.Frees)),
+		Gauge("GCCPUFraction", m.GCCPUFraction),
+		Gauge("GCSys", float64(m.GCSys)),
+		Gauge("HeapAlloc", float64(m.HeapAlloc)),
+		Gauge("HeapIdle", float64(m.HeapIdle)),
+		Gauge("HeapInuse", float64(m.HeapInuse)),
+		Gauge("HeapObjects", float64(m.HeapObjects)),
+		Gauge("HeapReleased", float64(m.HeapReleased)),
+		Gauge("HeapSys", float64(m.HeapSys)),
+		Gauge("LastGC", float64(m.LastGC)),
+		Gauge("Lookups", float64(m.Lookups)),
+		Gauge("MCacheInuse", float64(m.MCacheInuse)),
+		Gauge("MCacheSys", float64(m.MCacheSys)),
+		Gauge("MSpanInuse", float64(m.MSpanInuse)),
+		Gauge("MSpanSys", float64(m.MSpanSys)),
+		Gauge("Mallocs", float64(m.Mallocs)),
+		Gauge("NextGC", float64(m.NextGC)),
+		Gauge("NumForcedGC", float64(m.NumForcedGC)),
+		Gauge("NumGC", float64(m.NumGC)),
+		Gauge("OtherSys", float64(m.OtherSys)),
+		Gauge("PauseTotalNs", float64(m.PauseTotalNs)),
+		Gauge("StackInuse", float64(m.StackInuse)),
+		Gauge("StackSys", float64(m.StackSys)),
+		Gauge("Sys", float64(m.Sys)),
+		Gauge("TotalAlloc", float64(m.TotalAlloc)),
+	}, nil
+}
+
+// PollCollector reports RandomValue and increments PollCount on every poll.
+type PollCollector struct{}
+
+func NewPollCollector() *PollCollector {
+	return &PollCollector{}
+}
+
+func (c *PollCollector) Name() string {
+	return "poll"
+}
+
+func (c *PollCollector) Collect(_ context.Context) ([]Sample, error) {
+	return []Sample{
+		Gauge("RandomValue", rand.Float64()),
+		Counter("PollCount", 1),
+	}, nil
+}
+
+// HostCollector reports host-wide statistics read from procfs.
+type HostCollector struct {
+	stats *hoststats.Collector
+}
+
+func NewHostCollector(procRoot string) *HostCollector {
+	return &HostCollector{
+		stats: hoststats.NewCollector(procRoot),
+	}
+}
+
+func (c *HostCollector) Name() string {
+	return "host"
+}
+
+func (c *HostCollector) Collect(_ context.Context) ([]Sample, error) {
+	values, err := c.stats.Collect()
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]Sample, 0, len(values))
+	for name, value := range values {
+		samples = append(samples, Gauge(name, value))
+	}
+	return samples, nil
+}
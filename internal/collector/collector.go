@@ -0,0 +1,33 @@
+package collector
+
+import (
+	"context"
+
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+)
+
+// Sample is a single value produced by a Collector. Gauges carry Value,
+// counters carry Delta: the increment observed since the previous Collect.
+// Labels are optional.
+type Sample struct {
+	Name   string
+	MType  string
+	Value  float64
+	Delta  int64
+	Labels metrics.Labels
+}
+
+func Gauge(name string, value float64) Sample {
+	return Sample{Name: name, MType: "gauge", Value: value}
+}
+
+func Counter(name string, delta int64) Sample {
+	return Sample{Name: name, MType: "counter", Delta: delta}
+}
+
+// Collector is a source of metrics polled by the agent. Collect must honour
+// ctx cancellation; the registry abandons collectors that exceed their timeout.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) ([]Sample, error)
+}
@@ -0,0 +1,118 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const DefaultTimeout = time.Second
+
+type Options struct {
+	// Disabled lists collector names that are skipped by Register.
+	Disabled map[string]bool
+	// Timeouts overrides DefaultTimeout for individual collectors.
+	Timeouts       map[string]time.Duration
+	DefaultTimeout time.Duration
+}
+
+type entry struct {
+	collector Collector
+	timeout   time.Duration
+}
+
+type result struct {
+	samples []Sample
+	err     error
+}
+
+// Registry runs a set of collectors concurrently, each bounded by its own
+// timeout, so one slow or failing collector never blocks the others.
+type Registry struct {
+	entries []entry
+	options Options
+	logger  *zap.Logger
+}
+
+func NewRegistry(logger *zap.Logger, options Options) *Registry {
+	if options.DefaultTimeout <= 0 {
+		options.DefaultTimeout = DefaultTimeout
+	}
+	return &Registry{
+		options: options,
+		logger:  logger,
+	}
+}
+
+// Register adds c unless it is disabled in Options. It reports whether the
+// collector was added.
+func (r *Registry) Register(c Collector) bool {
+	if r.options.Disabled[c.Name()] {
+		r.logger.Info("collector disabled", zap.String("collector", c.Name()))
+		return false
+	}
+	timeout, ok := r.options.Timeouts[c.Name()]
+	if !ok || timeout <= 0 {
+		timeout = r.options.DefaultTimeout
+	}
+	r.entries = append(r.entries, entry{collector: c, timeout: timeout})
+	return true
+}
+
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.entries))
+	for _, e := range r.entries {
+		names = append(names, e.collector.Name())
+	}
+	return names
+}
+
+// Collect polls every registered collector and returns the samples in
+// registration order. Failed or timed out collectors are logged and skipped.
+func (r *Registry) Collect(ctx context.Context) []Sample {
+	results := make([]chan result, len(r.entries))
+	for i, e := range r.entries {
+		results[i] = make(chan result, 1)
+		go r.run(ctx, e, results[i])
+	}
+
+	var samples []Sample
+	for i, e := range r.entries {
+		res := <-results[i]
+		if res.err != nil {
+			r.logger.Warn(
+				"collector failed",
+				zap.String("collector", e.collector.Name()),
+				zap.Error(res.err),
+			)
+			continue
+		}
+		samples = append(samples, res.samples...)
+	}
+	return samples
+}
+
+func (r *Registry) run(ctx context.Context, e entry, out chan<- result) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{err: fmt.Errorf("collector panicked: %v", p)}
+			}
+		}()
+		samples, err := e.collector.Collect(ctx)
+		done <- result{samples: samples, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		out <- res
+	case <-ctx.Done():
+		out <- result{err: fmt.Errorf("collector abandoned: %w", ctx.Err())}
+	}
+}
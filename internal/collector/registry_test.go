@@ -0,0 +1,109 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type stubCollector struct {
+	name    string
+	samples []Sample
+	err     error
+	delay   time.Duration
+	panics  bool
+}
+
+func (c *stubCollector) Name() string {
+	return c.name
+}
+
+func (c *stubCollector) Collect(ctx context.Context) ([]Sample, error) {
+	if c.panics {
+		panic("broken collector")
+	}
+	if c.delay > 0 {
+		select {
+		case <-time.After(c.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return c.samples, c.err
+}
+
+func TestRegistryCollect(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    Options
+		collectors []Collector
+		want       []Sample
+		wantNames  []string
+	}{
+		{
+			name: "Samples in registration order",
+			collectors: []Collector{
+				&stubCollector{name: "first", samples: []Sample{Gauge("A", 1)}},
+				&stubCollector{name: "second", samples: []Sample{Counter("B", 2)}},
+			},
+			want:      []Sample{Gauge("A", 1), Counter("B", 2)},
+			wantNames: []string{"first", "second"},
+		},
+		{
+			name:    "Disabled collector is skipped",
+			options: Options{Disabled: map[string]bool{"first": true}},
+			collectors: []Collector{
+				&stubCollector{name: "first", samples: []Sample{Gauge("A", 1)}},
+				&stubCollector{name: "second", samples: []Sample{Counter("B", 2)}},
+			},
+			want:      []Sample{Counter("B", 2)},
+			wantNames: []string{"second"},
+		},
+		{
+			name: "Failing collector is isolated",
+			collectors: []Collector{
+				&stubCollector{name: "broken", err: errors.New("no data")},
+				&stubCollector{name: "panicking", panics: true},
+				&stubCollector{name: "second", samples: []Sample{Counter("B", 2)}},
+			},
+			want:      []Sample{Counter("B", 2)},
+			wantNames: []string{"broken", "panicking", "second"},
+		},
+		{
+			name: "Slow collector times out",
+			options: Options{
+				DefaultTimeout: time.Minute,
+				Timeouts:       map[string]time.Duration{"slow": 10 * time.Millisecond},
+			},
+			collectors: []Collector{
+				&stubCollector{name: "slow", delay: time.Minute, samples: []Sample{Gauge("A", 1)}},
+				&stubCollector{name: "second", samples: []Sample{Counter("B", 2)}},
+			},
+			want:      []Sample{Counter("B", 2)},
+			wantNames: []string{"slow", "second"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry(zap.NewNop(), tt.options)
+			for _, c := range tt.collectors {
+				r.Register(c)
+			}
+			assert.Equal(t, tt.wantNames, r.Names())
+
+			start := time.Now()
+			assert.Equal(t, tt.want, r.Collect(context.Background()))
+			assert.Less(t, time.Since(start), 5*time.Second)
+		})
+	}
+}
+
+func TestPollCollector(t *testing.T) {
+	samples, err := NewPollCollector().Collect(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, samples, Counter("PollCount", 1))
+}
@@ -0,0 +1,147 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/personage-hub/metrics-tracker/internal/httpheader"
+)
+
+const (
+	Gzip     = "gzip"
+	Deflate  = "deflate"
+	Zstd     = "zstd"
+	Identity = "identity"
+)
+
+// DefaultLevel selects the default compression level of an algorithm.
+const DefaultLevel = -1
+
+// maxDecoderMemory bounds the memory a zstd stream may request while decoding.
+const maxDecoderMemory = 64 << 20
+
+// Supported reports whether encoding can be read and written.
+func Supported(encoding string) bool {
+	switch encoding {
+	case Gzip, Deflate, Zstd, Identity:
+		return true
+	}
+	return false
+}
+
+// NewWriter returns a writer compressing into w. Levels follow the algorithm:
+// 1-9 for gzip and deflate, 1-22 for zstd, DefaultLevel for the default.
+func NewWriter(encoding string, w io.Writer, level int) (io.WriteCloser, error) {
+	switch encoding {
+	case Gzip:
+		if level == DefaultLevel {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Deflate:
+		if level == DefaultLevel {
+			level = zlib.DefaultCompression
+		}
+		return zlib.NewWriterLevel(w, level)
+	case Zstd:
+		zstdLevel := zstd.SpeedDefault
+		if level != DefaultLevel {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(
+			w,
+			zstd.WithEncoderLevel(zstdLevel),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithLowerEncoderMem(true),
+		)
+	case Identity, "":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// NewReader returns a reader decompressing r.
+func NewReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Deflate:
+		return zlib.NewReader(r)
+	case Zstd:
+		decoder, err := zstd.NewReader(
+			r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(maxDecoderMemory),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case Identity, "":
+		return io.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// Compress returns data compressed with encoding.
+func Compress(encoding string, level int, data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := NewWriter(encoding, &b, level)
+	if err != nil {
+		return nil, fmt.Errorf("failed init compress writer: %w", err)
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write compress data to buffer: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close compress writer: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Negotiate picks the response encoding for an Accept-Encoding header out of
+// offers, listed in server preference order. Higher q-values win, ties go to
+// the earlier offer, "*" matches any offer not listed explicitly and q=0
+// excludes an encoding. Identity is returned when nothing else is acceptable.
+func Negotiate(acceptEncoding string, offers []string) string {
+	accepted := parseAcceptEncoding(acceptEncoding)
+	if len(accepted) == 0 {
+		return Identity
+	}
+
+	best, bestQ := Identity, 0.0
+	for _, offer := range offers {
+		q, ok := accepted[offer]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// parseAcceptEncoding maps each listed coding to its q-value. When a coding
+// is listed twice the first occurrence wins.
+func parseAcceptEncoding(header string) map[string]float64 {
+	result := make(map[string]float64)
+	for _, accepted := range httpheader.ParseAccept(header) {
+		if _, ok := result[accepted.Value]; !ok {
+			result[accepted.Value] = accepted.Q
+		}
+	}
+	return result
+}
@@ -0,0 +1,68 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"id":"Alloc","type":"gauge","value":1}`), 100)
+	for _, encoding := range []string{Gzip, Deflate, Zstd, Identity} {
+		for _, level := range []int{DefaultLevel, 1, 9} {
+			compressed, err := Compress(encoding, level, data)
+			require.NoError(t, err, encoding)
+			if encoding != Identity {
+				assert.Less(t, len(compressed), len(data), encoding)
+			}
+
+			r, err := NewReader(encoding, bytes.NewReader(compressed))
+			require.NoError(t, err, encoding)
+			plain, err := io.ReadAll(r)
+			require.NoError(t, err, encoding)
+			require.NoError(t, r.Close())
+			assert.Equal(t, data, plain, encoding)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	assert.False(t, Supported("br"))
+	_, err := NewReader("br", bytes.NewReader(nil))
+	assert.Error(t, err)
+	_, err = Compress("br", DefaultLevel, nil)
+	assert.Error(t, err)
+}
+
+func TestInvalidLevel(t *testing.T) {
+	for _, encoding := range []string{Gzip, Deflate} {
+		_, err := NewWriter(encoding, io.Discard, 12)
+		assert.Error(t, err, encoding)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{Gzip, Zstd, Deflate}
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: Identity},
+		{header: "gzip", want: Gzip},
+		{header: "deflate, gzip", want: Gzip},
+		{header: "gzip;q=0.5, zstd", want: Zstd},
+		{header: "gzip;q=0, deflate;q=0.1", want: Deflate},
+		{header: "*", want: Gzip},
+		{header: "*;q=0.1, zstd;q=0.5", want: Zstd},
+		{header: "gzip;q=0, *", want: Zstd},
+		{header: "br", want: Identity},
+		{header: "GZIP ; q=0.8", want: Gzip},
+		{header: "gzip;q=0, zstd;q=0, deflate;q=0", want: Identity},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Negotiate(tt.header, offers), tt.header)
+	}
+}
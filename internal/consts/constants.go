@@ -3,3 +3,4 @@ package consts
 const ContentTypeJSON string = "application/json"
 const ContentTypeHTML string = "text/html"
 const Compression string = "gzip"
+const HeaderIdempotencyKey string = "Idempotency-Key"
@@ -4,3 +4,11 @@ type Dumper interface {
 	SaveData(gaugeMap map[string]float64, counterMap map[string]int64) error
 	RestoreData() (gaugeMap map[string]float64, counterMap map[string]int64, err error)
 }
+
+// KeyDumper also keeps the idempotency keys of applied batches, in the same
+// dump as the data they were applied to.
+type KeyDumper interface {
+	Dumper
+	SaveDataWithKeys(gaugeMap map[string]float64, counterMap map[string]int64, keys []string) error
+	RestoreDataWithKeys() (gaugeMap map[string]float64, counterMap map[string]int64, keys []string, err error)
+}
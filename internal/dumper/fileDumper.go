@@ -1,11 +1,29 @@
 package dumper
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/segments"
 )
 
+// formatVersion is the version of dumps written by SaveData. Dumps without a
+// header are the legacy format and are still restored.
+const formatVersion = 2
+
+// backupSuffix names the previous dump, kept as a fallback when the current
+// one turns out to be unreadable.
+const backupSuffix = ".bak"
+
+var ErrCorruptDump = errors.New("corrupt dump")
+
 type DumpFile struct {
 	Path string
 }
@@ -13,6 +31,16 @@ type DumpFile struct {
 type FileStorage struct {
 	CounterData map[string]int64
 	GaugeData   map[string]float64
+	AppliedKeys []string `json:",omitempty"`
+}
+
+// dumpHeader wraps the data with what is needed to validate it on restore.
+// Checksum is the hex SHA-256 of Data in compact form.
+type dumpHeader struct {
+	Version   int             `json:"version"`
+	WrittenAt time.Time       `json:"written_at"`
+	Checksum  string          `json:"checksum"`
+	Data      json.RawMessage `json:"data"`
 }
 
 func NewDumper(path string) *DumpFile {
@@ -22,33 +50,130 @@ func NewDumper(path string) *DumpFile {
 }
 
 func (file *DumpFile) SaveData(gaugeMap map[string]float64, counterMap map[string]int64) error {
+	return file.SaveDataWithKeys(gaugeMap, counterMap, nil)
+}
+
+// SaveDataWithKeys replaces the dump atomically: the new dump is written and
+// synced to a temporary file, the current dump becomes the backup and the
+// temporary file is renamed into place. A crash at any point leaves either
+// the old or the new dump readable. A current dump that fails validation is
+// overwritten without replacing the backup.
+func (file *DumpFile) SaveDataWithKeys(gaugeMap map[string]float64, counterMap map[string]int64, keys []string) error {
 	fileStorage := FileStorage{
 		CounterData: counterMap,
 		GaugeData:   gaugeMap,
+		AppliedKeys: keys,
 	}
 
-	data, err := json.MarshalIndent(fileStorage, "", "  ")
+	payload, err := json.Marshal(fileStorage)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(file.Path, data, 0666); err != nil {
+	sum := sha256.Sum256(payload)
+	data, err := json.MarshalIndent(dumpHeader{
+		Version:   formatVersion,
+		WrittenAt: time.Now().UTC(),
+		Checksum:  hex.EncodeToString(sum[:]),
+		Data:      payload,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(file.Path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(file.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
 		return err
 	}
-	return nil
+	if err := os.Chmod(tmp.Name(), 0666); err != nil {
+		return err
+	}
+
+	if _, err := readDump(file.Path); err == nil {
+		if err := os.Rename(file.Path, file.Path+backupSuffix); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), file.Path); err != nil {
+		return err
+	}
+	return segments.SyncDir(dir)
 }
 
 func (file *DumpFile) RestoreData() (map[string]float64, map[string]int64, error) {
+	gauges, counters, _, err := file.RestoreDataWithKeys()
+	return gauges, counters, err
+}
 
-	if _, err := os.Stat(file.Path); os.IsNotExist(err) {
-		return nil, nil, fmt.Errorf("file does not exist, skipping restore. %w", err)
+// RestoreDataWithKeys reads the dump and falls back to the backup when the
+// dump is missing or fails validation.
+func (file *DumpFile) RestoreDataWithKeys() (map[string]float64, map[string]int64, []string, error) {
+	fileStorage, err := readDump(file.Path)
+	if err == nil {
+		return fileStorage.GaugeData, fileStorage.CounterData, fileStorage.AppliedKeys, nil
+	}
+
+	backup, backupErr := readDump(file.Path + backupSuffix)
+	if backupErr == nil {
+		return backup.GaugeData, backup.CounterData, backup.AppliedKeys, nil
+	}
+	if os.IsNotExist(err) {
+		if os.IsNotExist(backupErr) {
+			return nil, nil, nil, fmt.Errorf("file does not exist, skipping restore. %w", err)
+		}
+		return nil, nil, nil, backupErr
 	}
-	data, err := os.ReadFile(file.Path)
+	if os.IsNotExist(backupErr) {
+		return nil, nil, nil, err
+	}
+	return nil, nil, nil, errors.Join(err, backupErr)
+}
+
+func readDump(path string) (FileStorage, error) {
+	var fileStorage FileStorage
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, nil, err
+		return fileStorage, err
+	}
+
+	var header dumpHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return fileStorage, fmt.Errorf("%w %s: %v", ErrCorruptDump, path, err)
+	}
+	switch header.Version {
+	case 0:
+		// Legacy dump without a header.
+		if err := json.Unmarshal(data, &fileStorage); err != nil {
+			return fileStorage, fmt.Errorf("%w %s: %v", ErrCorruptDump, path, err)
+		}
+		return fileStorage, nil
+	case formatVersion:
+	default:
+		return fileStorage, fmt.Errorf("%w %s: unsupported version %d", ErrCorruptDump, path, header.Version)
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, header.Data); err != nil {
+		return fileStorage, fmt.Errorf("%w %s: %v", ErrCorruptDump, path, err)
+	}
+	sum := sha256.Sum256(compact.Bytes())
+	if hex.EncodeToString(sum[:]) != header.Checksum {
+		return fileStorage, fmt.Errorf("%w %s: checksum mismatch", ErrCorruptDump, path)
 	}
-	fileStorage := FileStorage{}
-	if err := json.Unmarshal(data, &fileStorage); err != nil {
-		return nil, nil, err
+	if err := json.Unmarshal(header.Data, &fileStorage); err != nil {
+		return fileStorage, fmt.Errorf("%w %s: %v", ErrCorruptDump, path, err)
 	}
-	return fileStorage.GaugeData, fileStorage.CounterData, nil
+	return fileStorage, nil
 }
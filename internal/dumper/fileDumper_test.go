@@ -0,0 +1,118 @@
+package dumper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveAndRestore(t *testing.T) {
+	d := NewDumper(filepath.Join(t.TempDir(), "dump.json"))
+	gauges := map[string]float64{"Alloc": 1.5}
+	counters := map[string]int64{"PollCount": 3}
+
+	require.NoError(t, d.SaveData(gauges, counters))
+	restoredGauges, restoredCounters, err := d.RestoreData()
+	require.NoError(t, err)
+	assert.Equal(t, gauges, restoredGauges)
+	assert.Equal(t, counters, restoredCounters)
+
+	entries, err := os.ReadDir(filepath.Dir(d.Path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no temporary files are left behind")
+}
+
+func TestRestoreFallsBackToBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, path string)
+	}{
+		{
+			name: "Truncated dump",
+			corrupt: func(t *testing.T, path string) {
+				data, err := os.ReadFile(path)
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(path, data[:len(data)/2], 0666))
+			},
+		},
+		{
+			name: "Checksum mismatch",
+			corrupt: func(t *testing.T, path string) {
+				data, err := os.ReadFile(path)
+				require.NoError(t, err)
+				data = []byte(strings.Replace(string(data), `"PollCount": 5`, `"PollCount": 6`, 1))
+				require.NoError(t, os.WriteFile(path, data, 0666))
+			},
+		},
+		{
+			name: "Unknown version",
+			corrupt: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, []byte(`{"version":99}`), 0666))
+			},
+		},
+		{
+			name: "Missing dump",
+			corrupt: func(t *testing.T, path string) {
+				require.NoError(t, os.Remove(path))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDumper(filepath.Join(t.TempDir(), "dump.json"))
+			require.NoError(t, d.SaveData(map[string]float64{"Alloc": 1}, map[string]int64{"PollCount": 3}))
+			require.NoError(t, d.SaveData(map[string]float64{"Alloc": 2}, map[string]int64{"PollCount": 5}))
+			tt.corrupt(t, d.Path)
+
+			gauges, counters, err := d.RestoreData()
+			require.NoError(t, err)
+			assert.Equal(t, map[string]float64{"Alloc": 1}, gauges)
+			assert.Equal(t, map[string]int64{"PollCount": 3}, counters)
+		})
+	}
+}
+
+func TestSaveKeepsBackupOverCorruptDump(t *testing.T) {
+	d := NewDumper(filepath.Join(t.TempDir(), "dump.json"))
+	require.NoError(t, d.SaveData(map[string]float64{"Alloc": 1}, map[string]int64{"PollCount": 3}))
+	require.NoError(t, d.SaveData(map[string]float64{"Alloc": 2}, map[string]int64{"PollCount": 5}))
+	data, err := os.ReadFile(d.Path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(d.Path, []byte(strings.Replace(string(data), `"PollCount": 5`, `"PollCount": 6`, 1)), 0666))
+
+	require.NoError(t, d.SaveData(map[string]float64{"Alloc": 3}, map[string]int64{"PollCount": 7}))
+	backup, err := readDump(d.Path + backupSuffix)
+	require.NoError(t, err, "the corrupt dump does not replace the valid backup")
+	assert.Equal(t, map[string]int64{"PollCount": 3}, backup.CounterData)
+
+	_, counters, err := d.RestoreData()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"PollCount": 7}, counters)
+}
+
+func TestRestoreCorruptWithoutBackup(t *testing.T) {
+	d := NewDumper(filepath.Join(t.TempDir(), "dump.json"))
+	require.NoError(t, os.WriteFile(d.Path, []byte(`{"version":2,"checksum":"00","data":{}}`), 0666))
+
+	_, _, err := d.RestoreData()
+	assert.ErrorIs(t, err, ErrCorruptDump)
+
+	require.NoError(t, os.Remove(d.Path))
+	_, _, err = d.RestoreData()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRestoreLegacyFormat(t *testing.T) {
+	d := NewDumper(filepath.Join(t.TempDir(), "dump.json"))
+	legacy := `{"CounterData": {"PollCount": 4}, "GaugeData": {"Alloc": 2.5}}`
+	require.NoError(t, os.WriteFile(d.Path, []byte(legacy), 0666))
+
+	gauges, counters, err := d.RestoreData()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": 2.5}, gauges)
+	assert.Equal(t, map[string]int64{"PollCount": 4}, counters)
+}
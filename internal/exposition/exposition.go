@@ -0,0 +1,170 @@
+// Package exposition renders stored metrics in the Prometheus text format
+// 0.0.4 and in the OpenMetrics 1.0.0 text format.
+package exposition
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/personage-hub/metrics-tracker/internal/httpheader"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+)
+
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatOpenMetrics
+)
+
+const (
+	ContentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	ContentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+func (f Format) ContentType() string {
+	if f == FormatOpenMetrics {
+		return ContentTypeOpenMetrics
+	}
+	return ContentTypeText
+}
+
+// Negotiate picks the format for an Accept header. OpenMetrics is chosen only
+// when the client prefers it over text/plain, everything else gets text 0.0.4.
+func Negotiate(accept string) Format {
+	var openMetricsQ, textQ float64
+	for _, accepted := range httpheader.ParseAccept(accept) {
+		switch accepted.Value {
+		case "application/openmetrics-text":
+			openMetricsQ = math.Max(openMetricsQ, accepted.Q)
+		case "text/plain", "text/*", "*/*":
+			textQ = math.Max(textQ, accepted.Q)
+		}
+	}
+	if openMetricsQ > 0 && openMetricsQ > textQ {
+		return FormatOpenMetrics
+	}
+	return FormatText
+}
+
+// SanitizeName maps a metric ID to a valid Prometheus metric name by
+// replacing every disallowed character with an underscore.
+func SanitizeName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	b.Grow(len(name) + 1)
+	for i, r := range name {
+		switch {
+		case r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+type sample struct {
+	labels string
+	value  string
+}
+
+type family struct {
+	name    string
+	id      string
+	mType   string
+	sample  string
+	samples []sample
+}
+
+// Write renders gauges and counters sorted by name, each family with HELP
+// and TYPE lines followed by its series sorted by labels. Keys are series
+// keys as made by metrics.SeriesKey. IDs are sanitized; when two of them end
+// up with the same name, the gauge or the lexically first ID is kept and the
+// others are left out, since a scrape must not contain a metric family twice.
+func Write(w io.Writer, format Format, gauges map[string]float64, counters map[string]int64) error {
+	families := make(map[string]*family, len(gauges)+len(counters))
+	add := func(f *family, s sample) {
+		prev, ok := families[f.name]
+		switch {
+		case ok && prev.mType == f.mType && prev.id == f.id:
+			prev.samples = append(prev.samples, s)
+			return
+		case ok && (prev.mType == "gauge" && f.mType == "counter" || prev.mType == f.mType && prev.id < f.id):
+			return
+		}
+		f.samples = []sample{s}
+		families[f.name] = f
+	}
+
+	for key, value := range gauges {
+		id, labels := metrics.ParseSeriesKey(key)
+		name := SanitizeName(id)
+		add(&family{name: name, id: id, mType: "gauge", sample: name},
+			sample{labels: labels.String(), value: formatFloat(value)})
+	}
+	for key, delta := range counters {
+		id, labels := metrics.ParseSeriesKey(key)
+		name := SanitizeName(id)
+		sampleName := name
+		if format == FormatOpenMetrics {
+			// OpenMetrics names the counter family without the suffix and its sample with it.
+			name = strings.TrimSuffix(name, "_total")
+			sampleName = name + "_total"
+		}
+		add(&family{name: name, id: id, mType: "counter", sample: sampleName},
+			sample{labels: labels.String(), value: strconv.FormatInt(delta, 10)})
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := families[name]
+		sort.Slice(f.samples, func(i, j int) bool { return f.samples[i].labels < f.samples[j].labels })
+		bw.WriteString("# HELP " + f.name + " " + escapeHelp(format, f.mType+" metric "+f.id) + "\n")
+		bw.WriteString("# TYPE " + f.name + " " + f.mType + "\n")
+		for _, s := range f.samples {
+			bw.WriteString(f.sample + s.labels + " " + s.value + "\n")
+		}
+	}
+	if format == FormatOpenMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+func escapeHelp(format Format, help string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	if format == FormatOpenMetrics {
+		replacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	}
+	return replacer.Replace(help)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,165 @@
+package exposition
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "HeapAlloc", want: "HeapAlloc"},
+		{name: "http.requests-total", want: "http_requests_total"},
+		{name: "9lives", want: "_9lives"},
+		{name: "ns:metric_1", want: "ns:metric_1"},
+		{name: "память", want: "______"},
+		{name: "", want: "_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, SanitizeName(tt.name))
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   Format
+	}{
+		{name: "No Accept", want: FormatText},
+		{name: "Wildcard", accept: "*/*", want: FormatText},
+		{name: "Text only", accept: "text/plain;version=0.0.4", want: FormatText},
+		{name: "OpenMetrics only", accept: "application/openmetrics-text", want: FormatOpenMetrics},
+		{
+			name:   "Prometheus scrape",
+			accept: "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			want:   FormatOpenMetrics,
+		},
+		{name: "Text preferred", accept: "application/openmetrics-text;q=0.3,text/plain", want: FormatText},
+		{name: "OpenMetrics excluded", accept: "application/openmetrics-text;q=0", want: FormatText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Negotiate(tt.accept))
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	gauges := map[string]float64{
+		"Alloc":      1.5,
+		"heap.bytes": 1e21,
+		"heap_bytes": 7,
+		"Broken":     math.NaN(),
+		"Clash":      1,
+	}
+	counters := map[string]int64{
+		"PollCount":      5,
+		"requests_total": 3,
+		"Clash":          2,
+	}
+
+	tests := []struct {
+		name   string
+		format Format
+		want   string
+	}{
+		{
+			name:   "Text",
+			format: FormatText,
+			want: `# HELP Alloc gauge metric Alloc
+# TYPE Alloc gauge
+Alloc 1.5
+# HELP Broken gauge metric Broken
+# TYPE Broken gauge
+Broken NaN
+# HELP Clash gauge metric Clash
+# TYPE Clash gauge
+Clash 1
+# HELP PollCount counter metric PollCount
+# TYPE PollCount counter
+PollCount 5
+# HELP heap_bytes gauge metric heap.bytes
+# TYPE heap_bytes gauge
+heap_bytes 1e+21
+# HELP requests_total counter metric requests_total
+# TYPE requests_total counter
+requests_total 3
+`,
+		},
+		{
+			name:   "OpenMetrics",
+			format: FormatOpenMetrics,
+			want: `# HELP Alloc gauge metric Alloc
+# TYPE Alloc gauge
+Alloc 1.5
+# HELP Broken gauge metric Broken
+# TYPE Broken gauge
+Broken NaN
+# HELP Clash gauge metric Clash
+# TYPE Clash gauge
+Clash 1
+# HELP PollCount counter metric PollCount
+# TYPE PollCount counter
+PollCount_total 5
+# HELP heap_bytes gauge metric heap.bytes
+# TYPE heap_bytes gauge
+heap_bytes 1e+21
+# HELP requests counter metric requests_total
+# TYPE requests counter
+requests_total 3
+# EOF
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, Write(&buf, tt.format, gauges, counters))
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func TestWriteEscapesHelp(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, FormatOpenMetrics, map[string]float64{"a\\\"b\n": 1}, nil))
+	assert.Equal(t, "# HELP a__b_ gauge metric a\\\\\\\"b\\n\n# TYPE a__b_ gauge\na__b_ 1\n# EOF\n", buf.String())
+}
+
+func TestWriteLabels(t *testing.T) {
+	gauges := map[string]float64{
+		`Alloc{host="b"}`:          2,
+		"Alloc":                    1,
+		`Alloc{env="x",host="a"}`:  3,
+		`other.id{host="a"}`:       4,
+		`Value{path="a\"b\\c\nd"}`: 5,
+	}
+	counters := map[string]int64{
+		`PollCount{host="a"}`: 7,
+		`Alloc{host="a"}`:     9,
+	}
+	want := "# HELP Alloc gauge metric Alloc\n# TYPE Alloc gauge\n" +
+		"Alloc 1\n" +
+		"Alloc{env=\"x\",host=\"a\"} 3\n" +
+		"Alloc{host=\"b\"} 2\n" +
+		"# HELP PollCount counter metric PollCount\n# TYPE PollCount counter\n" +
+		"PollCount_total{host=\"a\"} 7\n" +
+		"# HELP Value gauge metric Value\n# TYPE Value gauge\n" +
+		"Value{path=\"a\\\"b\\\\c\\nd\"} 5\n" +
+		"# HELP other_id gauge metric other.id\n# TYPE other_id gauge\n" +
+		"other_id{host=\"a\"} 4\n" +
+		"# EOF\n"
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, FormatOpenMetrics, gauges, counters))
+	assert.Equal(t, want, buf.String())
+}
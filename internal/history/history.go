@@ -0,0 +1,172 @@
+// Package history keeps recent timestamped samples of every metric in
+// memory, so the server can answer range queries.
+//
+// Samples older than the retention are dropped, and the number of samples
+// across all series never exceeds a global budget: once it is reached the
+// oldest sample of any series makes room for the new one.
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultMaxSamples = 100000
+
+type Options struct {
+	// Retention is how long a sample is kept.
+	Retention time.Duration
+	// MaxSamples bounds the samples kept across all series.
+	MaxSamples int
+}
+
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+type seriesKey struct {
+	kind string
+	name string
+}
+
+// series holds the samples of one metric, oldest first, from head on.
+type series struct {
+	key     seriesKey
+	samples []Sample
+	head    int
+}
+
+func (s *series) len() int {
+	return len(s.samples) - s.head
+}
+
+func (s *series) popOldest() {
+	s.samples[s.head] = Sample{}
+	s.head++
+	// Compact once the dropped prefix dominates, which keeps pops O(1)
+	// amortized and the backing array bounded.
+	if s.head > 32 && s.head*2 >= len(s.samples) {
+		n := copy(s.samples, s.samples[s.head:])
+		s.samples = s.samples[:n]
+		s.head = 0
+	}
+}
+
+type Store struct {
+	mu        sync.Mutex
+	retention time.Duration
+	series    map[seriesKey]*series
+	// order lists the series of every kept sample in the order the samples
+	// were added; it is a ring of MaxSamples slots.
+	order []*series
+	first int
+	count int
+
+	now func() time.Time
+}
+
+func New(options Options) *Store {
+	if options.MaxSamples <= 0 {
+		options.MaxSamples = DefaultMaxSamples
+	}
+	return &Store{
+		retention: options.Retention,
+		series:    make(map[seriesKey]*series),
+		order:     make([]*series, options.MaxSamples),
+		now:       time.Now,
+	}
+}
+
+// Add records the current value of a metric; kind is "gauge" or "counter".
+func (s *Store) Add(kind, name string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.expire(now)
+	if s.count == len(s.order) {
+		s.dropOldest()
+	}
+
+	key := seriesKey{kind: kind, name: name}
+	ser, ok := s.series[key]
+	if !ok {
+		ser = &series{key: key}
+		s.series[key] = ser
+	}
+	ser.samples = append(ser.samples, Sample{Time: now, Value: value})
+	s.order[(s.first+s.count)%len(s.order)] = ser
+	s.count++
+}
+
+// Query returns the samples of a metric taken within [start, end], oldest
+// first, and whether the metric has any samples at all.
+func (s *Store) Query(kind, name string, start, end time.Time) ([]Sample, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(s.now())
+	ser, ok := s.series[seriesKey{kind: kind, name: name}]
+	if !ok {
+		return nil, false
+	}
+	samples := ser.samples[ser.head:]
+	from := sort.Search(len(samples), func(i int) bool { return !samples[i].Time.Before(start) })
+	to := sort.Search(len(samples), func(i int) bool { return samples[i].Time.After(end) })
+	if from >= to {
+		return []Sample{}, true
+	}
+	return append([]Sample(nil), samples[from:to]...), true
+}
+
+// Len returns the number of samples kept across all series.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// expire drops the samples older than the retention. Samples are added in
+// time order, so they are all at the front of the ring.
+func (s *Store) expire(now time.Time) {
+	if s.retention <= 0 {
+		return
+	}
+	cutoff := now.Add(-s.retention)
+	for s.count > 0 {
+		ser := s.order[s.first]
+		if !ser.samples[ser.head].Time.Before(cutoff) {
+			return
+		}
+		s.dropOldest()
+	}
+}
+
+func (s *Store) dropOldest() {
+	ser := s.order[s.first]
+	s.order[s.first] = nil
+	s.first = (s.first + 1) % len(s.order)
+	s.count--
+	ser.popOldest()
+	if ser.len() == 0 {
+		delete(s.series, ser.key)
+	}
+}
+
+// Resample returns one sample per step from start to end, each holding the
+// latest of samples at or before its time. Steps before the first sample
+// are left out.
+func Resample(samples []Sample, start, end time.Time, step time.Duration) []Sample {
+	var result []Sample
+	i := 0
+	for t := start; !t.After(end); t = t.Add(step) {
+		for i < len(samples) && !samples[i].Time.After(t) {
+			i++
+		}
+		if i == 0 {
+			continue
+		}
+		result = append(result, Sample{Time: t, Value: samples[i-1].Value})
+	}
+	return result
+}
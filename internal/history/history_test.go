@@ -0,0 +1,133 @@
+package history
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestStore returns a store whose clock is moved by advance.
+func newTestStore(options Options) (*Store, func(time.Duration)) {
+	now := epoch
+	s := New(options)
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func at(seconds int) time.Time {
+	return epoch.Add(time.Duration(seconds) * time.Second)
+}
+
+func TestQuery(t *testing.T) {
+	s, advance := newTestStore(Options{Retention: time.Hour})
+	for i := 0; i < 5; i++ {
+		s.Add("gauge", "Alloc", float64(i))
+		s.Add("counter", "Alloc", float64(10*i))
+		advance(time.Second)
+	}
+
+	samples, ok := s.Query("gauge", "Alloc", at(1), at(3))
+	require.True(t, ok)
+	assert.Equal(t, []Sample{{at(1), 1}, {at(2), 2}, {at(3), 3}}, samples, "both ends are inclusive")
+
+	samples, ok = s.Query("counter", "Alloc", at(4), at(100))
+	require.True(t, ok)
+	assert.Equal(t, []Sample{{at(4), 40}}, samples, "types are separate series")
+
+	samples, ok = s.Query("gauge", "Alloc", at(10), at(20))
+	assert.True(t, ok)
+	assert.Empty(t, samples)
+
+	_, ok = s.Query("gauge", "Missing", at(0), at(10))
+	assert.False(t, ok)
+}
+
+func TestRetention(t *testing.T) {
+	s, advance := newTestStore(Options{Retention: 10 * time.Second})
+	for i := 0; i < 20; i++ {
+		s.Add("gauge", "Alloc", float64(i))
+		advance(time.Second)
+	}
+	samples, ok := s.Query("gauge", "Alloc", time.Time{}, at(100))
+	require.True(t, ok)
+	require.Len(t, samples, 10)
+	assert.Equal(t, at(10), samples[0].Time, "samples older than the retention are dropped")
+	assert.Equal(t, 10, s.Len())
+
+	advance(time.Minute)
+	_, ok = s.Query("gauge", "Alloc", time.Time{}, at(100))
+	assert.False(t, ok, "a series without samples is forgotten")
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestSampleBudget(t *testing.T) {
+	s, advance := newTestStore(Options{Retention: time.Hour, MaxSamples: 100})
+	for i := 0; i < 1000; i++ {
+		s.Add("gauge", fmt.Sprintf("metric%d", i%7), float64(i))
+		advance(time.Millisecond)
+		require.LessOrEqual(t, s.Len(), 100)
+	}
+	assert.Equal(t, 100, s.Len())
+
+	// The budget drops the oldest samples first, whatever their series.
+	var total int
+	for m := 0; m < 7; m++ {
+		samples, ok := s.Query("gauge", fmt.Sprintf("metric%d", m), time.Time{}, at(100))
+		require.True(t, ok)
+		total += len(samples)
+		for _, sample := range samples {
+			assert.GreaterOrEqual(t, sample.Value, float64(900))
+		}
+	}
+	assert.Equal(t, 100, total)
+
+	s.Add("gauge", "new", 1)
+	samples, ok := s.Query("gauge", "new", time.Time{}, at(100))
+	require.True(t, ok)
+	assert.Len(t, samples, 1, "a new series gets room at the expense of old ones")
+	assert.Equal(t, 100, s.Len())
+}
+
+func TestResample(t *testing.T) {
+	samples := []Sample{{at(5), 1}, {at(12), 2}, {at(13), 3}, {at(31), 4}}
+	tests := []struct {
+		name  string
+		start time.Time
+		end   time.Time
+		step  time.Duration
+		want  []Sample
+	}{
+		{
+			name:  "Latest sample per step",
+			start: at(10),
+			end:   at(40),
+			step:  10 * time.Second,
+			want:  []Sample{{at(10), 1}, {at(20), 3}, {at(30), 3}, {at(40), 4}},
+		},
+		{
+			name:  "Steps before the first sample are left out",
+			start: at(0),
+			end:   at(10),
+			step:  5 * time.Second,
+			want:  []Sample{{at(5), 1}, {at(10), 1}},
+		},
+		{
+			name:  "Single point",
+			start: at(31),
+			end:   at(31),
+			step:  time.Second,
+			want:  []Sample{{at(31), 4}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Resample(samples, tt.start, tt.end, tt.step))
+		})
+	}
+	assert.Empty(t, Resample(nil, at(0), at(10), time.Second))
+}
@@ -0,0 +1,200 @@
+package hoststats
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultProcRoot is the procfs mount point on a regular Linux host.
+const DefaultProcRoot = "/proc"
+
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+// Collector reads host-wide statistics from a procfs tree. CPU utilization
+// is computed from the difference between two consecutive reads, so the
+// Collector keeps the previous per-core counters between calls.
+type Collector struct {
+	root string
+
+	mu      sync.Mutex
+	prevCPU map[string]cpuTimes
+}
+
+func NewCollector(root string) *Collector {
+	return &Collector{
+		root:    root,
+		prevCPU: make(map[string]cpuTimes),
+	}
+}
+
+// Collect returns the host gauges keyed by metric name: CPUutilization1..N
+// (percent per core), TotalMemory, FreeMemory and AvailableMemory (bytes),
+// LoadAverage1/5/15 and Uptime (seconds).
+func (c *Collector) Collect() (map[string]float64, error) {
+	result := make(map[string]float64)
+
+	if err := c.collectCPU(result); err != nil {
+		return nil, err
+	}
+	if err := c.collectMemory(result); err != nil {
+		return nil, err
+	}
+	if err := c.collectLoad(result); err != nil {
+		return nil, err
+	}
+	if err := c.collectUptime(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Collector) collectCPU(result map[string]float64) error {
+	file, err := os.Open(filepath.Join(c.root, "stat"))
+	if err != nil {
+		return fmt.Errorf("failed to open stat: %w", err)
+	}
+	defer file.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The aggregated "cpu" line is skipped, only "cpuN" lines are per core.
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			continue
+		}
+		core, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+		if err != nil {
+			return fmt.Errorf("failed to parse cpu line %q: %w", fields[0], err)
+		}
+		times, err := parseCPUTimes(fields[1:])
+		if err != nil {
+			return fmt.Errorf("failed to parse %s times: %w", fields[0], err)
+		}
+
+		prev := c.prevCPU[fields[0]]
+		c.prevCPU[fields[0]] = times
+		result[fmt.Sprintf("CPUutilization%d", core+1)] = utilization(prev, times)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read stat: %w", err)
+	}
+	return nil
+}
+
+// parseCPUTimes sums the jiffies of a cpu line. Guest time is already
+// accounted in user and nice, so only the first eight columns are used.
+func parseCPUTimes(fields []string) (cpuTimes, error) {
+	var times cpuTimes
+	for i, field := range fields {
+		if i >= 8 {
+			break
+		}
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return cpuTimes{}, err
+		}
+		// idle and iowait columns
+		if i == 3 || i == 4 {
+			times.idle += value
+		}
+		times.total += value
+	}
+	return times, nil
+}
+
+func utilization(prev, cur cpuTimes) float64 {
+	if cur.total < prev.total || cur.idle < prev.idle {
+		// Counters went backwards (e.g. CPU hotplug), start over from zero.
+		prev = cpuTimes{}
+	}
+	total := cur.total - prev.total
+	if total == 0 {
+		return 0
+	}
+	idle := cur.idle - prev.idle
+	return 100 * float64(total-idle) / float64(total)
+}
+
+func (c *Collector) collectMemory(result map[string]float64) error {
+	file, err := os.Open(filepath.Join(c.root, "meminfo"))
+	if err != nil {
+		return fmt.Errorf("failed to open meminfo: %w", err)
+	}
+	defer file.Close()
+
+	names := map[string]string{
+		"MemTotal":     "TotalMemory",
+		"MemFree":      "FreeMemory",
+		"MemAvailable": "AvailableMemory",
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		name, ok := names[strings.TrimSuffix(fields[0], ":")]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse meminfo %s: %w", fields[0], err)
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		result[name] = float64(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read meminfo: %w", err)
+	}
+	return nil
+}
+
+func (c *Collector) collectLoad(result map[string]float64) error {
+	data, err := os.ReadFile(filepath.Join(c.root, "loadavg"))
+	if err != nil {
+		return fmt.Errorf("failed to read loadavg: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("unexpected loadavg format: %q", data)
+	}
+	for i, name := range []string{"LoadAverage1", "LoadAverage5", "LoadAverage15"} {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		result[name] = value
+	}
+	return nil
+}
+
+func (c *Collector) collectUptime(result map[string]float64) error {
+	data, err := os.ReadFile(filepath.Join(c.root, "uptime"))
+	if err != nil {
+		return fmt.Errorf("failed to read uptime: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 1 {
+		return fmt.Errorf("unexpected uptime format: %q", data)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse uptime: %w", err)
+	}
+	result["Uptime"] = value
+	return nil
+}
@@ -0,0 +1,84 @@
+package hoststats
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func copyFixture(t *testing.T, src string) string {
+	dir := t.TempDir()
+	entries, err := os.ReadDir(src)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, entry.Name()), data, 0644))
+	}
+	return dir
+}
+
+func TestCollect(t *testing.T) {
+	c := NewCollector("testdata/proc")
+	result, err := c.Collect()
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]float64{
+		"CPUutilization1": 35,
+		"CPUutilization2": 15,
+		"TotalMemory":     8000000 * 1024,
+		"FreeMemory":      2000000 * 1024,
+		"AvailableMemory": 5000000 * 1024,
+		"LoadAverage1":    0.32,
+		"LoadAverage5":    0.34,
+		"LoadAverage15":   0.16,
+		"Uptime":          723.79,
+	}, result)
+}
+
+func TestCollectCPUDelta(t *testing.T) {
+	root := copyFixture(t, "testdata/proc")
+	c := NewCollector(root)
+	_, err := c.Collect()
+	require.NoError(t, err)
+
+	stat := "cpu  5000 0 1000 13250 2000 0 0 0 0 0\n" +
+		"cpu0 3750 0 500 5250 1500 0 0 0 0 0\n" +
+		"cpu1 1000 0 500 8000 500 0 0 0 0 0\n"
+	require.NoError(t, os.WriteFile(filepath.Join(root, "stat"), []byte(stat), 0644))
+
+	result, err := c.Collect()
+	require.NoError(t, err)
+	assert.Equal(t, float64(75), result["CPUutilization1"])
+	assert.Equal(t, float64(0), result["CPUutilization2"])
+}
+
+func TestCollectErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		value string
+	}{
+		{name: "Missing stat", file: "stat"},
+		{name: "Broken stat", file: "stat", value: "cpu0 a b c d e\n"},
+		{name: "Broken meminfo", file: "meminfo", value: "MemTotal: lots kB\n"},
+		{name: "Short loadavg", file: "loadavg", value: "0.1\n"},
+		{name: "Broken uptime", file: "uptime", value: "soon 1.0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := copyFixture(t, "testdata/proc")
+			path := filepath.Join(root, tt.file)
+			if tt.value == "" {
+				require.NoError(t, os.Remove(path))
+			} else {
+				require.NoError(t, os.WriteFile(path, []byte(tt.value), 0644))
+			}
+			_, err := NewCollector(root).Collect()
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// Package httpheader parses the HTTP headers used for content negotiation.
+package httpheader
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Accepted is one entry of an Accept or Accept-Encoding header.
+type Accepted struct {
+	// Value is the lower-cased media type or coding without parameters.
+	Value string
+	Q     float64
+}
+
+// ParseAccept lists the entries of an Accept or Accept-Encoding header in
+// order. The q-value defaults to 1; invalid ones are ignored.
+func ParseAccept(header string) []Accepted {
+	var result []Accepted
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		value, params, _ := strings.Cut(part, ";")
+		accepted := Accepted{Value: strings.ToLower(strings.TrimSpace(value)), Q: 1}
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && parsed >= 0 && parsed <= 1 {
+				accepted.Q = parsed
+			}
+		}
+		result = append(result, accepted)
+	}
+	return result
+}
@@ -0,0 +1,17 @@
+package httpheader
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccept(t *testing.T) {
+	assert.Empty(t, ParseAccept(""))
+	assert.Equal(t, []Accepted{
+		{Value: "application/openmetrics-text", Q: 1},
+		{Value: "text/plain", Q: 0.5},
+		{Value: "*/*", Q: 1},
+		{Value: "gzip", Q: 0},
+	}, ParseAccept("Application/OpenMetrics-Text;version=1.0.0, text/plain;version=0.0.4;q=0.5, */*;q=2, ,gzip ; q=0"))
+}
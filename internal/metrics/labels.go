@@ -0,0 +1,263 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels tell apart series of one metric, e.g. the same gauge reported by
+// several hosts.
+type Labels map[string]string
+
+// String renders labels sorted by name as {name="value",...}, with values
+// escaped like in the Prometheus text format. Empty labels render as "".
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(valueEscaper.Replace(l[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var valueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ValidateLabels checks that label names are valid Prometheus label names,
+// not reserved, and that no value is empty.
+func ValidateLabels(labels Labels) error {
+	for name, value := range labels {
+		if !validLabelName(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if value == "" {
+			return fmt.Errorf("empty value for label %q", name)
+		}
+	}
+	return nil
+}
+
+func validLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// Key returns the series key the metric is stored under.
+func (m Metrics) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// SeriesKey returns the canonical key of a series: the ID alone when there
+// are no labels, so unlabeled metrics keep their plain ID, and the ID
+// followed by the rendered labels otherwise. Braces and backslashes in the ID
+// are escaped with a backslash, so that an ID such as foo{bar can't be taken
+// for a labeled key.
+func SeriesKey(id string, labels Labels) string {
+	return idEscaper.Replace(id) + labels.String()
+}
+
+var idEscaper = strings.NewReplacer(`\`, `\\`, `{`, `\{`, `}`, `\}`)
+
+// DisplayKey returns a series key as shown to users: the ID unescaped,
+// followed by the labels.
+func DisplayKey(key string) string {
+	id, labels := ParseSeriesKey(key)
+	return id + labels.String()
+}
+
+// ParseSeriesKey splits a key made by SeriesKey into the ID and labels.
+// A key that does not end in a valid label set is a plain ID.
+func ParseSeriesKey(key string) (string, Labels) {
+	start := labelsStart(key)
+	if start <= 0 || !strings.HasSuffix(key, "}") {
+		return unescapeID(key), nil
+	}
+	labels, err := ParseLabels(key[start:])
+	if err != nil || len(labels) == 0 {
+		return unescapeID(key), nil
+	}
+	return unescapeID(key[:start]), labels
+}
+
+// labelsStart returns the index of the first unescaped brace of key, or -1.
+func labelsStart(key string) int {
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			i++
+		case '{':
+			return i
+		}
+	}
+	return -1
+}
+
+// unescapeID reverts the escaping of SeriesKey. Backslashes that don't
+// escape anything are kept.
+func unescapeID(id string) string {
+	if !strings.Contains(id, `\`) {
+		return id
+	}
+	var b strings.Builder
+	b.Grow(len(id))
+	for i := 0; i < len(id); i++ {
+		if id[i] == '\\' && i+1 < len(id) && strings.IndexByte(`\{}`, id[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(id[i])
+	}
+	return b.String()
+}
+
+// ParseLabels reads labels written as {name="value",...}.
+func ParseLabels(value string) (Labels, error) {
+	matchers, err := parseMatchers(value)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(Labels, len(matchers))
+	for _, m := range matchers {
+		if m.Negate {
+			return nil, fmt.Errorf("unexpected != for label %q", m.Name)
+		}
+		if _, ok := labels[m.Name]; ok {
+			return nil, fmt.Errorf("duplicate label %q", m.Name)
+		}
+		labels[m.Name] = m.Value
+	}
+	if err := ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// Matcher compares one label with a value. A missing label has the value "".
+type Matcher struct {
+	Name   string
+	Value  string
+	Negate bool
+}
+
+// Selector picks series whose labels satisfy all its matchers.
+type Selector []Matcher
+
+// ParseSelector reads a selector written as {name="value",name!="value"}.
+// An empty string selects every series.
+func ParseSelector(value string) (Selector, error) {
+	matchers, err := parseMatchers(value)
+	return Selector(matchers), err
+}
+
+func (s Selector) Matches(labels Labels) bool {
+	for _, m := range s {
+		if (labels[m.Name] == m.Value) == m.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+func parseMatchers(value string) ([]Matcher, error) {
+	s := strings.TrimSpace(value)
+	if strings.HasPrefix(s, "{") {
+		if !strings.HasSuffix(s, "}") {
+			return nil, errors.New("unterminated label set")
+		}
+		s = s[1 : len(s)-1]
+	}
+	var result []Matcher
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return result, nil
+		}
+		end := strings.IndexAny(s, "!= ")
+		if end < 0 {
+			return nil, fmt.Errorf("missing value for label %q", s)
+		}
+		m := Matcher{Name: s[:end]}
+		if !validLabelName(m.Name) {
+			return nil, fmt.Errorf("invalid label name %q", m.Name)
+		}
+		s = strings.TrimLeft(s[end:], " ")
+		switch {
+		case strings.HasPrefix(s, "!="):
+			m.Negate = true
+			s = s[2:]
+		case strings.HasPrefix(s, "="):
+			s = s[1:]
+		default:
+			return nil, fmt.Errorf("missing operator for label %q", m.Name)
+		}
+		var err error
+		m.Value, s, err = unquote(strings.TrimLeft(s, " "))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %q: %w", m.Name, err)
+		}
+		result = append(result, m)
+
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return result, nil
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("unexpected %q after label %q", s[0], m.Name)
+		}
+		s = s[1:]
+	}
+}
+
+// unquote reads a double quoted value at the start of s and returns it with
+// the rest of s.
+func unquote(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", errors.New("value must be quoted")
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", errors.New("unterminated escape")
+			}
+			switch s[i] {
+			case '\\', '"':
+				b.WriteByte(s[i])
+			case 'n':
+				b.WriteByte('\n')
+			default:
+				return "", "", fmt.Errorf("unknown escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", errors.New("unterminated value")
+}
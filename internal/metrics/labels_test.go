@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		labels Labels
+		key    string
+	}{
+		{name: "Unlabeled", id: "Alloc", key: "Alloc"},
+		{name: "Empty labels", id: "Alloc", labels: Labels{}, key: "Alloc"},
+		{name: "Sorted labels", id: "Alloc", labels: Labels{"host": "a", "env": "prod"}, key: `Alloc{env="prod",host="a"}`},
+		{name: "Escaped value", id: "Alloc", labels: Labels{"path": "C:\\\"x\"\n"}, key: `Alloc{path="C:\\\"x\"\n"}`},
+		{name: "Unlabeled ID with brace", id: "foo{bar", key: `foo\{bar`},
+		{name: "Unlabeled ID like a labeled key", id: `foo{host="a"}`, key: `foo\{host="a"\}`},
+		{name: "Unlabeled ID with backslash", id: `C:\x\`, key: `C:\\x\\`},
+		{name: "Labeled ID with braces", id: `a{b}\`, labels: Labels{"host": "a"}, key: `a\{b\}\\{host="a"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := SeriesKey(tt.id, tt.labels)
+			assert.Equal(t, tt.key, key)
+
+			id, labels := ParseSeriesKey(key)
+			assert.Equal(t, tt.id, id)
+			if len(tt.labels) == 0 {
+				assert.Empty(t, labels)
+			} else {
+				assert.Equal(t, tt.labels, labels)
+			}
+		})
+	}
+}
+
+func TestParseSeriesKeyPlainIDs(t *testing.T) {
+	for _, key := range []string{"Alloc", "{}", "a{b}", `a{b="c"`, `a{b!="c"}`, `a{1="c"}`, `"quoted"\n`} {
+		id, labels := ParseSeriesKey(key)
+		assert.Equal(t, key, id, key)
+		assert.Nil(t, labels, key)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels(` { host = "a" , env="prod" } `)
+	require.NoError(t, err)
+	assert.Equal(t, Labels{"host": "a", "env": "prod"}, labels)
+
+	labels, err = ParseLabels("")
+	require.NoError(t, err)
+	assert.Empty(t, labels)
+
+	for _, value := range []string{
+		`{host="a"`,
+		`{host=a}`,
+		`{host="a",host="b"}`,
+		`{host!="a"}`,
+		`{__name__="a"}`,
+		`{host=""}`,
+		`{host="a" env="b"}`,
+		`{host="\x"}`,
+	} {
+		_, err := ParseLabels(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestSelector(t *testing.T) {
+	selector, err := ParseSelector(`{host="a",env!="dev"}`)
+	require.NoError(t, err)
+	assert.True(t, selector.Matches(Labels{"host": "a", "env": "prod"}))
+	assert.True(t, selector.Matches(Labels{"host": "a"}), "a missing label is empty")
+	assert.False(t, selector.Matches(Labels{"host": "a", "env": "dev"}))
+	assert.False(t, selector.Matches(Labels{"host": "b"}))
+	assert.False(t, selector.Matches(nil))
+
+	selector, err = ParseSelector("")
+	require.NoError(t, err)
+	assert.True(t, selector.Matches(nil), "an empty selector matches everything")
+
+	selector, err = ParseSelector(`{host=""}`)
+	require.NoError(t, err)
+	assert.True(t, selector.Matches(nil), "an empty value selects unlabeled series")
+	assert.False(t, selector.Matches(Labels{"host": "a"}))
+
+	_, err = ParseSelector(`{host~"a"}`)
+	assert.Error(t, err)
+}
+
+func TestValidateLabels(t *testing.T) {
+	assert.NoError(t, ValidateLabels(nil))
+	assert.NoError(t, ValidateLabels(Labels{"host_1": "a", "_env": "b"}))
+	assert.Error(t, ValidateLabels(Labels{"1host": "a"}))
+	assert.Error(t, ValidateLabels(Labels{"ho-st": "a"}))
+	assert.Error(t, ValidateLabels(Labels{"__name__": "a"}))
+	assert.Error(t, ValidateLabels(Labels{"host": ""}))
+}
@@ -5,4 +5,10 @@ type Metrics struct {
 	MType string   `json:"type"`
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
+	// Labels are optional; metrics without them behave as before labels
+	// existed.
+	Labels Labels `json:"labels,omitempty"`
 }
+
+//easyjson:json
+type MetricsList []Metrics
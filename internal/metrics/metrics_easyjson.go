@@ -17,7 +17,73 @@ var (
 	_ easyjson.Marshaler
 )
 
-func easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics(in *jlexer.Lexer, out *Metrics) {
+func easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics(in *jlexer.Lexer, out *MetricsList) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		in.Skip()
+		*out = nil
+	} else {
+		in.Delim('[')
+		if *out == nil {
+			if !in.IsDelim(']') {
+				*out = make(MetricsList, 0, 1)
+			} else {
+				*out = MetricsList{}
+			}
+		} else {
+			*out = (*out)[:0]
+		}
+		for !in.IsDelim(']') {
+			var v1 Metrics
+			(v1).UnmarshalEasyJSON(in)
+			*out = append(*out, v1)
+			in.WantComma()
+		}
+		in.Delim(']')
+	}
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics(out *jwriter.Writer, in MetricsList) {
+	if in == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v2, v3 := range in {
+			if v2 > 0 {
+				out.RawByte(',')
+			}
+			(v3).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v MetricsList) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v MetricsList) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *MetricsList) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *MetricsList) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics(l, v)
+}
+func easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics1(in *jlexer.Lexer, out *Metrics) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
 		if isTopLevel {
@@ -60,6 +126,26 @@ func easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics(in
 				}
 				*out.Value = float64(in.Float64())
 			}
+		case "labels":
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				in.Delim('{')
+				if !in.IsDelim('}') {
+					out.Labels = make(Labels)
+				} else {
+					out.Labels = nil
+				}
+				for !in.IsDelim('}') {
+					key := string(in.String())
+					in.WantColon()
+					var v4 string
+					v4 = string(in.String())
+					(out.Labels)[key] = v4
+					in.WantComma()
+				}
+				in.Delim('}')
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -70,7 +156,7 @@ func easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics(in
 		in.Consumed()
 	}
 }
-func easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics(out *jwriter.Writer, in Metrics) {
+func easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics1(out *jwriter.Writer, in Metrics) {
 	out.RawByte('{')
 	first := true
 	_ = first
@@ -94,29 +180,48 @@ func easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics(ou
 		out.RawString(prefix)
 		out.Float64(float64(*in.Value))
 	}
+	if len(in.Labels) != 0 {
+		const prefix string = ",\"labels\":"
+		out.RawString(prefix)
+		{
+			out.RawByte('{')
+			v5First := true
+			for v5Name, v5Value := range in.Labels {
+				if v5First {
+					v5First = false
+				} else {
+					out.RawByte(',')
+				}
+				out.String(string(v5Name))
+				out.RawByte(':')
+				out.String(string(v5Value))
+			}
+			out.RawByte('}')
+		}
+	}
 	out.RawByte('}')
 }
 
 // MarshalJSON supports json.Marshaler interface
 func (v Metrics) MarshalJSON() ([]byte, error) {
 	w := jwriter.Writer{}
-	easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics(&w, v)
+	easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics1(&w, v)
 	return w.Buffer.BuildBytes(), w.Error
 }
 
 // MarshalEasyJSON supports easyjson.Marshaler interface
 func (v Metrics) MarshalEasyJSON(w *jwriter.Writer) {
-	easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics(w, v)
+	easyjson2220f231EncodeGithubComPersonageHubMetricsTrackerInternalMetrics1(w, v)
 }
 
 // UnmarshalJSON supports json.Unmarshaler interface
 func (v *Metrics) UnmarshalJSON(data []byte) error {
 	r := jlexer.Lexer{Data: data}
-	easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics(&r, v)
+	easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics1(&r, v)
 	return r.Error()
 }
 
 // UnmarshalEasyJSON supports easyjson.Unmarshaler interface
 func (v *Metrics) UnmarshalEasyJSON(l *jlexer.Lexer) {
-	easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics(l, v)
+	easyjson2220f231DecodeGithubComPersonageHubMetricsTrackerInternalMetrics1(l, v)
 }
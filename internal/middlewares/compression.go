@@ -0,0 +1,120 @@
+package middlewares
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/personage-hub/metrics-tracker/internal/compression"
+)
+
+// responseEncodings are offered to clients in order of preference.
+var responseEncodings = []string{compression.Gzip, compression.Zstd, compression.Deflate}
+
+// compressWriter starts the encoder on the first WriteHeader or Write, so
+// handlers that write nothing don't get a Content-Encoding header.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	encoder  io.WriteCloser
+	err      error
+}
+
+func (w *compressWriter) start() {
+	if w.encoder != nil || w.err != nil {
+		return
+	}
+	w.Header().Set("Content-Encoding", w.encoding)
+	w.Header().Del("Content-Length")
+	w.encoder, w.err = compression.NewWriter(w.encoding, w.ResponseWriter, compression.DefaultLevel)
+}
+
+func (w *compressWriter) WriteHeader(statusCode int) {
+	w.start()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	w.start()
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.encoder.Write(b)
+}
+
+func (w *compressWriter) Close() error {
+	if w.encoder == nil {
+		return nil
+	}
+	return w.encoder.Close()
+}
+
+// MaxRequestBody bounds request bodies both as sent and once decoded, so a
+// small compressed payload cannot inflate into an unbounded one.
+const MaxRequestBody = 10 << 20
+
+// tooLarge reports whether err comes from a body over MaxRequestBody.
+func tooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// decodeBody reads the whole body of r decoded with encoding. It fails with
+// an *http.MaxBytesError when the decoded body exceeds MaxRequestBody.
+func decodeBody(encoding string, r *http.Request) ([]byte, error) {
+	reader, err := compression.NewReader(encoding, r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	body, err := io.ReadAll(io.LimitReader(reader, MaxRequestBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxRequestBody {
+		return nil, &http.MaxBytesError{Limit: MaxRequestBody}
+	}
+	return body, nil
+}
+
+// CompressionHandler decodes gzip, deflate and zstd request bodies and
+// compresses responses with the best encoding the client accepts. Bodies
+// over MaxRequestBody, as sent or decoded, are answered with 413.
+func CompressionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxRequestBody)
+		if encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding != "" {
+			if !compression.Supported(encoding) {
+				w.Header().Set("Accept-Encoding", strings.Join(responseEncodings, ", "))
+				http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+			body, err := decodeBody(encoding, r)
+			if tooLarge(err) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "invalid compressed body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := compression.Negotiate(r.Header.Get("Accept-Encoding"), responseEncodings)
+		if encoding == compression.Identity || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,153 @@
+package middlewares
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/personage-hub/metrics-tracker/internal/compression"
+	"github.com/personage-hub/metrics-tracker/internal/signature"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionHandlerDecodesRequests(t *testing.T) {
+	body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(data)
+	})
+
+	tests := []struct {
+		name       string
+		encoding   string
+		payload    []byte
+		statusCode int
+	}{
+		{name: "Plain body", payload: body, statusCode: http.StatusOK},
+		{name: "Gzip body", encoding: compression.Gzip, statusCode: http.StatusOK},
+		{name: "Deflate body", encoding: compression.Deflate, statusCode: http.StatusOK},
+		{name: "Zstd body", encoding: compression.Zstd, statusCode: http.StatusOK},
+		{name: "Unsupported encoding", encoding: "br", payload: body, statusCode: http.StatusUnsupportedMediaType},
+		{name: "Corrupted body", encoding: compression.Gzip, payload: body, statusCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := tt.payload
+			if payload == nil {
+				var err error
+				payload, err = compression.Compress(tt.encoding, compression.DefaultLevel, body)
+				require.NoError(t, err)
+			}
+			request := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(payload))
+			request.Header.Set("Content-Encoding", tt.encoding)
+			response := httptest.NewRecorder()
+
+			CompressionHandler(echo).ServeHTTP(response, request)
+			result := response.Result()
+			defer result.Body.Close()
+			require.Equal(t, tt.statusCode, result.StatusCode)
+			if tt.statusCode == http.StatusOK {
+				data, err := io.ReadAll(result.Body)
+				require.NoError(t, err)
+				assert.Equal(t, body, data)
+			}
+		})
+	}
+}
+
+func TestCompressionHandlerLimitsBodies(t *testing.T) {
+	keys, err := signature.ParseKeyRing("secret")
+	require.NoError(t, err)
+	handler := CompressionHandler(HashHandler(keys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("an oversized body reached the handler")
+	})))
+	// Zeros compress to a tiny fraction of their size.
+	inflated := make([]byte, MaxRequestBody+1)
+
+	for _, encoding := range []string{compression.Gzip, compression.Deflate, compression.Zstd, ""} {
+		t.Run("Encoding "+encoding, func(t *testing.T) {
+			payload := inflated
+			if encoding != "" {
+				payload, err = compression.Compress(encoding, compression.DefaultLevel, inflated)
+				require.NoError(t, err)
+				require.Less(t, len(payload), MaxRequestBody/100)
+			}
+			request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(payload))
+			request.Header.Set("Content-Encoding", encoding)
+			response := httptest.NewRecorder()
+
+			handler.ServeHTTP(response, request)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+		})
+	}
+}
+
+func TestCompressionHandlerEncodesResponses(t *testing.T) {
+	body := bytes.Repeat([]byte("Gauge list: Alloc, HeapAlloc\n"), 10)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		handler        http.HandlerFunc
+		wantEncoding   string
+	}{
+		{
+			name:           "Gzip preferred on a tie",
+			acceptEncoding: "zstd, gzip",
+			wantEncoding:   compression.Gzip,
+		},
+		{
+			name:           "Highest q-value wins",
+			acceptEncoding: "gzip;q=0.2, zstd;q=0.9",
+			wantEncoding:   compression.Zstd,
+		},
+		{
+			name:           "Excluded encodings are skipped",
+			acceptEncoding: "gzip;q=0, deflate",
+			wantEncoding:   compression.Deflate,
+		},
+		{
+			name: "No Accept-Encoding",
+		},
+		{
+			name:           "Empty response is not encoded",
+			acceptEncoding: "gzip",
+			handler:        func(w http.ResponseWriter, r *http.Request) {},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := tt.handler
+			if handler == nil {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+					w.Write(body)
+				}
+			}
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			response := httptest.NewRecorder()
+
+			CompressionHandler(handler).ServeHTTP(response, request)
+			result := response.Result()
+			defer result.Body.Close()
+			assert.Equal(t, "Accept-Encoding", result.Header.Get("Vary"))
+			assert.Equal(t, tt.wantEncoding, result.Header.Get("Content-Encoding"))
+			if tt.handler != nil {
+				return
+			}
+
+			reader, err := compression.NewReader(tt.wantEncoding, result.Body)
+			require.NoError(t, err)
+			data, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, body, data)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package middlewares
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/personage-hub/metrics-tracker/internal/signature"
+)
+
+type signingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signingWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *signingWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+// HashHandler rejects requests whose body is not signed with one of the keys
+// and signs every response body with the active key. Requests that may change
+// state must be signed even when their body is empty, since the URL alone can
+// carry an update. It has to run inside the compression middleware so that
+// plain bodies are signed and verified.
+func HashHandler(keys *signature.KeyRing) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			if tooLarge(err) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "failed to read request body", http.StatusBadRequest)
+				return
+			}
+			if len(body) > 0 || !safeMethod(r.Method) {
+				sum := r.Header.Get(signature.HeaderHash)
+				if sum == "" {
+					http.Error(w, "missing request signature", http.StatusBadRequest)
+					return
+				}
+				if err := keys.Verify(body, r.Header.Get(signature.HeaderKeyID), sum); err != nil {
+					http.Error(w, "invalid request signature", http.StatusBadRequest)
+					return
+				}
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			sw := &signingWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+
+			id, sum := keys.Sign(sw.body.Bytes())
+			w.Header().Set(signature.HeaderHash, sum)
+			if id != "" {
+				w.Header().Set(signature.HeaderKeyID, id)
+			}
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			w.WriteHeader(sw.status)
+			_, _ = w.Write(sw.body.Bytes())
+		})
+	}
+}
+
+// safeMethod reports whether requests with method only read state.
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
@@ -0,0 +1,101 @@
+package middlewares
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/personage-hub/metrics-tracker/internal/signature"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashHandler(t *testing.T) {
+	keys, err := signature.ParseKeyRing("new:secret2,old:secret1")
+	require.NoError(t, err)
+	body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(data)
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		body       []byte
+		keyID      string
+		hash       string
+		statusCode int
+	}{
+		{
+			name:       "Signed with active key",
+			body:       body,
+			keyID:      "new",
+			hash:       signature.Sum([]byte("secret2"), body),
+			statusCode: http.StatusAccepted,
+		},
+		{
+			name:       "Signed with rotated out key",
+			body:       body,
+			hash:       signature.Sum([]byte("secret1"), body),
+			statusCode: http.StatusAccepted,
+		},
+		{
+			name:       "Wrong key",
+			body:       body,
+			hash:       signature.Sum([]byte("other"), body),
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Missing signature",
+			body:       body,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Unsigned update without body",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Signed update without body",
+			hash:       signature.Sum([]byte("secret2"), nil),
+			statusCode: http.StatusAccepted,
+		},
+		{
+			name:       "Read without body",
+			method:     http.MethodGet,
+			statusCode: http.StatusAccepted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			request := httptest.NewRequest(method, "/update/", bytes.NewReader(tt.body))
+			if tt.hash != "" {
+				request.Header.Set(signature.HeaderHash, tt.hash)
+			}
+			if tt.keyID != "" {
+				request.Header.Set(signature.HeaderKeyID, tt.keyID)
+			}
+			response := httptest.NewRecorder()
+
+			HashHandler(keys)(echo).ServeHTTP(response, request)
+			result := response.Result()
+			defer result.Body.Close()
+			require.Equal(t, tt.statusCode, result.StatusCode)
+			if tt.statusCode != http.StatusAccepted {
+				return
+			}
+
+			data, err := io.ReadAll(result.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "new", result.Header.Get(signature.HeaderKeyID))
+			assert.NoError(t, keys.Verify(data, "new", result.Header.Get(signature.HeaderHash)))
+		})
+	}
+}
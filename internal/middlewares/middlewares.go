@@ -1,12 +1,8 @@
 package middlewares
 
 import (
-	"bytes"
-	"compress/gzip"
-	"io"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -47,9 +43,6 @@ func RequestWithLogging(log *zap.Logger) func(http.Handler) http.Handler {
 				status: 0,
 				size:   0,
 			}
-			requestBodyBytes, _ := io.ReadAll(r.Body)
-			r.Body = io.NopCloser(bytes.NewBuffer(requestBodyBytes))
-
 			logWriter := loggingResponseWriter{
 				ResponseWriter: w,
 				responseData:   responseData,
@@ -68,31 +61,3 @@ func RequestWithLogging(log *zap.Logger) func(http.Handler) http.Handler {
 		})
 	}
 }
-
-type gzipWriter struct {
-	http.ResponseWriter
-	Writer io.Writer
-}
-
-func (w gzipWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
-}
-
-func GzipHandler(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		if err != nil {
-			io.WriteString(w, err.Error())
-			return
-		}
-		defer gz.Close()
-
-		w.Header().Set("Content-Encoding", "gzip")
-		next.ServeHTTP(gzipWriter{ResponseWriter: w, Writer: gz}, r)
-	})
-}
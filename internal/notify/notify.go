@@ -0,0 +1,300 @@
+// Package notify posts alert state changes to webhook receivers.
+//
+// Alerts are grouped by rule: all alerts of a rule that fire or resolve in
+// one evaluation go out in a single payload. A group is sent again only when
+// its set of firing alerts changes or, while it keeps firing, once every
+// repeat interval. Every receiver has its own queue and retries failed
+// deliveries with exponential backoff, so a slow or broken receiver does not
+// hold up the others.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/alerting"
+	"github.com/personage-hub/metrics-tracker/internal/consts"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/retry"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultRepeatInterval = 4 * time.Hour
+	DefaultTimeout        = 5 * time.Second
+	// queueSize bounds the payloads waiting for one receiver; newer ones
+	// are dropped while it is full.
+	queueSize = 64
+)
+
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+type RetryPolicy = retry.Policy
+
+// DefaultRetryPolicy retries three times, waiting up to 30s in between.
+var DefaultRetryPolicy = RetryPolicy{MaxRetries: 3, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+type Receiver struct {
+	Name  string
+	URL   string
+	Retry RetryPolicy
+}
+
+type Options struct {
+	Receivers      []Receiver
+	RepeatInterval time.Duration
+	// Timeout bounds a single delivery attempt.
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+// Payload is the JSON body posted to receivers.
+type Payload struct {
+	Receiver string           `json:"receiver"`
+	Status   string           `json:"status"`
+	Group    string           `json:"group"`
+	Alerts   []alerting.Alert `json:"alerts"`
+}
+
+// groupState is what was last sent for a group.
+type groupState struct {
+	firing   map[string]bool
+	lastSent time.Time
+}
+
+type receiver struct {
+	Receiver
+	queue chan Payload
+}
+
+type Notifier struct {
+	mu      sync.Mutex
+	options Options
+	groups  map[string]*groupState
+
+	receivers []*receiver
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	// ctx is cancelled once Close gives up on the queued notifications; it
+	// aborts the delivery in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	logger *zap.Logger
+	now    func() time.Time
+}
+
+// New starts a delivery worker per receiver; Close stops them.
+func New(options Options, logger *zap.Logger) *Notifier {
+	if options.RepeatInterval <= 0 {
+		options.RepeatInterval = DefaultRepeatInterval
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		options: options,
+		groups:  make(map[string]*groupState),
+		stop:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+		logger:  logger,
+		now:     time.Now,
+	}
+	for _, r := range options.Receivers {
+		if r.Name == "" {
+			r.Name = r.URL
+		}
+		rec := &receiver{Receiver: r, queue: make(chan Payload, queueSize)}
+		n.receivers = append(n.receivers, rec)
+		n.wg.Add(1)
+		go n.deliverLoop(rec)
+	}
+	return n
+}
+
+// Notify takes every alert after an evaluation and queues the payloads of
+// the groups that changed or are due for a repeat.
+func (n *Notifier) Notify(alerts []alerting.Alert) {
+	byGroup := make(map[string][]alerting.Alert)
+	for _, alert := range alerts {
+		if alert.State != alerting.StatePending {
+			byGroup[alert.Rule] = append(byGroup[alert.Rule], alert)
+		}
+	}
+
+	n.mu.Lock()
+	now := n.now()
+	var payloads []Payload
+	for group := range n.groups {
+		if _, ok := byGroup[group]; !ok {
+			byGroup[group] = nil
+		}
+	}
+	for group, groupAlerts := range byGroup {
+		state := n.groups[group]
+		if state == nil {
+			state = &groupState{firing: map[string]bool{}}
+		}
+		firing := make(map[string]bool)
+		var send []alerting.Alert
+		for _, alert := range groupAlerts {
+			key := metrics.SeriesKey(alert.Metric, alert.Labels)
+			switch {
+			case alert.State == alerting.StateFiring:
+				firing[key] = true
+				send = append(send, alert)
+			case state.firing[key]:
+				// Resolved since the last notification.
+				send = append(send, alert)
+			}
+		}
+		changed := !sameKeys(firing, state.firing) || len(send) > len(firing)
+		due := len(firing) > 0 && now.Sub(state.lastSent) >= n.options.RepeatInterval
+		if len(firing) == 0 {
+			delete(n.groups, group)
+		} else {
+			n.groups[group] = state
+		}
+		// A group whose alerts are gone without resolving, e.g. after its
+		// rule was removed, has nothing to report.
+		if len(send) == 0 || !changed && !due {
+			continue
+		}
+		state.firing = firing
+		state.lastSent = now
+
+		status := StatusResolved
+		if len(firing) > 0 {
+			status = StatusFiring
+		}
+		payloads = append(payloads, Payload{Status: status, Group: group, Alerts: send})
+	}
+	n.mu.Unlock()
+
+	sort.Slice(payloads, func(i, j int) bool { return payloads[i].Group < payloads[j].Group })
+	for _, payload := range payloads {
+		for _, rec := range n.receivers {
+			payload.Receiver = rec.Name
+			select {
+			case rec.queue <- payload:
+			default:
+				n.logger.Error("notification queue is full, dropping notification",
+					zap.String("receiver", rec.Name), zap.String("group", payload.Group))
+			}
+		}
+	}
+}
+
+func sameKeys(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if !b[key] {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *Notifier) deliverLoop(rec *receiver) {
+	defer n.wg.Done()
+	dropped := 0
+	for payload := range rec.queue {
+		if n.ctx.Err() != nil {
+			dropped++
+			continue
+		}
+		if err := n.deliver(rec, payload); err != nil {
+			n.logger.Error("failed to deliver notification",
+				zap.String("receiver", rec.Name), zap.String("group", payload.Group), zap.Error(err))
+		}
+	}
+	if dropped > 0 {
+		n.logger.Error("notifier closed, dropping queued notifications",
+			zap.String("receiver", rec.Name), zap.Int("dropped", dropped))
+	}
+}
+
+// deliver posts payload, retrying network errors, 5xx and 429 responses.
+// Once the notifier is closed, failed attempts are no longer retried.
+func (n *Notifier) deliver(rec *receiver, payload Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		retriable, err := n.post(rec.URL, body)
+		if err == nil {
+			return nil
+		}
+		if !retriable || attempt >= rec.Retry.MaxRetries {
+			return fmt.Errorf("giving up after %d attempt(s): %w", attempt+1, err)
+		}
+		timer := time.NewTimer(rec.Retry.Backoff(attempt))
+		select {
+		case <-n.stop:
+			timer.Stop()
+			return fmt.Errorf("notifier closed after %d attempt(s): %w", attempt+1, err)
+		case <-timer.C:
+		}
+	}
+}
+
+func (n *Notifier) post(url string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(n.ctx, n.options.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", consts.ContentTypeJSON)
+	resp, err := n.options.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retriable := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+	return retriable, fmt.Errorf("receiver answered %s", resp.Status)
+}
+
+// Close stops the workers once the queued notifications are delivered or
+// have failed their first attempt. When ctx is done first, the delivery in
+// flight is aborted and the notifications still queued are dropped.
+func (n *Notifier) Close(ctx context.Context) {
+	close(n.stop)
+	for _, rec := range n.receivers {
+		close(rec.queue)
+	}
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		n.cancel()
+		<-done
+	}
+	n.cancel()
+}
@@ -0,0 +1,256 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/alerting"
+	"github.com/personage-hub/metrics-tracker/internal/dumper"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var fastRetry = RetryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+// testReceiver records the payloads it accepts. The first failures requests
+// are answered with status instead.
+type testReceiver struct {
+	*httptest.Server
+	payloads chan Payload
+	requests atomic.Int64
+	failures int64
+	status   int
+}
+
+func newTestReceiver(t *testing.T, failures int64, status int) *testReceiver {
+	r := &testReceiver{payloads: make(chan Payload, 16), failures: failures, status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.requests.Add(1) <= r.failures {
+			w.WriteHeader(r.status)
+			return
+		}
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		var payload Payload
+		if !assert.NoError(t, json.NewDecoder(req.Body).Decode(&payload)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.payloads <- payload
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testReceiver) next(t *testing.T) Payload {
+	select {
+	case payload := <-r.payloads:
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+		return Payload{}
+	}
+}
+
+func (r *testReceiver) none(t *testing.T) {
+	select {
+	case payload := <-r.payloads:
+		t.Fatalf("unexpected notification %+v", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type fixture struct {
+	storage  *storage.MemStorage
+	engine   *alerting.Engine
+	notifier *Notifier
+	clock    time.Time
+}
+
+const fixtureRules = `{"rules": [
+	{"name": "HighHeap", "type": "gauge", "metric": "HeapAlloc", "op": ">", "threshold": 100, "severity": "critical"},
+	{"name": "LowFree", "type": "gauge", "metric": "Free", "op": "<", "threshold": 10}
+]}`
+
+func newFixture(t *testing.T, receivers ...Receiver) *fixture {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(fixtureRules), 0644))
+	s, _ := storage.NewMemStorage(dumper.NewDumper(filepath.Join(t.TempDir(), "dump.json")), false)
+	engine, err := alerting.NewEngine(path, s, zap.NewNop())
+	require.NoError(t, err)
+
+	f := &fixture{storage: s, engine: engine, clock: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	f.notifier = New(Options{Receivers: receivers, RepeatInterval: time.Hour}, zap.NewNop())
+	f.notifier.now = func() time.Time { return f.clock }
+	engine.SetNotifier(f.notifier)
+	t.Cleanup(func() { f.notifier.Close(context.Background()) })
+	return f
+}
+
+func (f *fixture) set(t *testing.T, host string, value float64) {
+	require.NoError(t, f.storage.GaugeUpdate(metrics.SeriesKey("HeapAlloc", metrics.Labels{"host": host}), value))
+}
+
+func (f *fixture) evaluate(t *testing.T, advance time.Duration) {
+	f.clock = f.clock.Add(advance)
+	require.NoError(t, f.engine.Evaluate())
+}
+
+func hosts(payload Payload) []string {
+	var result []string
+	for _, alert := range payload.Alerts {
+		result = append(result, alert.Labels["host"]+":"+string(alert.State))
+	}
+	return result
+}
+
+func TestNotifyLifecycle(t *testing.T) {
+	receiver := newTestReceiver(t, 0, 0)
+	f := newFixture(t, Receiver{Name: "ops", URL: receiver.URL, Retry: fastRetry})
+
+	f.set(t, "a", 150)
+	f.set(t, "b", 200)
+	f.evaluate(t, 0)
+	payload := receiver.next(t)
+	assert.Equal(t, "ops", payload.Receiver)
+	assert.Equal(t, StatusFiring, payload.Status)
+	assert.Equal(t, "HighHeap", payload.Group)
+	assert.Equal(t, []string{"a:firing", "b:firing"}, hosts(payload), "simultaneous alerts are grouped")
+	assert.Equal(t, "critical", payload.Alerts[0].Severity)
+
+	f.evaluate(t, time.Minute)
+	receiver.none(t)
+
+	f.set(t, "c", 300)
+	f.evaluate(t, time.Minute)
+	payload = receiver.next(t)
+	assert.Equal(t, []string{"a:firing", "b:firing", "c:firing"}, hosts(payload), "a new alert changes the group")
+
+	f.set(t, "a", 50)
+	f.evaluate(t, time.Minute)
+	payload = receiver.next(t)
+	assert.Equal(t, StatusFiring, payload.Status)
+	assert.Equal(t, []string{"a:resolved", "b:firing", "c:firing"}, hosts(payload))
+
+	f.evaluate(t, time.Minute)
+	receiver.none(t)
+
+	f.evaluate(t, time.Hour)
+	payload = receiver.next(t)
+	assert.Equal(t, []string{"b:firing", "c:firing"}, hosts(payload), "a firing group is repeated")
+
+	f.set(t, "b", 50)
+	f.set(t, "c", 50)
+	f.evaluate(t, time.Minute)
+	payload = receiver.next(t)
+	assert.Equal(t, StatusResolved, payload.Status)
+	assert.Equal(t, []string{"b:resolved", "c:resolved"}, hosts(payload))
+
+	f.evaluate(t, 2*time.Hour)
+	receiver.none(t)
+}
+
+func TestNotifySeparateGroups(t *testing.T) {
+	receiver := newTestReceiver(t, 0, 0)
+	f := newFixture(t, Receiver{URL: receiver.URL, Retry: fastRetry})
+
+	f.set(t, "a", 150)
+	require.NoError(t, f.storage.GaugeUpdate("Free", 1))
+	f.evaluate(t, 0)
+
+	groups := []string{receiver.next(t).Group, receiver.next(t).Group}
+	assert.ElementsMatch(t, []string{"HighHeap", "LowFree"}, groups)
+	receiver.none(t)
+}
+
+func TestNotifyRetries(t *testing.T) {
+	receiver := newTestReceiver(t, 2, http.StatusServiceUnavailable)
+	f := newFixture(t, Receiver{URL: receiver.URL, Retry: fastRetry})
+
+	f.set(t, "a", 150)
+	f.evaluate(t, 0)
+	payload := receiver.next(t)
+	assert.Equal(t, receiver.URL, payload.Receiver, "a receiver is named by its URL by default")
+	assert.Equal(t, int64(3), receiver.requests.Load())
+}
+
+func TestNotifyGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		requests int64
+	}{
+		{name: "Rejected", status: http.StatusBadRequest, requests: 1},
+		{name: "Retries exhausted", status: http.StatusInternalServerError, requests: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newTestReceiver(t, 100, tt.status)
+			f := newFixture(t, Receiver{URL: receiver.URL, Retry: fastRetry})
+
+			f.set(t, "a", 150)
+			f.evaluate(t, 0)
+			assert.Eventually(t, func() bool { return receiver.requests.Load() == tt.requests },
+				5*time.Second, time.Millisecond)
+			receiver.none(t)
+			assert.Equal(t, tt.requests, receiver.requests.Load())
+		})
+	}
+}
+
+func TestNotifyReceiversAreIndependent(t *testing.T) {
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stuck.Close()
+	defer close(release)
+	healthy := newTestReceiver(t, 0, 0)
+	f := newFixture(t,
+		Receiver{URL: stuck.URL, Retry: fastRetry},
+		Receiver{URL: healthy.URL, Retry: fastRetry},
+	)
+
+	f.set(t, "a", 150)
+	f.evaluate(t, 0)
+	assert.Equal(t, []string{"a:firing"}, hosts(healthy.next(t)))
+	f.set(t, "a", 50)
+	f.evaluate(t, time.Minute)
+	assert.Equal(t, []string{"a:resolved"}, hosts(healthy.next(t)), "a stuck receiver does not delay the others")
+}
+
+func TestCloseDropsQueueAtDeadline(t *testing.T) {
+	var requests atomic.Int64
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer stuck.Close()
+	defer close(release)
+	n := New(Options{Receivers: []Receiver{{URL: stuck.URL, Retry: fastRetry}}, Timeout: time.Minute}, zap.NewNop())
+
+	for _, group := range []string{"a", "b", "c"} {
+		n.Notify([]alerting.Alert{{Rule: group, Metric: "HeapAlloc", State: alerting.StateFiring}})
+	}
+	require.Eventually(t, func() bool { return requests.Load() == 1 }, 5*time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	n.Close(ctx)
+	assert.Less(t, time.Since(start), 5*time.Second, "Close gives up at the deadline")
+	assert.Equal(t, int64(1), requests.Load(), "queued notifications are dropped")
+}
@@ -0,0 +1,408 @@
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/segments"
+)
+
+// Record layout: crc32 | payload length | sequence | unix nano | payload.
+// The checksum covers everything after itself.
+const headerSize = 4 + 4 + 8 + 8
+
+const (
+	cursorFile = "cursor"
+	idFile     = "id"
+)
+
+// format names segments by the sequence of their first record.
+var format = segments.Format{Ext: ".seg", HeaderSize: headerSize}
+
+var ErrFull = errors.New("outbox is full")
+
+type DropPolicy int
+
+const (
+	// DropOldest discards the oldest pending records to make room for new ones.
+	DropOldest DropPolicy = iota
+	// DropNewest rejects new records with ErrFull while the outbox is full.
+	DropNewest
+)
+
+type Options struct {
+	// MaxBytes caps the size of pending records, 0 means unlimited.
+	MaxBytes int64
+	// MaxAge discards pending records older than this, 0 means forever.
+	MaxAge time.Duration
+	// SegmentSize is the size after which a new segment file is started.
+	SegmentSize int64
+	Policy      DropPolicy
+}
+
+const DefaultSegmentSize = 4 << 20
+
+type Record struct {
+	Seq     uint64
+	Written time.Time
+	Payload []byte
+}
+
+type segment struct {
+	*segments.File
+	first uint64
+	last  uint64
+}
+
+type recordRef struct {
+	seq     uint64
+	segment *segment
+	offset  int64
+	size    int64
+	written time.Time
+}
+
+// Outbox is a durable FIFO queue of opaque payloads stored in append-only
+// segment files. Records stay on disk until acknowledged, dropped by the
+// size or age limits, or rejected by the drop policy.
+type Outbox struct {
+	mu       sync.Mutex
+	dir      string
+	id       string
+	options  Options
+	segments []*segment
+	records  []recordRef
+	pending  int64
+	nextSeq  uint64
+	acked    uint64
+	dropped  uint64
+	writer   *segments.Writer
+	now      func() time.Time
+}
+
+// Open loads the outbox stored in dir, creating it when needed. A torn
+// record at the end of the last segment, left by a crash, is cut off.
+func Open(dir string, options Options) (*Outbox, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox dir: %w", err)
+	}
+	o := &Outbox{
+		dir:     dir,
+		options: options,
+		writer:  segments.NewWriter(dir, format, options.SegmentSize),
+		now:     time.Now,
+	}
+	if err := o.loadID(); err != nil {
+		return nil, err
+	}
+	if err := o.loadCursor(); err != nil {
+		return nil, err
+	}
+	if err := o.loadSegments(); err != nil {
+		return nil, err
+	}
+	o.nextSeq = o.acked + 1
+	if n := len(o.segments); n > 0 && o.segments[n-1].last >= o.nextSeq {
+		o.nextSeq = o.segments[n-1].last + 1
+	}
+	if err := o.removeConsumedSegments(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// ID is a random identifier persisted with the outbox. Together with a
+// record sequence it forms a key that is unique across restarts.
+func (o *Outbox) ID() string {
+	return o.id
+}
+
+func (o *Outbox) loadID() error {
+	path := filepath.Join(o.dir, idFile)
+	data, err := os.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		o.id = strings.TrimSpace(string(data))
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read outbox id: %w", err)
+	}
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return fmt.Errorf("failed to generate outbox id: %w", err)
+	}
+	o.id = hex.EncodeToString(raw)
+	return writeFileSync(path, []byte(o.id))
+}
+
+func (o *Outbox) loadCursor() error {
+	data, err := os.ReadFile(filepath.Join(o.dir, cursorFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read outbox cursor: %w", err)
+	}
+	acked, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse outbox cursor: %w", err)
+	}
+	o.acked = acked
+	return nil
+}
+
+// loadSegments indexes the pending records of every segment.
+func (o *Outbox) loadSegments() error {
+	loaded := make(map[*segments.File]*segment)
+	files, err := format.Load(o.dir, func(file *segments.File, offset int64, header, payload []byte) bool {
+		seg, ok := loaded[file]
+		if !ok {
+			seg = &segment{File: file}
+			loaded[file] = seg
+		}
+		seq := binary.LittleEndian.Uint64(header[8:16])
+		if seg.first == 0 {
+			seg.first = seq
+		}
+		seg.last = seq
+		if seq > o.acked {
+			ref := recordRef{
+				seq:     seq,
+				segment: seg,
+				offset:  offset,
+				size:    int64(headerSize + len(payload)),
+				written: time.Unix(0, int64(binary.LittleEndian.Uint64(header[16:24]))),
+			}
+			o.records = append(o.records, ref)
+			o.pending += ref.size
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load outbox: %w", err)
+	}
+	for _, file := range files {
+		seg, ok := loaded[file]
+		if !ok {
+			seg = &segment{File: file}
+		}
+		o.segments = append(o.segments, seg)
+	}
+	return nil
+}
+
+// Append durably stores payload and returns its sequence number.
+func (o *Outbox) Append(payload []byte) (uint64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	size := int64(headerSize + len(payload))
+	if o.options.MaxBytes > 0 && o.pending+size > o.options.MaxBytes && o.options.Policy == DropNewest {
+		o.dropped++
+		return 0, ErrFull
+	}
+
+	active, err := o.ensureActive()
+	if err != nil {
+		return 0, err
+	}
+	seg := o.segments[len(o.segments)-1]
+
+	seq := o.nextSeq
+	written := o.now()
+	record := make([]byte, size)
+	binary.LittleEndian.PutUint64(record[8:16], seq)
+	binary.LittleEndian.PutUint64(record[16:24], uint64(written.UnixNano()))
+	copy(record[headerSize:], payload)
+	format.Seal(record)
+
+	if _, err := active.Write(record); err != nil {
+		return 0, o.cut(seg, fmt.Errorf("failed to write outbox record: %w", err))
+	}
+	if err := active.Sync(); err != nil {
+		return 0, o.cut(seg, fmt.Errorf("failed to sync outbox record: %w", err))
+	}
+
+	o.records = append(o.records, recordRef{
+		seq:     seq,
+		segment: seg,
+		offset:  seg.Size,
+		size:    size,
+		written: written,
+	})
+	if seg.first == 0 {
+		seg.first = seq
+	}
+	seg.last = seq
+	seg.Size += size
+	o.pending += size
+	o.nextSeq++
+
+	// The record just written is always kept, even if it alone exceeds the limit.
+	for o.options.MaxBytes > 0 && o.pending > o.options.MaxBytes && len(o.records) > 1 {
+		o.dropped++
+		if err := o.ackLocked(o.records[0].seq); err != nil {
+			return seq, err
+		}
+	}
+	return seq, nil
+}
+
+// cut drops whatever part of a failed record made it to seg, so that later
+// records are not appended behind torn bytes.
+func (o *Outbox) cut(seg *segment, err error) error {
+	if cutErr := o.writer.Truncate(seg.Size); cutErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to cut outbox record: %w", cutErr))
+	}
+	return err
+}
+
+func (o *Outbox) ensureActive() (*os.File, error) {
+	var last *segments.File
+	if n := len(o.segments); n > 0 {
+		last = o.segments[n-1].File
+	}
+	active, created, err := o.writer.Ensure(last, o.nextSeq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox segment: %w", err)
+	}
+	if created != nil {
+		o.segments = append(o.segments, &segment{File: created})
+	}
+	return active, nil
+}
+
+// Peek returns the oldest pending record. Records older than MaxAge are
+// dropped first.
+func (o *Outbox) Peek() (Record, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.options.MaxAge > 0 {
+		deadline := o.now().Add(-o.options.MaxAge)
+		for len(o.records) > 0 && o.records[0].written.Before(deadline) {
+			o.dropped++
+			if err := o.ackLocked(o.records[0].seq); err != nil {
+				return Record{}, false, err
+			}
+		}
+	}
+	if len(o.records) == 0 {
+		return Record{}, false, nil
+	}
+
+	ref := o.records[0]
+	file, err := os.Open(ref.segment.Path)
+	if err != nil {
+		return Record{}, false, fmt.Errorf("failed to open outbox segment: %w", err)
+	}
+	defer file.Close()
+	payload := make([]byte, ref.size-headerSize)
+	if _, err := file.ReadAt(payload, ref.offset+headerSize); err != nil {
+		return Record{}, false, fmt.Errorf("failed to read outbox record: %w", err)
+	}
+	return Record{Seq: ref.seq, Written: ref.written, Payload: payload}, true, nil
+}
+
+// Ack marks every record up to and including seq as delivered.
+func (o *Outbox) Ack(seq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.ackLocked(seq)
+}
+
+func (o *Outbox) ackLocked(seq uint64) error {
+	if seq <= o.acked {
+		return nil
+	}
+	o.acked = seq
+	for len(o.records) > 0 && o.records[0].seq <= seq {
+		o.pending -= o.records[0].size
+		o.records = o.records[1:]
+	}
+	if err := writeFileSync(filepath.Join(o.dir, cursorFile), []byte(strconv.FormatUint(seq, 10))); err != nil {
+		return fmt.Errorf("failed to save outbox cursor: %w", err)
+	}
+	return o.removeConsumedSegments()
+}
+
+// removeConsumedSegments deletes fully acknowledged segments except the one
+// currently appended to.
+func (o *Outbox) removeConsumedSegments() error {
+	kept := o.segments[:0]
+	for i, seg := range o.segments {
+		isActive := i == len(o.segments)-1 && seg.Size < o.options.SegmentSize
+		if !isActive && seg.last <= o.acked {
+			if err := segments.Remove(seg.File); err != nil {
+				return fmt.Errorf("failed to remove outbox segment: %w", err)
+			}
+			continue
+		}
+		kept = append(kept, seg)
+	}
+	if len(kept) < len(o.segments) {
+		// The active file is only ever the last segment; keep it open only if it survived.
+		if len(kept) == 0 || kept[len(kept)-1] != o.segments[len(o.segments)-1] {
+			_ = o.writer.Close()
+		}
+	}
+	o.segments = kept
+	return nil
+}
+
+// Len returns the number of pending records.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.records)
+}
+
+// Dropped returns how many records were discarded by the size, age or
+// drop policy limits since Open.
+func (o *Outbox) Dropped() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.dropped
+}
+
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.writer.Close()
+}
+
+// writeFileSync replaces path with data through a synced temporary file.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return segments.SyncDir(filepath.Dir(path))
+}
@@ -0,0 +1,167 @@
+package outbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendAll(t *testing.T, o *Outbox, payloads ...string) {
+	for _, payload := range payloads {
+		_, err := o.Append([]byte(payload))
+		require.NoError(t, err)
+	}
+}
+
+func drain(t *testing.T, o *Outbox) []string {
+	var result []string
+	for {
+		record, ok, err := o.Peek()
+		require.NoError(t, err)
+		if !ok {
+			return result
+		}
+		result = append(result, string(record.Payload))
+		require.NoError(t, o.Ack(record.Seq))
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+format.Ext))
+	require.NoError(t, err)
+	return paths
+}
+
+func TestOutboxOrder(t *testing.T) {
+	o, err := Open(t.TempDir(), Options{})
+	require.NoError(t, err)
+	defer o.Close()
+
+	appendAll(t, o, "a", "b", "c")
+	assert.Equal(t, 3, o.Len())
+	assert.Equal(t, []string{"a", "b", "c"}, drain(t, o))
+	assert.Equal(t, 0, o.Len())
+}
+
+func TestOutboxSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	o, err := Open(dir, Options{})
+	require.NoError(t, err)
+	appendAll(t, o, "a", "b", "c")
+
+	record, ok, err := o.Peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, o.Ack(record.Seq))
+	id := o.ID()
+	require.NoError(t, o.Close())
+
+	o, err = Open(dir, Options{})
+	require.NoError(t, err)
+	defer o.Close()
+	assert.Equal(t, id, o.ID())
+
+	seq, err := o.Append([]byte("d"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), seq, "sequence numbers are never reused")
+	assert.Equal(t, []string{"b", "c", "d"}, drain(t, o))
+}
+
+func TestOutboxCutsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	o, err := Open(dir, Options{})
+	require.NoError(t, err)
+	appendAll(t, o, "a", "b")
+	require.NoError(t, o.Close())
+
+	// Simulate a crash in the middle of writing a third record.
+	paths := segmentFiles(t, dir)
+	require.Len(t, paths, 1)
+	file, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{1, 2, 3, 4, 5, 6, 7})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	o, err = Open(dir, Options{})
+	require.NoError(t, err)
+	defer o.Close()
+	appendAll(t, o, "c")
+	assert.Equal(t, []string{"a", "b", "c"}, drain(t, o))
+}
+
+func TestOutboxLimits(t *testing.T) {
+	recordSize := int64(headerSize + 1)
+	tests := []struct {
+		name    string
+		options Options
+		want    []string
+		err     error
+	}{
+		{
+			name:    "Oldest records are dropped",
+			options: Options{MaxBytes: 2 * recordSize, Policy: DropOldest},
+			want:    []string{"c", "d"},
+		},
+		{
+			name:    "New records are rejected",
+			options: Options{MaxBytes: 2 * recordSize, Policy: DropNewest},
+			want:    []string{"a", "b"},
+			err:     ErrFull,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := Open(t.TempDir(), tt.options)
+			require.NoError(t, err)
+			defer o.Close()
+
+			var lastErr error
+			for _, payload := range []string{"a", "b", "c", "d"} {
+				if _, err := o.Append([]byte(payload)); err != nil {
+					lastErr = err
+				}
+			}
+			assert.ErrorIs(t, lastErr, tt.err)
+			assert.Equal(t, uint64(2), o.Dropped())
+			assert.Equal(t, tt.want, drain(t, o))
+		})
+	}
+}
+
+func TestOutboxMaxAge(t *testing.T) {
+	o, err := Open(t.TempDir(), Options{MaxAge: time.Minute})
+	require.NoError(t, err)
+	defer o.Close()
+
+	now := time.Now()
+	o.now = func() time.Time { return now }
+	appendAll(t, o, "old")
+	now = now.Add(2 * time.Minute)
+	appendAll(t, o, "new")
+
+	assert.Equal(t, []string{"new"}, drain(t, o))
+	assert.Equal(t, uint64(1), o.Dropped())
+}
+
+func TestOutboxSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	o, err := Open(dir, Options{SegmentSize: 3 * (headerSize + 2)})
+	require.NoError(t, err)
+	defer o.Close()
+
+	var payloads []string
+	for i := 0; i < 10; i++ {
+		payloads = append(payloads, fmt.Sprintf("%02d", i))
+	}
+	appendAll(t, o, payloads...)
+	assert.Len(t, segmentFiles(t, dir), 4)
+
+	assert.Equal(t, payloads, drain(t, o))
+	assert.Len(t, segmentFiles(t, dir), 1, "only the active segment is kept")
+}
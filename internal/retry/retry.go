@@ -0,0 +1,33 @@
+// Package retry holds the backoff shared by the agent's reports and the
+// server's alert notifications.
+package retry
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Policy limits how often and how fast a failed request is repeated.
+type Policy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// Backoff returns the delay before retry number attempt (starting at 0):
+// BaseDelay doubled per attempt, capped by MaxDelay, with the upper half
+// randomized so that clients don't retry in lockstep.
+func (p Policy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)))
+}
@@ -0,0 +1,28 @@
+package retry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, limit := range []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second,
+	} {
+		delay := policy.Backoff(attempt)
+		assert.GreaterOrEqual(t, delay, limit/2)
+		assert.LessOrEqual(t, delay, limit)
+	}
+}
+
+func TestBackoffWithoutMaxDelay(t *testing.T) {
+	policy := Policy{BaseDelay: time.Millisecond}
+	delay := policy.Backoff(10)
+	assert.GreaterOrEqual(t, delay, 512*time.Millisecond)
+	assert.LessOrEqual(t, delay, 1024*time.Millisecond)
+	assert.Zero(t, Policy{}.Backoff(3))
+}
@@ -0,0 +1,235 @@
+// Package segments stores append-only logs as numbered segment files, as
+// used by the write-ahead log and the outbox.
+//
+// Every record starts with a header whose first 8 bytes are the crc32 of
+// the rest of the record and the payload length. The remaining header bytes
+// are up to the caller.
+package segments
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format describes the records of a log.
+type Format struct {
+	// Ext is the extension of the segment files, e.g. ".wal".
+	Ext string
+	// HeaderSize is the size of the record header, at least 8.
+	HeaderSize int
+	// MaxPayload guards scans against allocating a garbage length, 0 means
+	// no limit beyond the file size.
+	MaxPayload int64
+}
+
+// File is one segment. Index orders the segments and names the file.
+type File struct {
+	Path  string
+	Index uint64
+	Size  int64
+}
+
+// Name returns the file name of segment index. Indexes are zero padded so
+// that names sort like the indexes.
+func (f Format) Name(index uint64) string {
+	return fmt.Sprintf("%020d%s", index, f.Ext)
+}
+
+// Seal fills in the length and checksum of record, a header followed by
+// the payload.
+func (f Format) Seal(record []byte) {
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(record)-f.HeaderSize))
+	binary.LittleEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+}
+
+// Load opens the segments in dir, oldest first, and calls fn for every valid
+// record as Scan does. A torn record at the end of the last segment, left by
+// a crash, is cut off; damage to an earlier segment is an error.
+func (f Format) Load(dir string, fn func(file *File, offset int64, header, payload []byte) bool) ([]*File, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+f.Ext))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	files := make([]*File, 0, len(paths))
+	for i, path := range paths {
+		index, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), f.Ext), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected segment name %s", path)
+		}
+		file := &File{Path: path, Index: index}
+		validSize, err := f.Scan(file, fn)
+		if err != nil {
+			return nil, err
+		}
+		if validSize < file.Size {
+			if i != len(paths)-1 {
+				return nil, fmt.Errorf("segment %s is corrupted at offset %d", path, validSize)
+			}
+			if err := os.Truncate(path, validSize); err != nil {
+				return nil, fmt.Errorf("failed to cut torn record: %w", err)
+			}
+			file.Size = validSize
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Scan calls fn for every valid record of file and returns the size of its
+// valid prefix. A record fn rejects by returning false ends the valid
+// prefix. fn may be nil; it must not keep header or payload.
+func (f Format) Scan(file *File, fn func(file *File, offset int64, header, payload []byte) bool) (int64, error) {
+	r, err := os.Open(file.Path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer r.Close()
+
+	info, err := r.Stat()
+	if err != nil {
+		return 0, err
+	}
+	file.Size = info.Size()
+
+	reader := bufio.NewReader(r)
+	headerSize := int64(f.HeaderSize)
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return offset, nil
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:8]))
+		if f.MaxPayload > 0 && length > f.MaxPayload || offset+headerSize+length > file.Size {
+			return offset, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return offset, nil
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		crc.Write(payload)
+		if crc.Sum32() != binary.LittleEndian.Uint32(header[0:4]) {
+			return offset, nil
+		}
+		if fn != nil && !fn(file, offset, header, payload) {
+			return offset, nil
+		}
+		offset += headerSize + length
+	}
+}
+
+// Writer keeps the newest segment of a log open for appending.
+type Writer struct {
+	dir    string
+	format Format
+	limit  int64
+	file   *os.File
+	path   string
+}
+
+// NewWriter appends to the segments in dir and starts a new segment once
+// the newest one reaches limit bytes.
+func NewWriter(dir string, format Format, limit int64) *Writer {
+	return &Writer{dir: dir, format: format, limit: limit}
+}
+
+// Ensure returns the file to append to: last, the newest segment, while it
+// is below the limit, or else a new segment numbered next, which is also
+// returned as created.
+func (w *Writer) Ensure(last *File, next uint64) (file *os.File, created *File, err error) {
+	if last == nil || last.Size >= w.limit {
+		created, err = w.Start(next)
+		return w.file, created, err
+	}
+	if w.file != nil && w.path == last.Path {
+		return w.file, nil, nil
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	file, err = os.OpenFile(last.Path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open segment: %w", err)
+	}
+	w.file, w.path = file, last.Path
+	return file, nil, nil
+}
+
+// Start closes the open segment, if any, and creates the segment index.
+func (w *Writer) Start(index uint64) (*File, error) {
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(w.dir, w.format.Name(index))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment: %w", err)
+	}
+	if err := SyncDir(w.dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.file, w.path = file, path
+	return &File{Path: path, Index: index}, nil
+}
+
+// Sync flushes the open segment to disk.
+func (w *Writer) Sync() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// Truncate cuts the open segment back to size, e.g. to drop a record whose
+// write or sync failed.
+func (w *Writer) Truncate(size int64) error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Truncate(size)
+}
+
+// Close syncs and closes the open segment, if any.
+func (w *Writer) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file, w.path = nil, ""
+	return err
+}
+
+// Remove deletes the segment files; missing ones are skipped.
+func Remove(files ...*File) error {
+	for _, file := range files {
+		if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// SyncDir makes the creation, renaming and removal of files in dir durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
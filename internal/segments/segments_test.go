@@ -0,0 +1,137 @@
+package segments
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testFormat = Format{Ext: ".test", HeaderSize: 8, MaxPayload: 1 << 10}
+
+func record(payload string) []byte {
+	r := make([]byte, testFormat.HeaderSize+len(payload))
+	copy(r[testFormat.HeaderSize:], payload)
+	testFormat.Seal(r)
+	return r
+}
+
+func appendRecords(t *testing.T, w *Writer, files []*File, payloads ...string) []*File {
+	for _, payload := range payloads {
+		var last *File
+		next := uint64(1)
+		if n := len(files); n > 0 {
+			last = files[n-1]
+			next = last.Index + 1
+		}
+		file, created, err := w.Ensure(last, next)
+		require.NoError(t, err)
+		if created != nil {
+			files = append(files, created)
+		}
+		r := record(payload)
+		_, err = file.Write(r)
+		require.NoError(t, err)
+		files[len(files)-1].Size += int64(len(r))
+	}
+	return files
+}
+
+func loadPayloads(t *testing.T, dir string) ([]*File, []string) {
+	var payloads []string
+	files, err := testFormat.Load(dir, func(_ *File, _ int64, _, payload []byte) bool {
+		payloads = append(payloads, string(payload))
+		return true
+	})
+	require.NoError(t, err)
+	return files, payloads
+}
+
+func TestWriterStartsSegmentsAtLimit(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, testFormat, 2*int64(len(record("aa"))))
+	files := appendRecords(t, w, nil, "aa", "bb", "cc")
+	require.NoError(t, w.Close())
+	require.Len(t, files, 2)
+	assert.Equal(t, filepath.Join(dir, "00000000000000000002.test"), files[1].Path)
+
+	loaded, payloads := loadPayloads(t, dir)
+	assert.Equal(t, files, loaded)
+	assert.Equal(t, []string{"aa", "bb", "cc"}, payloads)
+
+	// The last segment has room left and is reopened.
+	w = NewWriter(dir, testFormat, 2*int64(len(record("aa"))))
+	files = appendRecords(t, w, loaded, "dd")
+	require.NoError(t, w.Close())
+	assert.Len(t, files, 2)
+	_, payloads = loadPayloads(t, dir)
+	assert.Equal(t, []string{"aa", "bb", "cc", "dd"}, payloads)
+}
+
+func TestLoadCutsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, testFormat, 1<<20)
+	files := appendRecords(t, w, nil, "aa", "bb")
+	require.NoError(t, w.Close())
+
+	file, err := os.OpenFile(files[0].Path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.Write(record("cc")[:5])
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	loaded, payloads := loadPayloads(t, dir)
+	assert.Equal(t, []string{"aa", "bb"}, payloads)
+	assert.Equal(t, files[0].Size, loaded[0].Size)
+	info, err := os.Stat(files[0].Path)
+	require.NoError(t, err)
+	assert.Equal(t, files[0].Size, info.Size())
+}
+
+func TestLoadRejectsDamagedOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, testFormat, 1)
+	files := appendRecords(t, w, nil, "aa", "bb")
+	require.NoError(t, w.Close())
+
+	data, err := os.ReadFile(files[0].Path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(files[0].Path, data, 0644))
+
+	_, err = testFormat.Load(dir, nil)
+	assert.Error(t, err)
+}
+
+func TestScanStopsAtRejectedRecord(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, testFormat, 1<<20)
+	files := appendRecords(t, w, nil, "aa", "bad", "cc")
+	require.NoError(t, w.Close())
+
+	valid, err := testFormat.Scan(files[0], func(_ *File, _ int64, _, payload []byte) bool {
+		return string(payload) != "bad"
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(record("aa"))), valid)
+}
+
+func TestWriterTruncateDropsFailedRecord(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, testFormat, 1<<20)
+	files := appendRecords(t, w, nil, "aa")
+
+	// A record whose write failed half way.
+	file, _, err := w.Ensure(files[0], 2)
+	require.NoError(t, err)
+	_, err = file.Write(record("bb")[:5])
+	require.NoError(t, err)
+	require.NoError(t, w.Truncate(files[0].Size))
+
+	files = appendRecords(t, w, files, "cc")
+	require.NoError(t, w.Close())
+	_, payloads := loadPayloads(t, dir)
+	assert.Equal(t, []string{"aa", "cc"}, payloads)
+}
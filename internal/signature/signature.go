@@ -0,0 +1,93 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	HeaderHash  = "HashSHA256"
+	HeaderKeyID = "HashSHA256-Key-Id"
+)
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// KeyRing holds the keys accepted for verification. The first key is the
+// active one and is used for signing, the rest are kept during rotation.
+type KeyRing struct {
+	keys []Key
+}
+
+// ParseKeyRing parses a key setting. A plain value is a single key without
+// an ID. Several keys are given as comma separated id:secret pairs, the
+// first pair being the active key, e.g. "2024b:newsecret,2024a:oldsecret".
+// An empty value returns a nil KeyRing, which disables signing.
+func ParseKeyRing(value string) (*KeyRing, error) {
+	if value == "" {
+		return nil, nil
+	}
+	id, secret, ok := strings.Cut(value, ":")
+	if !ok || !keyIDPattern.MatchString(id) {
+		return &KeyRing{keys: []Key{{Secret: []byte(value)}}}, nil
+	}
+
+	ring := &KeyRing{}
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		id, secret, ok = strings.Cut(pair, ":")
+		if !ok || !keyIDPattern.MatchString(id) || secret == "" {
+			return nil, fmt.Errorf("invalid key entry %q, expected id:secret", pair)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		seen[id] = true
+		ring.keys = append(ring.keys, Key{ID: id, Secret: []byte(secret)})
+	}
+	return ring, nil
+}
+
+// Sum returns the hex encoded HMAC-SHA256 of data.
+func Sum(secret, data []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign signs data with the active key and returns its ID with the signature.
+func (r *KeyRing) Sign(data []byte) (string, string) {
+	active := r.keys[0]
+	return active.ID, Sum(active.Secret, data)
+}
+
+var ErrMismatch = errors.New("signature mismatch")
+
+// Verify checks sum against the key named by id, or against every key when
+// id is empty, so agents that don't send a key ID keep working during rotation.
+func (r *KeyRing) Verify(data []byte, id string, sum string) error {
+	expected, err := hex.DecodeString(sum)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	for _, key := range r.keys {
+		if id != "" && key.ID != id {
+			continue
+		}
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(data)
+		if hmac.Equal(mac.Sum(nil), expected) {
+			return nil
+		}
+	}
+	return ErrMismatch
+}
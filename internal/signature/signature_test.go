@@ -0,0 +1,65 @@
+package signature
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyRing(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []Key
+		wantErr bool
+	}{
+		{name: "Empty disables signing", value: ""},
+		{name: "Plain key", value: "secret", want: []Key{{Secret: []byte("secret")}}},
+		{name: "Plain path", value: "/tmp/key", want: []Key{{Secret: []byte("/tmp/key")}}},
+		{
+			name:  "Key IDs",
+			value: "new:secret2,old:secret1",
+			want:  []Key{{ID: "new", Secret: []byte("secret2")}, {ID: "old", Secret: []byte("secret1")}},
+		},
+		{name: "Duplicate ID", value: "a:one,a:two", wantErr: true},
+		{name: "Missing secret", value: "a:one,b:", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring, err := ParseKeyRing(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.want == nil {
+				assert.Nil(t, ring)
+				return
+			}
+			assert.Equal(t, tt.want, ring.keys)
+		})
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	data := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	oldRing, err := ParseKeyRing("old:secret1")
+	require.NoError(t, err)
+	rotated, err := ParseKeyRing("new:secret2,old:secret1")
+	require.NoError(t, err)
+
+	id, sum := oldRing.Sign(data)
+	assert.Equal(t, "old", id)
+	assert.Equal(t, Sum([]byte("secret1"), data), sum)
+
+	assert.NoError(t, rotated.Verify(data, id, sum), "old key is still accepted")
+	assert.NoError(t, rotated.Verify(data, "", sum), "key ID is optional")
+	assert.ErrorIs(t, rotated.Verify(data, "new", sum), ErrMismatch)
+	assert.ErrorIs(t, rotated.Verify([]byte("tampered"), id, sum), ErrMismatch)
+	assert.Error(t, rotated.Verify(data, id, "not-hex"))
+
+	id, sum = rotated.Sign(data)
+	assert.Equal(t, "new", id)
+	assert.ErrorIs(t, oldRing.Verify(data, "", sum), ErrMismatch)
+}
@@ -0,0 +1,213 @@
+package statsd
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/personage-hub/metrics-tracker/internal/collector"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+)
+
+// maxTimerValues bounds the values kept per timer and interval for the
+// percentiles; count, sum, min and max stay exact beyond it.
+const maxTimerValues = 10000
+
+// maxSeries bounds the series of each metric type the aggregator keeps;
+// lines for new series of a type are dropped while it is reached.
+const maxSeries = 10000
+
+// maxSetMembers bounds the members kept per set and interval; the reported
+// count stops growing there.
+const maxSetMembers = 10000
+
+// gaugeIdleFlushes is the number of flushes without an update after which a
+// gauge is forgotten, together with its base for relative updates.
+const gaugeIdleFlushes = 10
+
+// timerPercentiles are reported as <name>.p<percentile> gauges.
+var timerPercentiles = []float64{50, 90, 99}
+
+type series struct {
+	name   string
+	labels metrics.Labels
+}
+
+type counterState struct {
+	series
+	value float64
+}
+
+type gaugeState struct {
+	series
+	value   float64
+	updated bool
+	// idle counts the flushes since the last update.
+	idle int
+}
+
+type timerState struct {
+	series
+	// count is scaled by the sample rates, n is the number of values seen.
+	count    float64
+	n        int
+	sum      float64
+	min, max float64
+	values   []float64
+}
+
+type setState struct {
+	series
+	members map[string]struct{}
+}
+
+// Aggregator accumulates StatsD lines between two Flush calls.
+//
+// Counters are summed, scaled by their sample rate. Gauges keep their last
+// value, which also persists across flushes as the base of relative
+// updates until the gauge has been idle for gaugeIdleFlushes flushes. Timers are reported as <name>.count (a counter) and
+// <name>.min, .max, .mean and percentile gauges. Sets are reported as a
+// gauge of the number of distinct members seen in the interval.
+type Aggregator struct {
+	mu       sync.Mutex
+	counters map[string]*counterState
+	gauges   map[string]*gaugeState
+	timers   map[string]*timerState
+	sets     map[string]*setState
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		counters: make(map[string]*counterState),
+		gauges:   make(map[string]*gaugeState),
+		timers:   make(map[string]*timerState),
+		sets:     make(map[string]*setState),
+	}
+}
+
+func (a *Aggregator) Add(line Line) {
+	key := metrics.SeriesKey(line.Name, line.Tags)
+	s := series{name: line.Name, labels: line.Tags}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch line.Type {
+	case TypeCounter:
+		c, ok := a.counters[key]
+		if !ok {
+			if len(a.counters) >= maxSeries {
+				return
+			}
+			c = &counterState{series: s}
+			a.counters[key] = c
+		}
+		c.value += line.Value / line.SampleRate
+	case TypeGauge:
+		g, ok := a.gauges[key]
+		if !ok {
+			if len(a.gauges) >= maxSeries {
+				return
+			}
+			g = &gaugeState{series: s}
+			a.gauges[key] = g
+		}
+		if line.Relative {
+			g.value += line.Value
+		} else {
+			g.value = line.Value
+		}
+		g.updated = true
+	case TypeTimer:
+		t, ok := a.timers[key]
+		if !ok {
+			if len(a.timers) >= maxSeries {
+				return
+			}
+			t = &timerState{series: s, min: line.Value, max: line.Value}
+			a.timers[key] = t
+		}
+		t.count += 1 / line.SampleRate
+		t.n++
+		t.sum += line.Value
+		t.min = math.Min(t.min, line.Value)
+		t.max = math.Max(t.max, line.Value)
+		if len(t.values) < maxTimerValues {
+			t.values = append(t.values, line.Value)
+		}
+	case TypeSet:
+		set, ok := a.sets[key]
+		if !ok {
+			if len(a.sets) >= maxSeries {
+				return
+			}
+			set = &setState{series: s, members: make(map[string]struct{})}
+			a.sets[key] = set
+		}
+		if len(set.members) < maxSetMembers {
+			set.members[line.Member] = struct{}{}
+		}
+	}
+}
+
+// Flush returns the aggregates of the interval since the previous Flush
+// and starts a new interval.
+func (a *Aggregator) Flush() []collector.Sample {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var samples []collector.Sample
+	for _, c := range a.counters {
+		if delta := int64(math.Round(c.value)); delta != 0 {
+			samples = append(samples, labeled(collector.Counter(c.name, delta), c.labels))
+		}
+	}
+	for key, g := range a.gauges {
+		if g.updated {
+			samples = append(samples, labeled(collector.Gauge(g.name, g.value), g.labels))
+			g.updated = false
+			g.idle = 0
+		} else if g.idle++; g.idle >= gaugeIdleFlushes {
+			delete(a.gauges, key)
+		}
+	}
+	for _, t := range a.timers {
+		samples = append(samples, t.samples()...)
+	}
+	for _, set := range a.sets {
+		samples = append(samples, labeled(collector.Gauge(set.name, float64(len(set.members))), set.labels))
+	}
+	a.counters = make(map[string]*counterState)
+	a.timers = make(map[string]*timerState)
+	a.sets = make(map[string]*setState)
+	return samples
+}
+
+func (t *timerState) samples() []collector.Sample {
+	sort.Float64s(t.values)
+	samples := []collector.Sample{
+		labeled(collector.Counter(t.name+".count", int64(math.Round(t.count))), t.labels),
+		labeled(collector.Gauge(t.name+".min", t.min), t.labels),
+		labeled(collector.Gauge(t.name+".max", t.max), t.labels),
+		labeled(collector.Gauge(t.name+".mean", t.sum/float64(t.n)), t.labels),
+	}
+	for _, p := range timerPercentiles {
+		name := t.name + ".p" + strconv.FormatFloat(p, 'f', -1, 64)
+		samples = append(samples, labeled(collector.Gauge(name, percentile(t.values, p)), t.labels))
+	}
+	return samples
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func labeled(sample collector.Sample, labels metrics.Labels) collector.Sample {
+	sample.Labels = labels
+	return sample
+}
@@ -0,0 +1,96 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// maxPacketSize is the largest datagram read; longer ones are truncated.
+const maxPacketSize = 65535
+
+// Listener reads StatsD packets from one socket into an Aggregator.
+type Listener struct {
+	conn       net.PacketConn
+	network    string
+	address    string
+	aggregator *Aggregator
+	logger     *zap.Logger
+}
+
+// ParseAddress splits an address such as "udp://:8125",
+// "unixgram:///run/statsd.sock" or ":8125" (UDP) into network and address.
+func ParseAddress(value string) (network, address string, err error) {
+	network, address, ok := strings.Cut(value, "://")
+	if !ok {
+		return "udp", value, nil
+	}
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return network, address, nil
+	}
+	return "", "", fmt.Errorf("unsupported StatsD network %q: want udp or unixgram", network)
+}
+
+// Listen opens the socket. A stale unixgram socket file left behind by a
+// previous run is replaced.
+func Listen(network, address string, aggregator *Aggregator, logger *zap.Logger) (*Listener, error) {
+	if network == "unixgram" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(address)
+		}
+	}
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		conn:       conn,
+		network:    network,
+		address:    address,
+		aggregator: aggregator,
+		logger:     logger,
+	}, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Serve reads packets until the listener is closed. Malformed lines are
+// logged and skipped.
+func (l *Listener) Serve() error {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			parsed, err := ParseLine(line)
+			if err != nil {
+				l.logger.Debug("skipping malformed StatsD line", zap.String("line", line), zap.Error(err))
+				continue
+			}
+			l.aggregator.Add(parsed)
+		}
+	}
+}
+
+func (l *Listener) Close() error {
+	err := l.conn.Close()
+	if l.network == "unixgram" {
+		_ = os.Remove(l.address)
+	}
+	return err
+}
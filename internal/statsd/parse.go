@@ -0,0 +1,130 @@
+// Package statsd receives StatsD metrics on UDP and unixgram sockets and
+// aggregates them into samples for the agent's report.
+//
+// A packet holds one or more lines separated by newlines, each of the form
+//
+//	name:value|type[|@sample_rate][|#tag:value,tag]
+//
+// with type c (counter), g (gauge), ms (timer) or s (set); the DogStatsD
+// types h and d are treated as timers. DogStatsD tags become labels.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+)
+
+const (
+	TypeCounter = "c"
+	TypeGauge   = "g"
+	TypeTimer   = "ms"
+	TypeSet     = "s"
+)
+
+// Line is a single parsed StatsD metric.
+type Line struct {
+	Name string
+	Type string
+	// Value is unset for sets, whose value is Member.
+	Value  float64
+	Member string
+	// Relative is set for gauges given as +N or -N, which adjust the
+	// current value instead of replacing it.
+	Relative   bool
+	SampleRate float64
+	Tags       metrics.Labels
+}
+
+// ParseLine parses one StatsD line.
+func ParseLine(line string) (Line, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		return Line{}, errors.New("missing ':' after the metric name")
+	}
+	if name == "" || strings.ContainsAny(name, "{} \t") {
+		return Line{}, fmt.Errorf("invalid metric name %q", name)
+	}
+	sections := strings.Split(rest, "|")
+	if len(sections) < 2 {
+		return Line{}, errors.New("missing metric type")
+	}
+	result := Line{Name: name, SampleRate: 1}
+
+	switch sections[1] {
+	case TypeCounter, TypeGauge, TypeTimer, TypeSet:
+		result.Type = sections[1]
+	case "h", "d":
+		result.Type = TypeTimer
+	default:
+		return Line{}, fmt.Errorf("unsupported metric type %q", sections[1])
+	}
+
+	raw := sections[0]
+	if result.Type == TypeSet {
+		if raw == "" {
+			return Line{}, errors.New("empty set member")
+		}
+		result.Member = raw
+	} else {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return Line{}, fmt.Errorf("invalid value %q", raw)
+		}
+		result.Value = value
+		result.Relative = result.Type == TypeGauge && (raw[0] == '+' || raw[0] == '-')
+	}
+
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Line{}, fmt.Errorf("invalid sample rate %q", section[1:])
+			}
+			result.SampleRate = rate
+		case strings.HasPrefix(section, "#"):
+			result.Tags = parseTags(section[1:])
+		}
+		// Other DogStatsD extensions, e.g. container IDs, are ignored.
+	}
+	return result, nil
+}
+
+// parseTags turns DogStatsD tags into labels. Characters not allowed in
+// label names are replaced by '_', a tag without a value gets the value
+// "true", and tags that still make no valid label are skipped.
+func parseTags(raw string) metrics.Labels {
+	var labels metrics.Labels
+	for _, tag := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			value = "true"
+		}
+		name = labelName(name)
+		if value == "" || metrics.ValidateLabels(metrics.Labels{name: value}) != nil {
+			continue
+		}
+		if labels == nil {
+			labels = make(metrics.Labels)
+		}
+		labels[name] = value
+	}
+	return labels
+}
+
+func labelName(tag string) string {
+	name := []byte(tag)
+	for i, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		return "_" + string(name)
+	}
+	return string(name)
+}
@@ -0,0 +1,219 @@
+package statsd
+
+import (
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/collector"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want Line
+	}{
+		{line: "hits:1|c", want: Line{Name: "hits", Type: TypeCounter, Value: 1, SampleRate: 1}},
+		{line: "hits:2|c|@0.5", want: Line{Name: "hits", Type: TypeCounter, Value: 2, SampleRate: 0.5}},
+		{line: "temp:21.5|g", want: Line{Name: "temp", Type: TypeGauge, Value: 21.5, SampleRate: 1}},
+		{line: "temp:-3|g", want: Line{Name: "temp", Type: TypeGauge, Value: -3, Relative: true, SampleRate: 1}},
+		{line: "temp:+3|g", want: Line{Name: "temp", Type: TypeGauge, Value: 3, Relative: true, SampleRate: 1}},
+		{line: "api.latency:12|ms", want: Line{Name: "api.latency", Type: TypeTimer, Value: 12, SampleRate: 1}},
+		{line: "api.size:512|h", want: Line{Name: "api.size", Type: TypeTimer, Value: 512, SampleRate: 1}},
+		{line: "users:alice|s", want: Line{Name: "users", Type: TypeSet, Member: "alice", SampleRate: 1}},
+		{
+			line: "hits:1|c|@0.1|#env:prod,canary,service-name:api,9x:y,__name__:z",
+			want: Line{Name: "hits", Type: TypeCounter, Value: 1, SampleRate: 0.1, Tags: metrics.Labels{
+				"env": "prod", "canary": "true", "service_name": "api", "_9x": "y",
+			}},
+		},
+		{line: "hits:1|c|c:container-id", want: Line{Name: "hits", Type: TypeCounter, Value: 1, SampleRate: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := ParseLine(tt.line)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseLineRejectsInvalid(t *testing.T) {
+	for _, line := range []string{
+		"hits", ":1|c", "hits:1", "hits:x|c", "hits:1|x", "hits:|s", "hits:1|c|@0", "hits:1|c|@2", "a{b}:1|c",
+	} {
+		_, err := ParseLine(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func mustAdd(t *testing.T, a *Aggregator, lines ...string) {
+	for _, line := range lines {
+		parsed, err := ParseLine(line)
+		require.NoError(t, err, line)
+		a.Add(parsed)
+	}
+}
+
+func byKey(samples []collector.Sample) map[string]collector.Sample {
+	result := make(map[string]collector.Sample, len(samples))
+	for _, s := range samples {
+		result[s.MType+" "+metrics.SeriesKey(s.Name, s.Labels)] = s
+	}
+	return result
+}
+
+func keys(samples []collector.Sample) []string {
+	var result []string
+	for key := range byKey(samples) {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator()
+	mustAdd(t, a,
+		"hits:1|c", "hits:2|c|@0.5", "hits:1|c|#env:prod",
+		"temp:20|g", "temp:+5|g",
+		"lat:10|ms", "lat:20|ms", "lat:30|ms", "lat:40|ms|@0.5",
+		"users:alice|s", "users:bob|s", "users:alice|s",
+	)
+	samples := byKey(a.Flush())
+	assert.Equal(t, int64(5), samples["counter hits"].Delta)
+	assert.Equal(t, int64(1), samples[`counter hits{env="prod"}`].Delta)
+	assert.Equal(t, 25.0, samples["gauge temp"].Value)
+	assert.Equal(t, int64(5), samples["counter lat.count"].Delta)
+	assert.Equal(t, 10.0, samples["gauge lat.min"].Value)
+	assert.Equal(t, 40.0, samples["gauge lat.max"].Value)
+	assert.Equal(t, 25.0, samples["gauge lat.mean"].Value)
+	assert.Equal(t, 20.0, samples["gauge lat.p50"].Value)
+	assert.Equal(t, 40.0, samples["gauge lat.p99"].Value)
+	assert.Equal(t, 2.0, samples["gauge users"].Value)
+
+	mustAdd(t, a, "temp:-10|g")
+	assert.Equal(t, []string{"gauge temp"}, keys(a.Flush()), "every interval starts over")
+
+	mustAdd(t, a, "users:carol|s")
+	samples = byKey(a.Flush())
+	assert.Equal(t, 1.0, samples["gauge users"].Value)
+	assert.Empty(t, a.Flush())
+}
+
+func TestAggregatorRelativeGaugeKeepsBase(t *testing.T) {
+	a := NewAggregator()
+	mustAdd(t, a, "temp:20|g")
+	a.Flush()
+	mustAdd(t, a, "temp:-5|g")
+	assert.Equal(t, 15.0, byKey(a.Flush())["gauge temp"].Value)
+}
+
+func TestAggregatorForgetsIdleGauges(t *testing.T) {
+	a := NewAggregator()
+	mustAdd(t, a, "temp:20|g", "load:1|g")
+	a.Flush()
+	for i := 0; i < gaugeIdleFlushes-1; i++ {
+		mustAdd(t, a, "load:+1|g")
+		a.Flush()
+	}
+	assert.Len(t, a.gauges, 2)
+	a.Flush()
+	assert.Len(t, a.gauges, 1, "temp was idle for too long")
+
+	mustAdd(t, a, "temp:+5|g")
+	assert.Equal(t, 5.0, byKey(a.Flush())["gauge temp"].Value, "a forgotten gauge starts over")
+}
+
+func TestAggregatorLimitsSeries(t *testing.T) {
+	tests := []struct {
+		typ     string
+		sample  string
+		perLine int
+	}{
+		{typ: TypeCounter, sample: "counter m0", perLine: 1},
+		{typ: TypeGauge, sample: "gauge m0", perLine: 1},
+		{typ: TypeTimer, sample: "counter m0.count", perLine: 4 + len(timerPercentiles)},
+		{typ: TypeSet, sample: "gauge m0", perLine: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			a := NewAggregator()
+			for i := 0; i <= maxSeries; i++ {
+				a.Add(Line{Name: "m" + strconv.Itoa(i), Type: tt.typ, Value: 1, Member: "x", SampleRate: 1})
+			}
+			samples := byKey(a.Flush())
+			assert.Len(t, samples, maxSeries*tt.perLine)
+			assert.Contains(t, samples, tt.sample)
+		})
+	}
+}
+
+func TestAggregatorLimitsSetMembers(t *testing.T) {
+	a := NewAggregator()
+	for i := 0; i <= maxSetMembers; i++ {
+		a.Add(Line{Name: "users", Type: TypeSet, Member: strconv.Itoa(i), SampleRate: 1})
+	}
+	assert.Equal(t, float64(maxSetMembers), byKey(a.Flush())["gauge users"].Value)
+}
+
+func TestListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		address func(t *testing.T) string
+	}{
+		{name: "UDP", address: func(t *testing.T) string { return "udp://127.0.0.1:0" }},
+		{name: "Unixgram", address: func(t *testing.T) string {
+			return "unixgram://" + filepath.Join(t.TempDir(), "statsd.sock")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, address, err := ParseAddress(tt.address(t))
+			require.NoError(t, err)
+			a := NewAggregator()
+			l, err := Listen(network, address, a, zap.NewNop())
+			require.NoError(t, err)
+			done := make(chan error, 1)
+			go func() { done <- l.Serve() }()
+
+			conn, err := net.Dial(network, l.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("hits:1|c\nbroken\nhits:2|c|#env:prod\n"))
+			require.NoError(t, err)
+
+			var samples []collector.Sample
+			require.Eventually(t, func() bool {
+				samples = append(samples, a.Flush()...)
+				return len(samples) == 2
+			}, 5*time.Second, 5*time.Millisecond)
+			assert.Equal(t, []string{"counter hits", `counter hits{env="prod"}`}, keys(samples))
+
+			require.NoError(t, l.Close())
+			assert.NoError(t, <-done)
+		})
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	network, address, err := ParseAddress(":8125")
+	require.NoError(t, err)
+	assert.Equal(t, "udp", network)
+	assert.Equal(t, ":8125", address)
+
+	network, address, err = ParseAddress("unixgram:///run/statsd.sock")
+	require.NoError(t, err)
+	assert.Equal(t, "unixgram", network)
+	assert.Equal(t, "/run/statsd.sock", address)
+
+	_, _, err = ParseAddress("tcp://:8125")
+	assert.Error(t, err)
+}
@@ -0,0 +1,49 @@
+package storage
+
+// AppliedKeysLimit is the number of idempotency keys of applied batches a
+// storage remembers; older keys are forgotten.
+const AppliedKeysLimit = 10000
+
+// keyRing remembers the most recently added keys in the order they were
+// added. It is not safe for concurrent use.
+type keyRing struct {
+	slots map[string]int
+	ring  []string
+	next  int
+}
+
+func newKeyRing(size int) *keyRing {
+	return &keyRing{
+		slots: make(map[string]int, size),
+		ring:  make([]string, size),
+	}
+}
+
+func (r *keyRing) Contains(key string) bool {
+	_, ok := r.slots[key]
+	return ok
+}
+
+// Add records key. The oldest key is forgotten once the ring is full.
+func (r *keyRing) Add(key string) {
+	if r.Contains(key) {
+		return
+	}
+	if old := r.ring[r.next]; old != "" && r.slots[old] == r.next {
+		delete(r.slots, old)
+	}
+	r.ring[r.next] = key
+	r.slots[key] = r.next
+	r.next = (r.next + 1) % len(r.ring)
+}
+
+// Keys returns the keys oldest first.
+func (r *keyRing) Keys() []string {
+	keys := make([]string, 0, len(r.slots))
+	for i := range r.ring {
+		if key := r.ring[(r.next+i)%len(r.ring)]; key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var (
+	gaugeBucket   = []byte("gauges")
+	counterBucket = []byte("counters")
+	// appliedBucket maps idempotency keys of applied batches to their
+	// sequence number, appliedOrderBucket the numbers back to the keys.
+	appliedBucket      = []byte("applied_keys")
+	appliedOrderBucket = []byte("applied_order")
+)
+
+// BoltStorage keeps metrics in a bbolt file. Every update is a committed
+// transaction, so there is nothing to save periodically, and reads run on
+// a consistent view of the file.
+type BoltStorage struct {
+	db     *bolt.DB
+	logger *zap.Logger
+}
+
+func NewBoltStorage(path string, logger *zap.Logger) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{gaugeBucket, counterBucket, appliedBucket, appliedOrderBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &BoltStorage{db: db, logger: logger}, nil
+}
+
+func (s *BoltStorage) GaugeUpdate(key string, value float64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(gaugeBucket).Put([]byte(key), encodeUint64(math.Float64bits(value)))
+	})
+}
+
+// CounterUpdate reads and writes the counter in one transaction; bbolt
+// runs one writer at a time, so increments never overwrite each other.
+func (s *BoltStorage) CounterUpdate(key string, value int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return addCounter(tx.Bucket(counterBucket), key, value)
+	})
+}
+
+// BatchUpdate applies all gauges and counter deltas in one transaction.
+func (s *BoltStorage) BatchUpdate(gauges map[string]float64, counters map[string]int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return applyBatch(tx, gauges, counters)
+	})
+}
+
+// BatchUpdateOnce records the key in the transaction of the batch. bbolt
+// runs one writer at a time, so a concurrent duplicate sees the outcome of
+// the first attempt.
+func (s *BoltStorage) BatchUpdateOnce(key string, gauges map[string]float64, counters map[string]int64) (bool, error) {
+	applied := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if key == "" {
+			applied = true
+			return applyBatch(tx, gauges, counters)
+		}
+		keys, order := tx.Bucket(appliedBucket), tx.Bucket(appliedOrderBucket)
+		if keys.Get([]byte(key)) != nil {
+			return nil
+		}
+		if err := applyBatch(tx, gauges, counters); err != nil {
+			return err
+		}
+		seq, err := order.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := keys.Put([]byte(key), encodeUint64(seq)); err != nil {
+			return err
+		}
+		if err := order.Put(encodeUint64(seq), []byte(key)); err != nil {
+			return err
+		}
+		// Forget the oldest keys beyond the limit.
+		cursor := order.Cursor()
+		for k, v := cursor.First(); k != nil && binary.BigEndian.Uint64(k)+AppliedKeysLimit <= seq; k, v = cursor.First() {
+			if err := keys.Delete(v); err != nil {
+				return err
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		applied = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return applied, nil
+}
+
+func applyBatch(tx *bolt.Tx, gauges map[string]float64, counters map[string]int64) error {
+	gaugeStore := tx.Bucket(gaugeBucket)
+	for key, value := range gauges {
+		if err := gaugeStore.Put([]byte(key), encodeUint64(math.Float64bits(value))); err != nil {
+			return err
+		}
+	}
+	counterStore := tx.Bucket(counterBucket)
+	for key, value := range counters {
+		if err := addCounter(counterStore, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addCounter(bucket *bolt.Bucket, key string, value int64) error {
+	if current := bucket.Get([]byte(key)); current != nil {
+		value += int64(binary.BigEndian.Uint64(current))
+	}
+	return bucket.Put([]byte(key), encodeUint64(uint64(value)))
+}
+
+// Snapshot reads both buckets in one read transaction. The generation is
+// the ID of the last committed write transaction.
+func (s *BoltStorage) Snapshot() (*Snapshot, error) {
+	var snapshot *Snapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		gauges := make(map[string]float64)
+		err := tx.Bucket(gaugeBucket).ForEach(func(k, v []byte) error {
+			gauges[string(k)] = math.Float64frombits(binary.BigEndian.Uint64(v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		counters := make(map[string]int64)
+		err = tx.Bucket(counterBucket).ForEach(func(k, v []byte) error {
+			counters[string(k)] = int64(binary.BigEndian.Uint64(v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		snapshot = NewSnapshot(uint64(tx.ID()), gauges, counters)
+		return nil
+	})
+	return snapshot, err
+}
+
+func (s *BoltStorage) GaugeMap() map[string]float64 {
+	result := make(map[string]float64)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(gaugeBucket).ForEach(func(k, v []byte) error {
+			result[string(k)] = math.Float64frombits(binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+	if err != nil {
+		s.logger.Error("failed to read gauges", zap.Error(err))
+	}
+	return result
+}
+
+func (s *BoltStorage) CounterMap() map[string]int64 {
+	result := make(map[string]int64)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(counterBucket).ForEach(func(k, v []byte) error {
+			result[string(k)] = int64(binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+	if err != nil {
+		s.logger.Error("failed to read counters", zap.Error(err))
+	}
+	return result
+}
+
+func (s *BoltStorage) GetGaugeMetric(metricName string) (float64, bool) {
+	var value float64
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(gaugeBucket).Get([]byte(metricName)); v != nil {
+			value, ok = math.Float64frombits(binary.BigEndian.Uint64(v)), true
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("failed to read gauge", zap.String("name", metricName), zap.Error(err))
+	}
+	return value, ok
+}
+
+func (s *BoltStorage) GetCounterMetric(metricName string) (int64, bool) {
+	var value int64
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(counterBucket).Get([]byte(metricName)); v != nil {
+			value, ok = int64(binary.BigEndian.Uint64(v)), true
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("failed to read counter", zap.String("name", metricName), zap.Error(err))
+	}
+	return value, ok
+}
+
+// PeriodicSave returns at once, every update is already on disk.
+func (s *BoltStorage) PeriodicSave(ctx context.Context, saveInterval int64) error {
+	return nil
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+func encodeUint64(value uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	return buf
+}
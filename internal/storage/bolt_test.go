@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBoltStoragePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.bolt")
+	s, err := NewBoltStorage(path, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, s.GaugeUpdate("Alloc", -1.5))
+	require.NoError(t, s.CounterUpdate("PollCount", 2))
+	require.NoError(t, s.BatchUpdate(map[string]float64{"Free": 3}, map[string]int64{"PollCount": -5}))
+	require.NoError(t, s.Close())
+
+	s, err = NewBoltStorage(path, zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, map[string]float64{"Alloc": -1.5, "Free": 3}, s.GaugeMap())
+	assert.Equal(t, map[string]int64{"PollCount": -3}, s.CounterMap())
+
+	_, ok := s.GetGaugeMetric("Missing")
+	assert.False(t, ok)
+}
+
+func TestBoltStorageConcurrentIncrements(t *testing.T) {
+	s, err := NewBoltStorage(filepath.Join(t.TempDir(), "metrics.bolt"), zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+
+	const writers, increments = 8, 25
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				assert.NoError(t, s.CounterUpdate("PollCount", 1))
+				assert.NoError(t, s.BatchUpdate(nil, map[string]int64{"PollCount": 1}))
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, ok := s.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, int64(2*writers*increments), value)
+}
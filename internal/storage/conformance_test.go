@@ -0,0 +1,111 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/personage-hub/metrics-tracker/internal/dumper"
+	"github.com/personage-hub/metrics-tracker/internal/storage"
+	"github.com/personage-hub/metrics-tracker/internal/storage/storagetest"
+	"github.com/personage-hub/metrics-tracker/internal/wal"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memStorage remembers where a MemStorage keeps its files so the suite can
+// reopen it.
+type memStorage struct {
+	*storage.MemStorage
+	dir string
+	wal *wal.Log
+}
+
+func openMem(t *testing.T, dir string, withWAL bool) memStorage {
+	m, _ := storage.NewMemStorage(dumper.NewDumper(filepath.Join(dir, "dump.json")), true)
+	s := memStorage{MemStorage: m, dir: dir}
+	if withWAL {
+		w, err := wal.Open(filepath.Join(dir, "wal"), wal.Options{})
+		require.NoError(t, err)
+		t.Cleanup(func() { w.Close() })
+		require.NoError(t, m.AttachWAL(w, true))
+		s.wal = w
+	}
+	return s
+}
+
+func TestMemStorageConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Backend{
+		Open: func(t *testing.T) storage.Storage {
+			return openMem(t, t.TempDir(), false)
+		},
+		Reopen: func(t *testing.T, s storage.Storage) storage.Storage {
+			m := s.(memStorage)
+			require.NoError(t, m.Save())
+			return openMem(t, m.dir, false)
+		},
+	})
+}
+
+func TestMemStorageWithWALConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Backend{
+		Open: func(t *testing.T) storage.Storage {
+			return openMem(t, t.TempDir(), true)
+		},
+		// Reopening without a snapshot, as after a crash, relies on the log alone.
+		Reopen: func(t *testing.T, s storage.Storage) storage.Storage {
+			m := s.(memStorage)
+			require.NoError(t, m.wal.Close())
+			return openMem(t, m.dir, true)
+		},
+	})
+}
+
+type dbStorage struct {
+	storage.Storage
+	path  string
+	close func() error
+}
+
+func TestSQLiteStorageConformance(t *testing.T) {
+	open := func(t *testing.T, path string) storage.Storage {
+		s, err := storage.NewSQLiteStorage(path, zap.NewNop())
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return dbStorage{Storage: s, path: path, close: s.Close}
+	}
+	storagetest.Run(t, storagetest.Backend{
+		Open: func(t *testing.T) storage.Storage {
+			return open(t, filepath.Join(t.TempDir(), "metrics.db"))
+		},
+		Reopen: func(t *testing.T, s storage.Storage) storage.Storage {
+			db := s.(dbStorage)
+			require.NoError(t, db.close())
+			return open(t, db.path)
+		},
+	})
+}
+
+func TestBoltStorageConformance(t *testing.T) {
+	open := func(t *testing.T, path string) storage.Storage {
+		s, err := storage.NewBoltStorage(path, zap.NewNop())
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return dbStorage{Storage: s, path: path, close: s.Close}
+	}
+	storagetest.Run(t, storagetest.Backend{
+		Open: func(t *testing.T) storage.Storage {
+			return open(t, filepath.Join(t.TempDir(), "metrics.bolt"))
+		},
+		Reopen: func(t *testing.T, s storage.Storage) storage.Storage {
+			db := s.(dbStorage)
+			require.NoError(t, db.close())
+			return open(t, db.path)
+		},
+	})
+}
+
+func TestDumpFileConformance(t *testing.T) {
+	storagetest.RunDumper(t, func(t *testing.T) dumper.Dumper {
+		return dumper.NewDumper(filepath.Join(t.TempDir(), "dump.json"))
+	})
+}
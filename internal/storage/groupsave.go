@@ -0,0 +1,50 @@
+package storage
+
+import "sync"
+
+// groupSaver runs save on behalf of concurrent callers. Callers that arrive
+// while a save is in progress are served together by the next one, so a
+// burst of updates costs a couple of saves instead of one per update.
+type groupSaver struct {
+	save func() error
+
+	mu      sync.Mutex
+	pending []chan error
+	running bool
+}
+
+func newGroupSaver(save func() error) *groupSaver {
+	return &groupSaver{save: save}
+}
+
+// Save returns once a save that started after the call has finished, with
+// the error of that save.
+func (g *groupSaver) Save() error {
+	done := make(chan error, 1)
+	g.mu.Lock()
+	g.pending = append(g.pending, done)
+	if !g.running {
+		g.running = true
+		go g.run()
+	}
+	g.mu.Unlock()
+	return <-done
+}
+
+func (g *groupSaver) run() {
+	g.mu.Lock()
+	for len(g.pending) > 0 {
+		waiting := g.pending
+		g.pending = nil
+		g.mu.Unlock()
+
+		err := g.save()
+		for _, done := range waiting {
+			done <- err
+		}
+
+		g.mu.Lock()
+	}
+	g.running = false
+	g.mu.Unlock()
+}
@@ -0,0 +1,76 @@
+package storage
+
+import "sort"
+
+// Snapshot is an immutable view of all metrics at one point in time.
+// Snapshots with the same generation from one storage hold the same data.
+type Snapshot struct {
+	generation uint64
+	gauges     map[string]float64
+	counters   map[string]int64
+	// appliedKeys are the idempotency keys a MemStorage dumps with the data.
+	appliedKeys []string
+}
+
+// NewSnapshot takes ownership of the maps; they must not be changed later.
+func NewSnapshot(generation uint64, gauges map[string]float64, counters map[string]int64) *Snapshot {
+	if gauges == nil {
+		gauges = map[string]float64{}
+	}
+	if counters == nil {
+		counters = map[string]int64{}
+	}
+	return &Snapshot{generation: generation, gauges: gauges, counters: counters}
+}
+
+func (s *Snapshot) Generation() uint64 {
+	return s.generation
+}
+
+func (s *Snapshot) Gauge(name string) (float64, bool) {
+	value, ok := s.gauges[name]
+	return value, ok
+}
+
+func (s *Snapshot) Counter(name string) (int64, bool) {
+	value, ok := s.counters[name]
+	return value, ok
+}
+
+// Gauges returns a copy of all gauges.
+func (s *Snapshot) Gauges() map[string]float64 {
+	result := make(map[string]float64, len(s.gauges))
+	for name, value := range s.gauges {
+		result[name] = value
+	}
+	return result
+}
+
+// Counters returns a copy of all counters.
+func (s *Snapshot) Counters() map[string]int64 {
+	result := make(map[string]int64, len(s.counters))
+	for name, value := range s.counters {
+		result[name] = value
+	}
+	return result
+}
+
+// GaugeNames returns the gauge names in sorted order.
+func (s *Snapshot) GaugeNames() []string {
+	names := make([]string, 0, len(s.gauges))
+	for name := range s.gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CounterNames returns the counter names in sorted order.
+func (s *Snapshot) CounterNames() []string {
+	names := make([]string, 0, len(s.counters))
+	for name := range s.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
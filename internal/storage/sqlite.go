@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order; the number applied so far is kept
+// in the user_version pragma of the database.
+var sqliteMigrations = []string{
+	`CREATE TABLE gauges (
+		name  TEXT PRIMARY KEY,
+		value REAL NOT NULL
+	);
+	CREATE TABLE counters (
+		name  TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);`,
+	// The generation row changes with every write and dates snapshots.
+	`CREATE TABLE generation (value INTEGER NOT NULL);
+	INSERT INTO generation (value) VALUES (0);
+	CREATE TRIGGER gauges_insert AFTER INSERT ON gauges BEGIN UPDATE generation SET value = value + 1; END;
+	CREATE TRIGGER gauges_update AFTER UPDATE ON gauges BEGIN UPDATE generation SET value = value + 1; END;
+	CREATE TRIGGER counters_insert AFTER INSERT ON counters BEGIN UPDATE generation SET value = value + 1; END;
+	CREATE TRIGGER counters_update AFTER UPDATE ON counters BEGIN UPDATE generation SET value = value + 1; END;`,
+	// Idempotency keys of applied batches, oldest first by seq.
+	`CREATE TABLE applied_keys (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		key TEXT NOT NULL UNIQUE
+	);`,
+}
+
+// SQLiteStorage keeps metrics in an SQLite database. Every update is
+// committed before it returns, so there is nothing to save periodically.
+type SQLiteStorage struct {
+	db     *sql.DB
+	logger *zap.Logger
+
+	setGauge    *sql.Stmt
+	addCounter  *sql.Stmt
+	getGauge    *sql.Stmt
+	getCounter  *sql.Stmt
+	allGauges   *sql.Stmt
+	allCounters *sql.Stmt
+	generation  *sql.Stmt
+	addKey      *sql.Stmt
+	pruneKeys   *sql.Stmt
+}
+
+func NewSQLiteStorage(path string, logger *zap.Logger) (*SQLiteStorage, error) {
+	// Immediate transactions take the write lock up front, so concurrent
+	// batches wait on busy_timeout instead of failing on lock upgrade.
+	dsn := "file:" + path + "?_txlock=immediate" +
+		"&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	s := &SQLiteStorage{db: db, logger: logger}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.prepare(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLiteStorage) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than supported %d", version, len(sqliteMigrations))
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) prepare() error {
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.setGauge, `INSERT INTO gauges (name, value) VALUES (?, ?)
+			ON CONFLICT (name) DO UPDATE SET value = excluded.value`},
+		{&s.addCounter, `INSERT INTO counters (name, value) VALUES (?, ?)
+			ON CONFLICT (name) DO UPDATE SET value = value + excluded.value`},
+		{&s.getGauge, `SELECT value FROM gauges WHERE name = ?`},
+		{&s.getCounter, `SELECT value FROM counters WHERE name = ?`},
+		{&s.allGauges, `SELECT name, value FROM gauges`},
+		{&s.allCounters, `SELECT name, value FROM counters`},
+		{&s.generation, `SELECT value FROM generation`},
+		{&s.addKey, `INSERT INTO applied_keys (key) VALUES (?) ON CONFLICT (key) DO NOTHING`},
+		{&s.pruneKeys, `DELETE FROM applied_keys WHERE seq <= (SELECT MAX(seq) FROM applied_keys) - ?`},
+	}
+	for _, st := range statements {
+		stmt, err := s.db.Prepare(st.query)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		*st.stmt = stmt
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GaugeUpdate(key string, value float64) error {
+	_, err := s.setGauge.Exec(key, value)
+	return err
+}
+
+// CounterUpdate adds value in SQL, so concurrent increments never overwrite
+// each other.
+func (s *SQLiteStorage) CounterUpdate(key string, value int64) error {
+	_, err := s.addCounter.Exec(key, value)
+	return err
+}
+
+// BatchUpdate applies all gauges and counter deltas in one transaction.
+func (s *SQLiteStorage) BatchUpdate(gauges map[string]float64, counters map[string]int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.applyBatch(tx, gauges, counters); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// BatchUpdateOnce records the key in the transaction of the batch. The
+// transaction takes the write lock up front, so a concurrent duplicate
+// waits and then finds the key committed, or gone with a rolled back batch.
+func (s *SQLiteStorage) BatchUpdateOnce(key string, gauges map[string]float64, counters map[string]int64) (bool, error) {
+	if key == "" {
+		return true, s.BatchUpdate(gauges, counters)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	result, err := tx.Stmt(s.addKey).Exec(key)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if added, err := result.RowsAffected(); err != nil || added == 0 {
+		tx.Rollback()
+		return false, err
+	}
+	if err := s.applyBatch(tx, gauges, counters); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if _, err := tx.Stmt(s.pruneKeys).Exec(AppliedKeysLimit); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *SQLiteStorage) applyBatch(tx *sql.Tx, gauges map[string]float64, counters map[string]int64) error {
+	setGauge := tx.Stmt(s.setGauge)
+	for key, value := range gauges {
+		if _, err := setGauge.Exec(key, value); err != nil {
+			return err
+		}
+	}
+	addCounter := tx.Stmt(s.addCounter)
+	for key, value := range counters {
+		if _, err := addCounter.Exec(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot reads both tables in one read transaction.
+func (s *SQLiteStorage) Snapshot() (*Snapshot, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var generation uint64
+	if err := tx.Stmt(s.generation).QueryRow().Scan(&generation); err != nil {
+		return nil, fmt.Errorf("failed to read generation: %w", err)
+	}
+	gauges := make(map[string]float64)
+	if err := scanRows(tx.Stmt(s.allGauges), func(rows *sql.Rows) error {
+		var name string
+		var value float64
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		gauges[name] = value
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read gauges: %w", err)
+	}
+	counters := make(map[string]int64)
+	if err := scanRows(tx.Stmt(s.allCounters), func(rows *sql.Rows) error {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		counters[name] = value
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read counters: %w", err)
+	}
+	return NewSnapshot(generation, gauges, counters), nil
+}
+
+func scanRows(stmt *sql.Stmt, scan func(rows *sql.Rows) error) error {
+	rows, err := stmt.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStorage) GaugeMap() map[string]float64 {
+	result := make(map[string]float64)
+	rows, err := s.allGauges.Query()
+	if err != nil {
+		s.logger.Error("failed to read gauges", zap.Error(err))
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var value float64
+		if err := rows.Scan(&name, &value); err != nil {
+			s.logger.Error("failed to read gauges", zap.Error(err))
+			return result
+		}
+		result[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error("failed to read gauges", zap.Error(err))
+	}
+	return result
+}
+
+func (s *SQLiteStorage) CounterMap() map[string]int64 {
+	result := make(map[string]int64)
+	rows, err := s.allCounters.Query()
+	if err != nil {
+		s.logger.Error("failed to read counters", zap.Error(err))
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			s.logger.Error("failed to read counters", zap.Error(err))
+			return result
+		}
+		result[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error("failed to read counters", zap.Error(err))
+	}
+	return result
+}
+
+func (s *SQLiteStorage) GetGaugeMetric(metricName string) (float64, bool) {
+	var value float64
+	err := s.getGauge.QueryRow(metricName).Scan(&value)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			s.logger.Error("failed to read gauge", zap.String("name", metricName), zap.Error(err))
+		}
+		return 0, false
+	}
+	return value, true
+}
+
+func (s *SQLiteStorage) GetCounterMetric(metricName string) (int64, bool) {
+	var value int64
+	err := s.getCounter.QueryRow(metricName).Scan(&value)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			s.logger.Error("failed to read counter", zap.String("name", metricName), zap.Error(err))
+		}
+		return 0, false
+	}
+	return value, true
+}
+
+// PeriodicSave returns at once, every update is already on disk.
+func (s *SQLiteStorage) PeriodicSave(ctx context.Context, saveInterval int64) error {
+	return nil
+}
+
+func (s *SQLiteStorage) Close() error {
+	for _, stmt := range []*sql.Stmt{s.setGauge, s.addCounter, s.getGauge, s.getCounter, s.allGauges, s.allCounters, s.generation, s.addKey, s.pruneKeys} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSQLiteStoragePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	s, err := NewSQLiteStorage(path, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, s.GaugeUpdate("Alloc", 1.5))
+	require.NoError(t, s.CounterUpdate("PollCount", 2))
+	require.NoError(t, s.Close())
+
+	// Reopening runs the migrations again, which must leave the data alone.
+	s, err = NewSQLiteStorage(path, zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+	var version int
+	require.NoError(t, s.db.QueryRow("PRAGMA user_version").Scan(&version))
+	assert.Equal(t, len(sqliteMigrations), version)
+
+	value, ok := s.GetGaugeMetric("Alloc")
+	require.True(t, ok)
+	assert.Equal(t, 1.5, value)
+	require.NoError(t, s.CounterUpdate("PollCount", 3))
+	assert.Equal(t, map[string]int64{"PollCount": 5}, s.CounterMap())
+
+	_, ok = s.GetCounterMetric("Missing")
+	assert.False(t, ok)
+}
+
+func TestSQLiteStorageConcurrentIncrements(t *testing.T) {
+	s, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "metrics.db"), zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+
+	const writers, increments = 8, 25
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				assert.NoError(t, s.CounterUpdate("PollCount", 1))
+				assert.NoError(t, s.BatchUpdate(nil, map[string]int64{"PollCount": 1}))
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, ok := s.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, int64(2*writers*increments), value)
+}
+
+func TestSQLiteStorageBatchRollsBack(t *testing.T) {
+	s, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "metrics.db"), zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// SQLite stores NaN as NULL, which the schema rejects midway through the batch.
+	err = s.BatchUpdate(map[string]float64{"Broken": math.NaN()}, map[string]int64{"PollCount": 1})
+	require.Error(t, err)
+	assert.Empty(t, s.GaugeMap())
+	assert.Empty(t, s.CounterMap())
+}
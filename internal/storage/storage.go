@@ -1,65 +1,326 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"github.com/cornelk/hashmap"
 	"github.com/personage-hub/metrics-tracker/internal/dumper"
-	"go.uber.org/zap"
-	"log"
+	"github.com/personage-hub/metrics-tracker/internal/wal"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Storage keeps gauges and counters by series key, as built by
+// metrics.SeriesKey: the metric ID followed by its labels, if any. An
+// unlabeled metric is keyed by its plain ID, unless the ID holds braces or
+// backslashes, which are escaped.
 type Storage interface {
-	GaugeUpdate(key string, value float64)
-	CounterUpdate(key string, value int64)
+	GaugeUpdate(key string, value float64) error
+	CounterUpdate(key string, value int64) error
 	GaugeMap() map[string]float64
 	CounterMap() map[string]int64
 	GetGaugeMetric(metricName string) (float64, bool)
 	GetCounterMetric(metricName string) (int64, bool)
-	PeriodicSave(saveInterval int64)
+	BatchUpdate(gauges map[string]float64, counters map[string]int64) error
+	// BatchUpdateOnce is BatchUpdate for a batch with an idempotency key: a
+	// batch whose key was applied before is skipped, which it reports. The
+	// key is stored with the batch, so it persists exactly like the batch
+	// does. Concurrent calls with one key wait for each other. An empty key
+	// always applies.
+	BatchUpdateOnce(key string, gauges map[string]float64, counters map[string]int64) (bool, error)
+	// Snapshot returns all metrics as of a single point in time.
+	Snapshot() (*Snapshot, error)
+	PeriodicSave(ctx context.Context, saveInterval int64) error
 }
 
 type MemStorage struct {
-	gauge   *hashmap.Map[string, float64]
-	counter *hashmap.Map[string, int64]
+	// mu is held for reading by single updates and map reads and for writing
+	// by BatchUpdate, so a batch is never observed half-applied.
+	mu    sync.RWMutex
+	gauge *hashmap.Map[string, float64]
+	// counter holds one atomic cell per key, so concurrent increments of the
+	// same counter never lose an update.
+	counter *hashmap.Map[string, *atomic.Int64]
 	keeper  dumper.Dumper
+	// saver is set in synchronous mode, every update then returns only after
+	// a dump that includes it has been written.
+	saver *groupSaver
+	// wal, when attached, logs the result of every update before it becomes
+	// visible. walMu keeps the log in the order updates are applied.
+	wal   *wal.Log
+	walMu sync.Mutex
+	// generation grows with every update; snapshot caches the last
+	// snapshot so reads between updates do not copy the maps again.
+	generation atomic.Uint64
+	snapshot   atomic.Pointer[Snapshot]
+	// applied holds the keys of the last AppliedKeysLimit keyed batches.
+	// It changes under mu held for writing and is saved with the dumps.
+	applied *keyRing
 }
 
 func NewMemStorage(k dumper.Dumper, restore bool) (*MemStorage, error) {
 	m := &MemStorage{
 		gauge:   hashmap.New[string, float64](),
-		counter: hashmap.New[string, int64](),
+		counter: hashmap.New[string, *atomic.Int64](),
 		keeper:  k,
+		applied: newKeyRing(AppliedKeysLimit),
 	}
 	if !restore {
 		return m, nil
 	}
-	gaugeData, counterData, err := m.keeper.RestoreData()
+	var gaugeData map[string]float64
+	var counterData map[string]int64
+	var err error
+	if keyKeeper, ok := k.(dumper.KeyDumper); ok {
+		var keys []string
+		gaugeData, counterData, keys, err = keyKeeper.RestoreDataWithKeys()
+		for _, key := range keys {
+			m.applied.Add(key)
+		}
+	} else {
+		gaugeData, counterData, err = m.keeper.RestoreData()
+	}
 	if err != nil {
 		return m, err
 	}
 	for metricName, metricValue := range gaugeData {
-		m.GaugeUpdate(metricName, metricValue)
+		m.gauge.Set(metricName, metricValue)
 	}
 	for metricName, metricValue := range counterData {
-		m.CounterUpdate(metricName, metricValue)
+		m.counterAdd(metricName, metricValue)
 	}
 	return m, nil
 }
 
-func (m *MemStorage) GaugeUpdate(key string, value float64) {
-	m.gauge.Set(key, value)
+func (m *MemStorage) GaugeUpdate(key string, value float64) error {
+	var err error
+	m.mu.RLock()
+	if m.wal == nil {
+		m.gauge.Set(key, value)
+		m.generation.Add(1)
+	} else {
+		err = m.update("", map[string]float64{key: value}, nil)
+	}
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return m.commit()
+}
+
+func (m *MemStorage) CounterUpdate(key string, value int64) error {
+	var err error
+	m.mu.RLock()
+	if m.wal == nil {
+		m.counterAdd(key, value)
+		m.generation.Add(1)
+	} else {
+		err = m.update("", nil, map[string]int64{key: value})
+	}
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return m.commit()
+}
+
+// BatchUpdate applies all gauges and counter deltas as a single unit:
+// concurrent readers see either none or all of them.
+func (m *MemStorage) BatchUpdate(gauges map[string]float64, counters map[string]int64) error {
+	m.mu.Lock()
+	err := m.update("", gauges, counters)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return m.commit()
+}
+
+func (m *MemStorage) BatchUpdateOnce(key string, gauges map[string]float64, counters map[string]int64) (bool, error) {
+	m.mu.Lock()
+	if key != "" && m.applied.Contains(key) {
+		m.mu.Unlock()
+		// In synchronous mode the first attempt may still be waiting for
+		// its dump; the duplicate reports success only once it is written.
+		return false, m.commit()
+	}
+	err := m.update(key, gauges, counters)
+	m.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, m.commit()
+}
+
+// update sets gauges and adds counter deltas, records a non-empty key as
+// applied, which needs mu held for writing, and advances the generation.
+// With a WAL attached the resulting values and the key are logged first as
+// one record, and nothing changes if that fails. The generation then advances while
+// walMu is still held, so a Save rotating the log after the record never
+// takes a cached snapshot without it.
+func (m *MemStorage) update(batchKey string, gauges map[string]float64, counters map[string]int64) error {
+	if m.wal == nil {
+		for key, value := range gauges {
+			m.gauge.Set(key, value)
+		}
+		for key, value := range counters {
+			m.counterAdd(key, value)
+		}
+		if batchKey != "" {
+			m.applied.Add(batchKey)
+		}
+		m.generation.Add(1)
+		return nil
+	}
+
+	m.walMu.Lock()
+	defer m.walMu.Unlock()
+	ops := make([]wal.Op, 0, len(gauges)+len(counters))
+	for key, value := range gauges {
+		ops = append(ops, wal.Op{Kind: wal.KindGauge, Name: key, Value: value})
+	}
+	totals := make(map[string]int64, len(counters))
+	for key, value := range counters {
+		var current int64
+		if cell, ok := m.counter.Get(key); ok {
+			current = cell.Load()
+		}
+		totals[key] = current + value
+		ops = append(ops, wal.Op{Kind: wal.KindCounter, Name: key, Total: current + value})
+	}
+	if batchKey != "" {
+		ops = append(ops, wal.Op{Kind: wal.KindKey, Name: batchKey})
+	}
+	if err := m.wal.Append(ops...); err != nil {
+		return err
+	}
+	for key, value := range gauges {
+		m.gauge.Set(key, value)
+	}
+	for key, total := range totals {
+		m.counterCell(key).Store(total)
+	}
+	if batchKey != "" {
+		m.applied.Add(batchKey)
+	}
+	m.generation.Add(1)
+	return nil
+}
+
+// AttachWAL logs every later update to w. With replay set the records in w
+// are applied on top of the restored snapshot, otherwise w is cleared. It
+// must be called before the storage is shared.
+func (m *MemStorage) AttachWAL(w *wal.Log, replay bool) error {
+	if !replay {
+		if err := w.Reset(); err != nil {
+			return err
+		}
+		m.wal = w
+		return nil
+	}
+	err := w.Replay(func(op wal.Op) {
+		switch op.Kind {
+		case wal.KindGauge:
+			m.gauge.Set(op.Name, op.Value)
+		case wal.KindCounter:
+			m.counterCell(op.Name).Store(op.Total)
+		case wal.KindKey:
+			m.applied.Add(op.Name)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replay wal: %w", err)
+	}
+	m.wal = w
+	return nil
 }
 
-func (m *MemStorage) CounterUpdate(key string, value int64) {
-	current, ok := m.counter.Get(key)
-	if !ok {
-		m.counter.Set(key, value)
+// commit saves the current data in synchronous mode. It must be called
+// without holding mu, since the dump reads the maps under it.
+func (m *MemStorage) commit() error {
+	if m.saver == nil {
+		return nil
+	}
+	return m.saver.Save()
+}
+
+// Save writes a snapshot through the dumper. With a WAL attached, the log
+// segments the snapshot covers are removed afterwards.
+func (m *MemStorage) Save() error {
+	var mark uint64
+	if m.wal != nil {
+		// Updates are applied under walMu, so everything logged before the
+		// rotation is visible to the snapshot below.
+		m.walMu.Lock()
+		var err error
+		mark, err = m.wal.Rotate()
+		m.walMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	snapshot, err := m.Snapshot()
+	if err != nil {
+		return err
+	}
+	if keyKeeper, ok := m.keeper.(dumper.KeyDumper); ok {
+		err = keyKeeper.SaveDataWithKeys(snapshot.Gauges(), snapshot.Counters(), snapshot.appliedKeys)
 	} else {
-		m.counter.Set(key, current+value)
+		err = m.keeper.SaveData(snapshot.Gauges(), snapshot.Counters())
+	}
+	if err != nil {
+		return err
+	}
+	if m.wal != nil {
+		return m.wal.RemoveBefore(mark)
 	}
+	return nil
+}
+
+func (m *MemStorage) counterAdd(key string, value int64) {
+	m.counterCell(key).Add(value)
+}
+
+// counterCell returns the cell of key, creating it on first use. Racing
+// creators all get the cell that was inserted first. GetOrInsert is not
+// used since in hashmap v1.0.8 it leaves the new key out of Range.
+func (m *MemStorage) counterCell(key string) *atomic.Int64 {
+	for {
+		if cell, ok := m.counter.Get(key); ok {
+			return cell
+		}
+		m.counter.Insert(key, new(atomic.Int64))
+	}
+}
+
+// Snapshot copies the maps while updates are held off, so a batch is either
+// fully in it or not at all.
+func (m *MemStorage) Snapshot() (*Snapshot, error) {
+	if cached := m.snapshot.Load(); cached != nil && cached.generation == m.generation.Load() {
+		return cached, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gauges := make(map[string]float64, m.gauge.Len())
+	m.gauge.Range(func(key string, value float64) bool {
+		gauges[key] = value
+		return true
+	})
+	counters := make(map[string]int64, m.counter.Len())
+	m.counter.Range(func(key string, cell *atomic.Int64) bool {
+		counters[key] = cell.Load()
+		return true
+	})
+	snapshot := NewSnapshot(m.generation.Load(), gauges, counters)
+	snapshot.appliedKeys = m.applied.Keys()
+	m.snapshot.Store(snapshot)
+	return snapshot, nil
 }
 
 func (m *MemStorage) GaugeMap() map[string]float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	resultMap := make(map[string]float64)
 	m.gauge.Range(func(key string, value float64) bool {
 		resultMap[key] = value
@@ -69,9 +330,11 @@ func (m *MemStorage) GaugeMap() map[string]float64 {
 }
 
 func (m *MemStorage) CounterMap() map[string]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	resultMap := make(map[string]int64)
-	m.counter.Range(func(key string, value int64) bool {
-		resultMap[key] = value
+	m.counter.Range(func(key string, cell *atomic.Int64) bool {
+		resultMap[key] = cell.Load()
 		return true
 	})
 	return resultMap
@@ -86,23 +349,32 @@ func (m *MemStorage) GetGaugeMetric(metricName string) (float64, bool) {
 }
 
 func (m *MemStorage) GetCounterMetric(metricName string) (int64, bool) {
-	value, ok := m.counter.Get(metricName)
+	cell, ok := m.counter.Get(metricName)
 	if ok {
-		return value, true
+		return cell.Load(), true
 	}
 	return 0, false
 }
 
-func (m *MemStorage) PeriodicSave(saveInterval int64) {
+// PeriodicSave dumps the data every saveInterval seconds until ctx is done
+// or a dump fails. A zero interval switches the storage to synchronous mode
+// instead and returns at once.
+func (m *MemStorage) PeriodicSave(ctx context.Context, saveInterval int64) error {
+	if saveInterval <= 0 {
+		m.saver = newGroupSaver(m.Save)
+		return nil
+	}
 	tickerSave := time.NewTicker(time.Duration(saveInterval) * time.Second)
 	defer tickerSave.Stop()
 
-	for range tickerSave.C {
-		gaugeData := m.GaugeMap()
-		counterData := m.CounterMap()
-		err := m.keeper.SaveData(gaugeData, counterData)
-		if err != nil {
-			log.Fatal("fail saving data to dump", zap.Error(err))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tickerSave.C:
+			if err := m.Save(); err != nil {
+				return fmt.Errorf("fail saving data to dump: %w", err)
+			}
 		}
 	}
 }
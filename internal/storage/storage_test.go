@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/dumper"
+	"github.com/personage-hub/metrics-tracker/internal/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingDumper struct {
+	mu       sync.Mutex
+	saves    int
+	gauges   map[string]float64
+	counters map[string]int64
+	err      error
+	// release, when set, blocks every save until it is closed.
+	release chan struct{}
+	entered chan struct{}
+}
+
+func (d *recordingDumper) SaveData(gaugeMap map[string]float64, counterMap map[string]int64) error {
+	if d.release != nil {
+		select {
+		case d.entered <- struct{}{}:
+		default:
+		}
+		<-d.release
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.saves++
+	if d.err != nil {
+		return d.err
+	}
+	d.gauges, d.counters = gaugeMap, counterMap
+	return nil
+}
+
+func (d *recordingDumper) RestoreData() (map[string]float64, map[string]int64, error) {
+	return nil, nil, errors.New("nothing to restore")
+}
+
+func (d *recordingDumper) state() (int, map[string]float64, map[string]int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.saves, d.gauges, d.counters
+}
+
+func TestPeriodicSaveInterval(t *testing.T) {
+	d := &recordingDumper{}
+	m, err := NewMemStorage(d, false)
+	require.NoError(t, err)
+	go m.PeriodicSave(context.Background(), 1)
+
+	require.NoError(t, m.GaugeUpdate("Alloc", 1.5))
+	require.NoError(t, m.CounterUpdate("PollCount", 3))
+	saves, _, _ := d.state()
+	assert.Equal(t, 0, saves, "updates must not wait for a save")
+
+	assert.Eventually(t, func() bool {
+		saves, gauges, counters := d.state()
+		return saves > 0 && gauges["Alloc"] == 1.5 && counters["PollCount"] == 3
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestPeriodicSaveSynchronous(t *testing.T) {
+	d := &recordingDumper{}
+	m, err := NewMemStorage(d, false)
+	require.NoError(t, err)
+	m.PeriodicSave(context.Background(), 0)
+
+	require.NoError(t, m.GaugeUpdate("Alloc", 1.5))
+	_, gauges, _ := d.state()
+	assert.Equal(t, map[string]float64{"Alloc": 1.5}, gauges)
+
+	require.NoError(t, m.CounterUpdate("PollCount", 3))
+	_, _, counters := d.state()
+	assert.Equal(t, map[string]int64{"PollCount": 3}, counters)
+
+	require.NoError(t, m.BatchUpdate(map[string]float64{"Alloc": 2}, map[string]int64{"PollCount": 1}))
+	saves, gauges, counters := d.state()
+	assert.Equal(t, 3, saves)
+	assert.Equal(t, map[string]float64{"Alloc": 2}, gauges)
+	assert.Equal(t, map[string]int64{"PollCount": 4}, counters)
+
+	d.err = errors.New("disk full")
+	assert.ErrorIs(t, m.GaugeUpdate("Alloc", 3), d.err)
+}
+
+func TestSynchronousSaveGroupsConcurrentWriters(t *testing.T) {
+	d := &recordingDumper{release: make(chan struct{}), entered: make(chan struct{}, 1)}
+	m, err := NewMemStorage(d, false)
+	require.NoError(t, err)
+	m.PeriodicSave(context.Background(), 0)
+
+	const writers = 50
+	var wg sync.WaitGroup
+	write := func() {
+		defer wg.Done()
+		assert.NoError(t, m.CounterUpdate("PollCount", 1))
+	}
+
+	// The first writer starts a save that blocks, the others queue up behind it.
+	wg.Add(1)
+	go write()
+	<-d.entered
+	wg.Add(writers - 1)
+	for i := 1; i < writers; i++ {
+		go write()
+	}
+	require.Eventually(t, func() bool {
+		m.saver.mu.Lock()
+		defer m.saver.mu.Unlock()
+		return len(m.saver.pending) == writers-1
+	}, time.Second, time.Millisecond)
+	close(d.release)
+	wg.Wait()
+
+	saves, _, counters := d.state()
+	assert.Equal(t, 2, saves)
+	assert.Equal(t, int64(writers), counters["PollCount"])
+}
+
+func TestPeriodicSaveStops(t *testing.T) {
+	d := &recordingDumper{}
+	m, err := NewMemStorage(d, false)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- m.PeriodicSave(ctx, 1)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("PeriodicSave did not stop after cancel")
+	}
+
+	// A failed dump ends the loop with the error instead of exiting the process.
+	d.err = errors.New("disk full")
+	err = m.PeriodicSave(context.Background(), 1)
+	assert.ErrorIs(t, err, d.err)
+}
+
+func TestWALReplayedOnTopOfSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	keeper := dumper.NewDumper(filepath.Join(dir, "dump.json"))
+	open := func() (*MemStorage, *wal.Log) {
+		m, _ := NewMemStorage(keeper, true)
+		w, err := wal.Open(filepath.Join(dir, "wal"), wal.Options{})
+		require.NoError(t, err)
+		require.NoError(t, m.AttachWAL(w, true))
+		return m, w
+	}
+
+	m, w := open()
+	require.NoError(t, m.CounterUpdate("PollCount", 2))
+	require.NoError(t, m.GaugeUpdate("Alloc", 1))
+	require.NoError(t, m.Save())
+	require.NoError(t, m.CounterUpdate("PollCount", 3))
+	require.NoError(t, m.BatchUpdate(map[string]float64{"Alloc": 2}, map[string]int64{"PollCount": 1, "Other": 5}))
+	// The process dies without a final snapshot.
+	require.NoError(t, w.Close())
+
+	m, w = open()
+	assert.Equal(t, map[string]float64{"Alloc": 2}, m.GaugeMap())
+	assert.Equal(t, map[string]int64{"PollCount": 6, "Other": 5}, m.CounterMap())
+
+	// A snapshot written without truncating the log, as after a crash between
+	// the two, must not count the logged increments twice.
+	require.NoError(t, keeper.SaveData(m.GaugeMap(), m.CounterMap()))
+	require.NoError(t, w.Close())
+	m, w = open()
+	defer w.Close()
+	assert.Equal(t, map[string]int64{"PollCount": 6, "Other": 5}, m.CounterMap())
+}
+
+func TestWALSaveDuringUpdateLosesNothing(t *testing.T) {
+	dir := t.TempDir()
+	keeper := dumper.NewDumper(filepath.Join(dir, "dump.json"))
+	m, _ := NewMemStorage(keeper, false)
+	w, err := wal.Open(filepath.Join(dir, "wal"), wal.Options{})
+	require.NoError(t, err)
+	require.NoError(t, m.AttachWAL(w, false))
+	require.NoError(t, m.CounterUpdate("PollCount", 1))
+	require.NoError(t, m.Save())
+
+	// An update is logged and applied but CounterUpdate has not returned
+	// yet when a Save rotates the log.
+	m.mu.RLock()
+	require.NoError(t, m.update("", nil, map[string]int64{"PollCount": 1}))
+	saved := make(chan error, 1)
+	go func() { saved <- m.Save() }()
+	time.Sleep(20 * time.Millisecond)
+	m.mu.RUnlock()
+	require.NoError(t, <-saved)
+	// The process dies without a final snapshot.
+	require.NoError(t, w.Close())
+
+	m, _ = NewMemStorage(keeper, true)
+	w, err = wal.Open(filepath.Join(dir, "wal"), wal.Options{})
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, m.AttachWAL(w, true))
+	value, _ := m.GetCounterMetric("PollCount")
+	assert.Equal(t, int64(2), value)
+}
+
+func TestWALClearedWithoutRestore(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.Open(dir, wal.Options{})
+	require.NoError(t, err)
+	require.NoError(t, w.Append(wal.Op{Kind: wal.KindCounter, Name: "PollCount", Total: 9}))
+
+	m, _ := NewMemStorage(&recordingDumper{}, false)
+	require.NoError(t, m.AttachWAL(w, false))
+	require.NoError(t, m.CounterUpdate("PollCount", 1))
+	require.NoError(t, w.Close())
+
+	w, err = wal.Open(dir, wal.Options{})
+	require.NoError(t, err)
+	defer w.Close()
+	m, _ = NewMemStorage(&recordingDumper{}, false)
+	require.NoError(t, m.AttachWAL(w, true))
+	assert.Equal(t, map[string]int64{"PollCount": 1}, m.CounterMap())
+}
+
+func BenchmarkCounterUpdateContended(b *testing.B) {
+	m, _ := NewMemStorage(&recordingDumper{}, false)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.CounterUpdate("PollCount", 1)
+		}
+	})
+	if value, _ := m.GetCounterMetric("PollCount"); value != int64(b.N) {
+		b.Fatalf("lost increments: got %d, want %d", value, b.N)
+	}
+}
+
+func BenchmarkCounterUpdateSpread(b *testing.B) {
+	m, _ := NewMemStorage(&recordingDumper{}, false)
+	keys := make([]string, 64)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("counter%d", i)
+	}
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		key := keys[int(next.Add(1))%len(keys)]
+		for pb.Next() {
+			m.CounterUpdate(key, 1)
+		}
+	})
+}
@@ -0,0 +1,433 @@
+// Package storagetest is a conformance suite for storage.Storage and
+// dumper.Dumper implementations.
+package storagetest
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/personage-hub/metrics-tracker/internal/dumper"
+	"github.com/personage-hub/metrics-tracker/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Backend struct {
+	// Open returns an empty storage owned by t.
+	Open func(t *testing.T) storage.Storage
+	// Reopen persists s, closes it and opens the same data again. When nil
+	// the persistence checks are skipped.
+	Reopen func(t *testing.T, s storage.Storage) storage.Storage
+}
+
+// Run checks that the backend behaves like every other storage.
+func Run(t *testing.T, backend Backend) {
+	t.Run("Gauges", func(t *testing.T) { testGauges(t, backend) })
+	t.Run("Counters", func(t *testing.T) { testCounters(t, backend) })
+	t.Run("MissingKeys", func(t *testing.T) { testMissingKeys(t, backend) })
+	t.Run("SeparateTypes", func(t *testing.T) { testSeparateTypes(t, backend) })
+	t.Run("BatchUpdate", func(t *testing.T) { testBatchUpdate(t, backend) })
+	t.Run("BatchUpdateOnce", func(t *testing.T) { testBatchUpdateOnce(t, backend) })
+	t.Run("ConcurrentDuplicateBatches", func(t *testing.T) { testConcurrentDuplicateBatches(t, backend) })
+	t.Run("MapsAreCopies", func(t *testing.T) { testMapsAreCopies(t, backend) })
+	t.Run("BatchIsAtomic", func(t *testing.T) { testBatchIsAtomic(t, backend) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, backend) })
+	t.Run("ContendedCounter", func(t *testing.T) { testContendedCounter(t, backend) })
+	t.Run("Snapshot", func(t *testing.T) { testSnapshot(t, backend) })
+	t.Run("SnapshotIsConsistent", func(t *testing.T) { testSnapshotIsConsistent(t, backend) })
+	t.Run("Persistence", func(t *testing.T) {
+		if backend.Reopen == nil {
+			t.Skip("backend does not persist")
+		}
+		testPersistence(t, backend)
+	})
+}
+
+func testGauges(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	for _, value := range []float64{1.5, -2, 0, math.MaxFloat64, math.SmallestNonzeroFloat64} {
+		require.NoError(t, s.GaugeUpdate("Alloc", value))
+		got, ok := s.GetGaugeMetric("Alloc")
+		require.True(t, ok)
+		assert.Equal(t, value, got, "a gauge keeps the last value")
+	}
+	assert.Equal(t, map[string]float64{"Alloc": math.SmallestNonzeroFloat64}, s.GaugeMap())
+}
+
+func testCounters(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	var want int64
+	for _, delta := range []int64{5, -2, 0, math.MaxInt32} {
+		require.NoError(t, s.CounterUpdate("PollCount", delta))
+		want += delta
+		got, ok := s.GetCounterMetric("PollCount")
+		require.True(t, ok)
+		assert.Equal(t, want, got, "a counter adds every delta")
+	}
+	require.NoError(t, s.CounterUpdate("Zero", 0))
+	got, ok := s.GetCounterMetric("Zero")
+	require.True(t, ok, "a zero delta still creates the counter")
+	assert.Equal(t, int64(0), got)
+	assert.Equal(t, map[string]int64{"PollCount": want, "Zero": 0}, s.CounterMap())
+}
+
+func testMissingKeys(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	_, ok := s.GetGaugeMetric("Missing")
+	assert.False(t, ok)
+	_, ok = s.GetCounterMetric("Missing")
+	assert.False(t, ok)
+	assert.Empty(t, s.GaugeMap())
+	assert.Empty(t, s.CounterMap())
+}
+
+func testSeparateTypes(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	require.NoError(t, s.GaugeUpdate("Shared", 1.5))
+	require.NoError(t, s.CounterUpdate("Shared", 3))
+	require.NoError(t, s.GaugeUpdate("Ключ с пробелами/и.точками", 2))
+
+	gauge, ok := s.GetGaugeMetric("Shared")
+	require.True(t, ok)
+	assert.Equal(t, 1.5, gauge)
+	counter, ok := s.GetCounterMetric("Shared")
+	require.True(t, ok)
+	assert.Equal(t, int64(3), counter)
+	_, ok = s.GetCounterMetric("Ключ с пробелами/и.точками")
+	assert.False(t, ok, "a gauge is not visible as a counter")
+	assert.Equal(t, map[string]float64{"Shared": 1.5, "Ключ с пробелами/и.точками": 2}, s.GaugeMap())
+}
+
+func testBatchUpdate(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	require.NoError(t, s.CounterUpdate("PollCount", 1))
+	require.NoError(t, s.BatchUpdate(
+		map[string]float64{"Alloc": 1, "Free": 2},
+		map[string]int64{"PollCount": 2, "Other": 7},
+	))
+	require.NoError(t, s.BatchUpdate(map[string]float64{"Alloc": 3}, nil))
+	require.NoError(t, s.BatchUpdate(nil, nil))
+
+	assert.Equal(t, map[string]float64{"Alloc": 3, "Free": 2}, s.GaugeMap())
+	assert.Equal(t, map[string]int64{"PollCount": 3, "Other": 7}, s.CounterMap())
+}
+
+func testBatchUpdateOnce(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	batch := map[string]int64{"PollCount": 2}
+	for _, tt := range []struct {
+		key     string
+		applied bool
+	}{
+		{key: "agent-1", applied: true},
+		{key: "agent-1", applied: false},
+		{key: "agent-2", applied: true},
+		{key: "", applied: true},
+		{key: "", applied: true},
+	} {
+		applied, err := s.BatchUpdateOnce(tt.key, map[string]float64{"Alloc": 1}, batch)
+		require.NoError(t, err)
+		assert.Equal(t, tt.applied, applied, "key %q", tt.key)
+	}
+	value, _ := s.GetCounterMetric("PollCount")
+	assert.Equal(t, int64(8), value)
+}
+
+// testConcurrentDuplicateBatches checks that a batch sent several times at
+// once is applied once.
+func testConcurrentDuplicateBatches(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	const senders = 8
+
+	start := make(chan struct{})
+	var applied atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(senders)
+	for i := 0; i < senders; i++ {
+		go func() {
+			defer wg.Done()
+			<-start
+			ok, err := s.BatchUpdateOnce("agent-1", nil, map[string]int64{"PollCount": 1})
+			assert.NoError(t, err)
+			if ok {
+				applied.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), applied.Load())
+	value, _ := s.GetCounterMetric("PollCount")
+	assert.Equal(t, int64(1), value)
+}
+
+func testMapsAreCopies(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	require.NoError(t, s.GaugeUpdate("Alloc", 1))
+	require.NoError(t, s.CounterUpdate("PollCount", 1))
+
+	gauges, counters := s.GaugeMap(), s.CounterMap()
+	gauges["Alloc"] = 100
+	gauges["Injected"] = 1
+	counters["PollCount"] = 100
+	require.NoError(t, s.GaugeUpdate("Alloc", 2))
+	require.NoError(t, s.CounterUpdate("PollCount", 1))
+
+	assert.Equal(t, map[string]float64{"Alloc": 2}, s.GaugeMap())
+	assert.Equal(t, map[string]int64{"PollCount": 2}, s.CounterMap())
+	assert.Equal(t, map[string]int64{"PollCount": 100}, counters, "later updates do not leak into a returned map")
+}
+
+// testBatchIsAtomic checks that readers never see part of a batch.
+func testBatchIsAtomic(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	require.NoError(t, s.BatchUpdate(map[string]float64{"A": 0, "B": 0}, map[string]int64{"A": 0, "B": 0}))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 1; i <= 50; i++ {
+			assert.NoError(t, s.BatchUpdate(
+				map[string]float64{"A": float64(i), "B": float64(i)},
+				map[string]int64{"A": 1, "B": 1},
+			))
+		}
+	}()
+
+	for {
+		gauges, counters := s.GaugeMap(), s.CounterMap()
+		assert.Equal(t, gauges["A"], gauges["B"], "gauges of one batch are seen together")
+		assert.Equal(t, counters["A"], counters["B"], "counters of one batch are seen together")
+		select {
+		case <-done:
+			wg.Wait()
+			return
+		default:
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	const writers, updates = 8, 50
+
+	var wg sync.WaitGroup
+	wg.Add(2 * writers)
+	for w := 0; w < writers; w++ {
+		name := fmt.Sprintf("metric%d", w)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= updates; i++ {
+				assert.NoError(t, s.GaugeUpdate(name, float64(i)))
+				assert.NoError(t, s.CounterUpdate(name, 1))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				s.GaugeMap()
+				s.CounterMap()
+				s.GetGaugeMetric(name)
+				s.GetCounterMetric(name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	gauges, counters := s.GaugeMap(), s.CounterMap()
+	for w := 0; w < writers; w++ {
+		name := fmt.Sprintf("metric%d", w)
+		assert.Equal(t, float64(updates), gauges[name])
+		assert.Equal(t, int64(updates), counters[name])
+	}
+}
+
+// testContendedCounter checks that concurrent increments of one counter are
+// never lost.
+func testContendedCounter(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	const writers, increments = 16, 50
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for w := 0; w < writers; w++ {
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < increments; i++ {
+				assert.NoError(t, s.CounterUpdate("PollCount", 1))
+				assert.NoError(t, s.BatchUpdate(nil, map[string]int64{"PollCount": 2}))
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	value, ok := s.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, int64(3*writers*increments), value)
+}
+
+func testSnapshot(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	empty, err := s.Snapshot()
+	require.NoError(t, err)
+	assert.Empty(t, empty.Gauges())
+	assert.Empty(t, empty.Counters())
+
+	require.NoError(t, s.GaugeUpdate("Free", 2))
+	require.NoError(t, s.GaugeUpdate("Alloc", 1))
+	require.NoError(t, s.CounterUpdate("PollCount", 3))
+	first, err := s.Snapshot()
+	require.NoError(t, err)
+	assert.NotEqual(t, empty.Generation(), first.Generation(), "writes change the generation")
+	assert.Equal(t, s.GaugeMap(), first.Gauges())
+	assert.Equal(t, s.CounterMap(), first.Counters())
+	assert.Equal(t, []string{"Alloc", "Free"}, first.GaugeNames())
+	assert.Equal(t, []string{"PollCount"}, first.CounterNames())
+	value, ok := first.Gauge("Alloc")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, value)
+	_, ok = first.Counter("Missing")
+	assert.False(t, ok)
+
+	again, err := s.Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, first.Generation(), again.Generation(), "reads keep the generation")
+
+	gauges := first.Gauges()
+	gauges["Alloc"] = 100
+	require.NoError(t, s.GaugeUpdate("Alloc", 5))
+	require.NoError(t, s.BatchUpdate(nil, map[string]int64{"PollCount": 1}))
+	assert.Equal(t, map[string]float64{"Alloc": 1, "Free": 2}, first.Gauges(), "a snapshot never changes")
+	assert.Equal(t, map[string]int64{"PollCount": 3}, first.Counters())
+
+	latest, err := s.Snapshot()
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Generation(), latest.Generation())
+	assert.Equal(t, map[string]float64{"Alloc": 5, "Free": 2}, latest.Gauges())
+	assert.Equal(t, map[string]int64{"PollCount": 4}, latest.Counters())
+}
+
+// testSnapshotIsConsistent checks that a snapshot holds a batch across both
+// metric types entirely or not at all.
+func testSnapshotIsConsistent(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	require.NoError(t, s.BatchUpdate(map[string]float64{"A": 0}, map[string]int64{"A": 0}))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 1; i <= 50; i++ {
+			assert.NoError(t, s.BatchUpdate(map[string]float64{"A": float64(i)}, map[string]int64{"A": 1}))
+		}
+	}()
+
+	for {
+		snapshot, err := s.Snapshot()
+		require.NoError(t, err)
+		gauge, _ := snapshot.Gauge("A")
+		counter, _ := snapshot.Counter("A")
+		assert.Equal(t, gauge, float64(counter), "gauge and counter of one batch are seen together")
+		select {
+		case <-done:
+			wg.Wait()
+			return
+		default:
+		}
+	}
+}
+
+func testPersistence(t *testing.T, backend Backend) {
+	s := backend.Open(t)
+	require.NoError(t, s.GaugeUpdate("Alloc", 1.5))
+	require.NoError(t, s.CounterUpdate("PollCount", 2))
+	require.NoError(t, s.BatchUpdate(map[string]float64{"Free": -3}, map[string]int64{"PollCount": 3}))
+
+	s = backend.Reopen(t, s)
+	assert.Equal(t, map[string]float64{"Alloc": 1.5, "Free": -3}, s.GaugeMap())
+	assert.Equal(t, map[string]int64{"PollCount": 5}, s.CounterMap())
+
+	require.NoError(t, s.CounterUpdate("PollCount", 1))
+	s = backend.Reopen(t, s)
+	value, ok := s.GetCounterMetric("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, int64(6), value, "counters continue from the persisted total")
+
+	applied, err := s.BatchUpdateOnce("agent-1", nil, map[string]int64{"PollCount": 4})
+	require.NoError(t, err)
+	require.True(t, applied)
+	s = backend.Reopen(t, s)
+	applied, err = s.BatchUpdateOnce("agent-1", nil, map[string]int64{"PollCount": 4})
+	require.NoError(t, err)
+	assert.False(t, applied, "applied keys persist with the data")
+	value, _ = s.GetCounterMetric("PollCount")
+	assert.Equal(t, int64(10), value)
+}
+
+// RunDumper checks that data saved by a dumper is restored unchanged.
+func RunDumper(t *testing.T, newDumper func(t *testing.T) dumper.Dumper) {
+	tests := []struct {
+		name     string
+		gauges   map[string]float64
+		counters map[string]int64
+	}{
+		{
+			name:     "Regular values",
+			gauges:   map[string]float64{"Alloc": 1.5, "Free": -2, "Zero": 0},
+			counters: map[string]int64{"PollCount": 5, "Negative": -3},
+		},
+		{
+			name:     "Extreme values",
+			gauges:   map[string]float64{"Max": math.MaxFloat64, "Tiny": math.SmallestNonzeroFloat64},
+			counters: map[string]int64{"Max": math.MaxInt64, "Min": math.MinInt64},
+		},
+		{
+			name:     "Unusual names",
+			gauges:   map[string]float64{"": 1, "с пробелом": 2, `"quoted"\n`: 3},
+			counters: map[string]int64{"a/b.c": 1},
+		},
+		{
+			name:     "Empty",
+			gauges:   map[string]float64{},
+			counters: map[string]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDumper(t)
+			require.NoError(t, d.SaveData(tt.gauges, tt.counters))
+			gauges, counters, err := d.RestoreData()
+			require.NoError(t, err)
+			assert.Equal(t, len(tt.gauges), len(gauges))
+			for name, value := range tt.gauges {
+				assert.Equal(t, value, gauges[name], name)
+			}
+			assert.Equal(t, len(tt.counters), len(counters))
+			for name, value := range tt.counters {
+				assert.Equal(t, value, counters[name], name)
+			}
+		})
+	}
+
+	t.Run("Overwrite", func(t *testing.T) {
+		d := newDumper(t)
+		require.NoError(t, d.SaveData(map[string]float64{"Alloc": 1, "Old": 1}, map[string]int64{"PollCount": 1}))
+		require.NoError(t, d.SaveData(map[string]float64{"Alloc": 2}, map[string]int64{"PollCount": 2}))
+		gauges, counters, err := d.RestoreData()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]float64{"Alloc": 2}, gauges)
+		assert.Equal(t, map[string]int64{"PollCount": 2}, counters)
+	})
+}
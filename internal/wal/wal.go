@@ -0,0 +1,354 @@
+// Package wal implements the write-ahead log of the in-memory storage.
+//
+// Every record holds the state a set of metrics was left in by one update:
+// the new gauge value or the new counter total. Replaying a record twice is
+// therefore harmless, which lets the storage replay the whole log on top of
+// a snapshot that may already include some of it.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/personage-hub/metrics-tracker/internal/segments"
+)
+
+// Record layout: crc32 | payload length | payload. The checksum covers the
+// length and the payload.
+const headerSize = 4 + 4
+
+// format caps records at 64 MiB so that replay never allocates a garbage
+// length.
+var format = segments.Format{Ext: ".wal", HeaderSize: headerSize, MaxPayload: 64 << 20}
+
+const DefaultSegmentSize = 16 << 20
+
+type Kind byte
+
+const (
+	KindGauge Kind = iota + 1
+	KindCounter
+	// KindKey records the idempotency key of an applied batch in Name.
+	KindKey
+)
+
+// Op is the state of one metric after an update: Value for a gauge, the
+// counter total in Total for a counter.
+type Op struct {
+	Kind  Kind
+	Name  string
+	Value float64
+	Total int64
+}
+
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs every record before Append returns.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval syncs in the background every Options.SyncInterval.
+	SyncInterval
+	// SyncOS leaves flushing to the operating system.
+	SyncOS
+)
+
+type Options struct {
+	// SegmentSize is the size after which a new segment file is started.
+	SegmentSize  int64
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+// ParseSyncPolicy reads "always", "os" or an interval such as "100ms".
+func ParseSyncPolicy(value string) (SyncPolicy, time.Duration, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "always":
+		return SyncAlways, 0, nil
+	case "os":
+		return SyncOS, 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, 0, fmt.Errorf("invalid wal sync policy %q: want always, os or a positive interval", value)
+	}
+	return SyncInterval, interval, nil
+}
+
+// Log is an append-only sequence of records split into segment files that
+// are named by a growing index.
+type Log struct {
+	mu       sync.Mutex
+	dir      string
+	options  Options
+	segments []*segments.File
+	writer   *segments.Writer
+	dirty    bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Open loads the log stored in dir, creating it when needed. A torn record
+// at the end of the last segment, left by a crash, is cut off.
+func Open(dir string, options Options) (*Log, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = DefaultSegmentSize
+	}
+	if options.Sync == SyncInterval && options.SyncInterval <= 0 {
+		return nil, errors.New("wal sync interval must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create wal dir: %w", err)
+	}
+	files, err := format.Load(dir, func(_ *segments.File, _ int64, _, payload []byte) bool {
+		_, err := decodeOps(payload)
+		return err == nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load wal: %w", err)
+	}
+	l := &Log{
+		dir:      dir,
+		options:  options,
+		segments: files,
+		writer:   segments.NewWriter(dir, format, options.SegmentSize),
+	}
+	if options.Sync == SyncInterval {
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// Replay calls fn for every logged op, oldest first.
+func (l *Log) Replay(fn func(Op)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, file := range l.segments {
+		_, err := format.Scan(file, func(_ *segments.File, _ int64, _, payload []byte) bool {
+			ops, err := decodeOps(payload)
+			if err != nil {
+				return false
+			}
+			for _, op := range ops {
+				fn(op)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append writes ops as a single record, so a crash keeps either all or none
+// of them.
+func (l *Log) Append(ops ...Op) error {
+	record := make([]byte, headerSize, headerSize+32*len(ops))
+	for _, op := range ops {
+		record = encodeOp(record, op)
+	}
+	format.Seal(record)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	active, err := l.ensureActive()
+	if err != nil {
+		return err
+	}
+	seg := l.segments[len(l.segments)-1]
+	if _, err := active.Write(record); err != nil {
+		return l.cut(seg, fmt.Errorf("failed to write wal record: %w", err))
+	}
+	if l.options.Sync == SyncAlways {
+		if err := active.Sync(); err != nil {
+			return l.cut(seg, fmt.Errorf("failed to sync wal record: %w", err))
+		}
+	} else {
+		l.dirty = true
+	}
+	seg.Size += int64(len(record))
+	return nil
+}
+
+// cut drops whatever part of a failed record made it to seg, so that later
+// records are not appended behind torn bytes.
+func (l *Log) cut(seg *segments.File, err error) error {
+	if cutErr := l.writer.Truncate(seg.Size); cutErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to cut wal record: %w", cutErr))
+	}
+	return err
+}
+
+func (l *Log) ensureActive() (*os.File, error) {
+	var last *segments.File
+	next := uint64(1)
+	if n := len(l.segments); n > 0 {
+		last = l.segments[n-1]
+		next = last.Index + 1
+	}
+	active, created, err := l.writer.Ensure(last, next)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal segment: %w", err)
+	}
+	if created != nil {
+		l.dirty = false
+		l.segments = append(l.segments, created)
+	}
+	return active, nil
+}
+
+// startSegment closes the active segment, if any, and starts a new one.
+func (l *Log) startSegment() error {
+	var index uint64 = 1
+	if n := len(l.segments); n > 0 {
+		index = l.segments[n-1].Index + 1
+	}
+	created, err := l.writer.Start(index)
+	if err != nil {
+		return fmt.Errorf("failed to create wal segment: %w", err)
+	}
+	l.dirty = false
+	l.segments = append(l.segments, created)
+	return nil
+}
+
+func (l *Log) closeActive() error {
+	l.dirty = false
+	return l.writer.Close()
+}
+
+// Rotate makes later records go to a new segment and returns a mark that
+// RemoveBefore accepts once everything logged so far is in a snapshot.
+func (l *Log) Rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.segments)
+	if n == 0 {
+		return 1, nil
+	}
+	if l.segments[n-1].Size == 0 {
+		return l.segments[n-1].Index, nil
+	}
+	if err := l.startSegment(); err != nil {
+		return 0, err
+	}
+	return l.segments[n].Index, nil
+}
+
+// RemoveBefore deletes the segments older than mark.
+func (l *Log) RemoveBefore(mark uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.segments[:0]
+	for i, file := range l.segments {
+		isLast := i == len(l.segments)-1
+		if file.Index < mark && !isLast {
+			if err := segments.Remove(file); err != nil {
+				return fmt.Errorf("failed to remove wal segment: %w", err)
+			}
+			continue
+		}
+		kept = append(kept, file)
+	}
+	l.segments = kept
+	return segments.SyncDir(l.dir)
+}
+
+// Reset drops every record.
+func (l *Log) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.closeActive(); err != nil {
+		return err
+	}
+	if err := segments.Remove(l.segments...); err != nil {
+		return fmt.Errorf("failed to remove wal segment: %w", err)
+	}
+	l.segments = nil
+	return segments.SyncDir(l.dir)
+}
+
+// Sync flushes written records to disk.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.writer.Sync()
+}
+
+func (l *Log) syncLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			// A failed sync is retried on the next tick, and Close reports it.
+			_ = l.Sync()
+		}
+	}
+}
+
+// Close syncs and closes the log.
+func (l *Log) Close() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+		l.stop = nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closeActive()
+}
+
+// Entry layout: kind | name length (uvarint) | name | 8 byte value.
+func encodeOp(buf []byte, op Op) []byte {
+	buf = append(buf, byte(op.Kind))
+	buf = binary.AppendUvarint(buf, uint64(len(op.Name)))
+	buf = append(buf, op.Name...)
+	var value uint64
+	if op.Kind == KindGauge {
+		value = math.Float64bits(op.Value)
+	} else {
+		value = uint64(op.Total)
+	}
+	return binary.LittleEndian.AppendUint64(buf, value)
+}
+
+func decodeOps(payload []byte) ([]Op, error) {
+	var ops []Op
+	for len(payload) > 0 {
+		kind := Kind(payload[0])
+		if kind != KindGauge && kind != KindCounter && kind != KindKey {
+			return nil, fmt.Errorf("unknown wal op kind %d", kind)
+		}
+		length, n := binary.Uvarint(payload[1:])
+		if n <= 0 || uint64(len(payload)-1-n) < length+8 {
+			return nil, errors.New("truncated wal op")
+		}
+		payload = payload[1+n:]
+		op := Op{Kind: kind, Name: string(payload[:length])}
+		value := binary.LittleEndian.Uint64(payload[length : length+8])
+		if kind == KindGauge {
+			op.Value = math.Float64frombits(value)
+		} else {
+			op.Total = int64(value)
+		}
+		ops = append(ops, op)
+		payload = payload[length+8:]
+	}
+	return ops, nil
+}
@@ -0,0 +1,135 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func replayAll(t *testing.T, l *Log) []Op {
+	t.Helper()
+	var ops []Op
+	require.NoError(t, l.Replay(func(op Op) {
+		ops = append(ops, op)
+	}))
+	return ops
+}
+
+func TestAppendReplay(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	require.NoError(t, err)
+
+	written := []Op{
+		{Kind: KindGauge, Name: "Alloc", Value: 1.5},
+		{Kind: KindCounter, Name: "PollCount", Total: 3},
+		{Kind: KindCounter, Name: "", Total: -7},
+	}
+	require.NoError(t, l.Append(written[0]))
+	require.NoError(t, l.Append(written[1:]...))
+	require.NoError(t, l.Close())
+
+	l, err = Open(dir, Options{})
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, written, replayAll(t, l))
+}
+
+func TestOpenCutsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Op{Kind: KindGauge, Name: "Alloc", Value: 1}))
+	require.NoError(t, l.Append(Op{Kind: KindGauge, Name: "Alloc", Value: 2}))
+	require.NoError(t, l.Close())
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+format.Ext))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	info, err := os.Stat(paths[0])
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(paths[0], info.Size()-3))
+
+	l, err = Open(dir, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []Op{{Kind: KindGauge, Name: "Alloc", Value: 1}}, replayAll(t, l))
+
+	// Records appended after the cut are replayed as usual.
+	require.NoError(t, l.Append(Op{Kind: KindGauge, Name: "Alloc", Value: 3}))
+	require.NoError(t, l.Close())
+	l, err = Open(dir, Options{})
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, []Op{
+		{Kind: KindGauge, Name: "Alloc", Value: 1},
+		{Kind: KindGauge, Name: "Alloc", Value: 3},
+	}, replayAll(t, l))
+}
+
+func TestSegmentsAndTruncation(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{SegmentSize: 64})
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := int64(1); i <= 10; i++ {
+		require.NoError(t, l.Append(Op{Kind: KindCounter, Name: "PollCount", Total: i}))
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+format.Ext))
+	require.NoError(t, err)
+	assert.Greater(t, len(paths), 1, "small segments rotate by size")
+
+	mark, err := l.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Op{Kind: KindCounter, Name: "PollCount", Total: 11}))
+	require.NoError(t, l.RemoveBefore(mark))
+	assert.Equal(t, []Op{{Kind: KindCounter, Name: "PollCount", Total: 11}}, replayAll(t, l))
+
+	require.NoError(t, l.Reset())
+	assert.Empty(t, replayAll(t, l))
+	require.NoError(t, l.Append(Op{Kind: KindGauge, Name: "Alloc", Value: 1}))
+	assert.Len(t, replayAll(t, l), 1)
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := []struct {
+		value    string
+		policy   SyncPolicy
+		interval time.Duration
+		wantErr  bool
+	}{
+		{value: "always", policy: SyncAlways},
+		{value: "OS", policy: SyncOS},
+		{value: "100ms", policy: SyncInterval, interval: 100 * time.Millisecond},
+		{value: "0s", wantErr: true},
+		{value: "sometimes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			policy, interval, err := ParseSyncPolicy(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.policy, policy)
+			assert.Equal(t, tt.interval, interval)
+		})
+	}
+}
+
+func TestIntervalSync(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Op{Kind: KindGauge, Name: "Alloc", Value: 1}))
+	assert.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return !l.dirty
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, l.Close())
+}
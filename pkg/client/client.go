@@ -0,0 +1,345 @@
+// Package client reports application metrics to the metrics server.
+//
+// Handles returned by Gauge and Counter are cheap to update from any number
+// of goroutines: updates are single atomic operations that never allocate.
+// A background flusher sends the metrics updated since the previous flush as
+// one batch to the server's /updates/ endpoint. Every batch carries an
+// Idempotency-Key, so a retry of a batch the server already applied is not
+// counted twice.
+//
+//	c, err := client.New(client.Options{Address: "localhost:8080"})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	requests := c.Counter("requests", client.Labels{"handler": "login"})
+//	requests.Inc()
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/personage-hub/metrics-tracker/internal/consts"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/signature"
+)
+
+const (
+	DefaultFlushInterval = 10 * time.Second
+	DefaultTimeout       = 5 * time.Second
+)
+
+// Labels tell apart series of one metric, e.g. {"handler": "login"}.
+type Labels = metrics.Labels
+
+type Options struct {
+	// Address of the server, e.g. "localhost:8080".
+	Address       string
+	FlushInterval time.Duration
+	// Timeout bounds a single request to the server.
+	Timeout time.Duration
+	// Labels are attached to every metric. Labels of a handle take
+	// precedence over them.
+	Labels Labels
+	// Key signs request bodies like the agent's -k flag; empty disables
+	// signatures.
+	Key        string
+	HTTPClient *http.Client
+	// ErrorHandler is called with the errors of background flushes. They
+	// are discarded when it is nil.
+	ErrorHandler func(error)
+}
+
+// Gauge is a handle to a gauge series.
+type Gauge struct {
+	metric metrics.Metrics
+	bits   atomic.Uint64
+	dirty  atomic.Bool
+}
+
+func (g *Gauge) Set(value float64) {
+	g.bits.Store(math.Float64bits(value))
+	g.dirty.Store(true)
+}
+
+// Add adds delta to the current value.
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			g.dirty.Store(true)
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Counter is a handle to a counter series. The server adds the increments
+// up, so a counter reports only what was added since the last flush.
+type Counter struct {
+	metric  metrics.Metrics
+	pending atomic.Int64
+}
+
+func (c *Counter) Add(delta int64) {
+	c.pending.Add(delta)
+}
+
+func (c *Counter) Inc() {
+	c.pending.Add(1)
+}
+
+type Client struct {
+	options      Options
+	keys         *signature.KeyRing
+	url          string
+	errorHandler func(error)
+
+	mu          sync.Mutex
+	gaugeKeys   map[string]*Gauge
+	counterKeys map[string]*Counter
+	gauges      []*Gauge
+	counters    []*Counter
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// flushMu keeps flushes in order and guards the fields below.
+	flushMu sync.Mutex
+	// id and seq make up the idempotency keys of the batches.
+	id  string
+	seq uint64
+	// pending is a batch whose delivery failed; the next flush sends it
+	// again, unchanged and under the same key, before anything newer.
+	pending    []byte
+	pendingKey string
+}
+
+// New validates options and starts the background flusher; Close stops it.
+func New(options Options) (*Client, error) {
+	if options.Address == "" {
+		return nil, errors.New("server address is required")
+	}
+	if err := metrics.ValidateLabels(options.Labels); err != nil {
+		return nil, err
+	}
+	keys, err := signature.ParseKeyRing(options.Key)
+	if err != nil {
+		return nil, err
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate client id: %w", err)
+	}
+	c := &Client{
+		options:      options,
+		keys:         keys,
+		url:          fmt.Sprintf("http://%s/updates/", strings.TrimPrefix(options.Address, "http://")),
+		gaugeKeys:    make(map[string]*Gauge),
+		counterKeys:  make(map[string]*Counter),
+		id:           hex.EncodeToString(raw),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		errorHandler: options.ErrorHandler,
+	}
+	if c.errorHandler == nil {
+		c.errorHandler = func(error) {}
+	}
+	go c.flushLoop()
+	return c, nil
+}
+
+// Gauge returns the handle of the gauge name with labels, creating it on
+// first use. It panics if the name or labels are invalid.
+func (c *Client) Gauge(name string, labels Labels) *Gauge {
+	metric := c.newMetric(name, "gauge", labels)
+	key := metric.Key()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.gaugeKeys[key]
+	if !ok {
+		g = &Gauge{metric: metric}
+		c.gaugeKeys[key] = g
+		c.gauges = append(c.gauges, g)
+	}
+	return g
+}
+
+// Counter returns the handle of the counter name with labels, creating it
+// on first use. It panics if the name or labels are invalid.
+func (c *Client) Counter(name string, labels Labels) *Counter {
+	metric := c.newMetric(name, "counter", labels)
+	key := metric.Key()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, ok := c.counterKeys[key]
+	if !ok {
+		counter = &Counter{metric: metric}
+		c.counterKeys[key] = counter
+		c.counters = append(c.counters, counter)
+	}
+	return counter
+}
+
+func (c *Client) newMetric(name, mType string, labels Labels) metrics.Metrics {
+	merged := make(Labels, len(c.options.Labels)+len(labels))
+	for n, v := range c.options.Labels {
+		merged[n] = v
+	}
+	for n, v := range labels {
+		merged[n] = v
+	}
+	if len(merged) == 0 {
+		merged = nil
+	}
+	if name == "" || len(merged) > 0 && strings.ContainsAny(name, "{}") {
+		panic(fmt.Sprintf("client: invalid metric name %q", name))
+	}
+	if err := metrics.ValidateLabels(merged); err != nil {
+		panic(fmt.Sprintf("client: metric %s: %v", name, err))
+	}
+	return metrics.Metrics{ID: name, MType: mType, Labels: merged}
+}
+
+func (c *Client) flushLoop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.Flush(context.Background()); err != nil {
+				c.errorHandler(err)
+			}
+		}
+	}
+}
+
+// Flush sends the metrics updated since the previous flush. When the
+// server cannot be reached, answers 5xx or 429, the batch is kept and sent
+// again by the next flush under the same Idempotency-Key; a batch the
+// server rejects otherwise is dropped.
+func (c *Client) Flush(ctx context.Context) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	if c.pending != nil {
+		retriable, err := c.send(ctx, c.pending, c.pendingKey)
+		if err != nil && retriable {
+			return err
+		}
+		c.pending, c.pendingKey = nil, ""
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	gauges, counters := c.gauges, c.counters
+	c.mu.Unlock()
+
+	var batch metrics.MetricsList
+	for _, g := range gauges {
+		if !g.dirty.Swap(false) {
+			continue
+		}
+		m := g.metric
+		value := g.Value()
+		m.Value = &value
+		batch = append(batch, m)
+	}
+	for _, counter := range counters {
+		delta := counter.pending.Swap(0)
+		if delta == 0 {
+			continue
+		}
+		m := counter.metric
+		m.Delta = &delta
+		batch = append(batch, m)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	data, err := easyjson.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed converting metrics: %w", err)
+	}
+	c.seq++
+	key := fmt.Sprintf("%s-%d", c.id, c.seq)
+	retriable, err := c.send(ctx, data, key)
+	if err != nil && retriable {
+		c.pending, c.pendingKey = data, key
+	}
+	return err
+}
+
+// send posts an encoded batch under key and reports whether a failure is
+// worth retrying.
+func (c *Client) send(ctx context.Context, data []byte, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.options.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", consts.ContentTypeJSON)
+	req.Header.Set(consts.HeaderIdempotencyKey, key)
+	if c.keys != nil {
+		keyID, sum := c.keys.Sign(data)
+		req.Header.Set(signature.HeaderHash, sum)
+		if keyID != "" {
+			req.Header.Set(signature.HeaderKeyID, keyID)
+		}
+	}
+	resp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed sending metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	retriable := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+	return retriable, fmt.Errorf("server rejected metrics: %s", resp.Status)
+}
+
+// Close stops the background flusher and flushes once more.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+		err = c.Flush(context.Background())
+	})
+	return err
+}
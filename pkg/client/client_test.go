@@ -0,0 +1,268 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/personage-hub/metrics-tracker/internal/consts"
+	"github.com/personage-hub/metrics-tracker/internal/metrics"
+	"github.com/personage-hub/metrics-tracker/internal/signature"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer sums up the received batches by series. It answers status
+// instead while status is set.
+type testServer struct {
+	*httptest.Server
+	status atomic.Int64
+
+	mu       sync.Mutex
+	gauges   map[string]float64
+	counters map[string]int64
+	requests int
+}
+
+func newTestServer(t *testing.T, handle func(r *http.Request, body []byte)) *testServer {
+	ts := &testServer{gauges: make(map[string]float64), counters: make(map[string]int64)}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/updates/", r.URL.Path)
+		body, err := io.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if handle != nil {
+			handle(r, body)
+		}
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.requests++
+		if status := ts.status.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		var batch metrics.MetricsList
+		if !assert.NoError(t, easyjson.Unmarshal(body, &batch)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, m := range batch {
+			if m.MType == "gauge" {
+				ts.gauges[m.Key()] = *m.Value
+			} else {
+				ts.counters[m.Key()] += *m.Delta
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *testServer) counter(key string) int64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.counters[key]
+}
+
+func (ts *testServer) gauge(key string) (float64, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	value, ok := ts.gauges[key]
+	return value, ok
+}
+
+func newTestClient(t *testing.T, ts *testServer, options Options) *Client {
+	options.Address = strings.TrimPrefix(ts.URL, "http://")
+	if options.FlushInterval == 0 {
+		options.FlushInterval = time.Hour
+	}
+	c, err := New(options)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestFlush(t *testing.T) {
+	ts := newTestServer(t, nil)
+	c := newTestClient(t, ts, Options{Labels: Labels{"service": "api"}})
+
+	requests := c.Counter("requests", Labels{"handler": "login"})
+	assert.Same(t, requests, c.Counter("requests", Labels{"handler": "login"}), "handles are shared")
+	requests.Inc()
+	requests.Add(2)
+	temp := c.Gauge("temp", nil)
+	temp.Set(20)
+	temp.Add(1.5)
+	c.Gauge("idle", nil)
+
+	require.NoError(t, c.Flush(context.Background()))
+	assert.Equal(t, int64(3), ts.counter(`requests{handler="login",service="api"}`))
+	value, ok := ts.gauge(`temp{service="api"}`)
+	require.True(t, ok)
+	assert.Equal(t, 21.5, value)
+	_, ok = ts.gauge(`idle{service="api"}`)
+	assert.False(t, ok, "a gauge that was never set is not reported")
+
+	require.NoError(t, c.Flush(context.Background()))
+	assert.Equal(t, 1, ts.requests, "nothing changed, nothing is sent")
+
+	requests.Inc()
+	require.NoError(t, c.Flush(context.Background()))
+	assert.Equal(t, int64(4), ts.counter(`requests{handler="login",service="api"}`))
+}
+
+func TestFlushKeepsUpdatesOnFailure(t *testing.T) {
+	ts := newTestServer(t, nil)
+	c := newTestClient(t, ts, Options{})
+	requests := c.Counter("requests", nil)
+	temp := c.Gauge("temp", nil)
+
+	requests.Add(2)
+	temp.Set(5)
+	ts.status.Store(http.StatusServiceUnavailable)
+	assert.Error(t, c.Flush(context.Background()))
+
+	requests.Add(3)
+	ts.status.Store(0)
+	require.NoError(t, c.Flush(context.Background()))
+	assert.Equal(t, int64(5), ts.counter("requests"))
+	value, _ := ts.gauge("temp")
+	assert.Equal(t, 5.0, value)
+
+	requests.Inc()
+	ts.status.Store(http.StatusBadRequest)
+	assert.Error(t, c.Flush(context.Background()))
+	ts.status.Store(0)
+	require.NoError(t, c.Flush(context.Background()))
+	assert.Equal(t, int64(5), ts.counter("requests"), "a rejected batch is dropped")
+}
+
+func TestRetriesKeepIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	ts := newTestServer(t, func(r *http.Request, _ []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get(consts.HeaderIdempotencyKey))
+	})
+	c := newTestClient(t, ts, Options{})
+	requests := c.Counter("requests", nil)
+
+	requests.Add(2)
+	ts.status.Store(http.StatusGatewayTimeout)
+	assert.Error(t, c.Flush(context.Background()))
+	assert.Error(t, c.Flush(context.Background()))
+
+	requests.Add(3)
+	ts.status.Store(0)
+	require.NoError(t, c.Flush(context.Background()))
+	assert.Equal(t, int64(5), ts.counter("requests"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, keys, 4, "the failed batch is retried before the new one")
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1])
+	assert.Equal(t, keys[0], keys[2])
+	assert.NotEqual(t, keys[0], keys[3])
+}
+
+func TestBackgroundFlushAndClose(t *testing.T) {
+	ts := newTestServer(t, nil)
+	c := newTestClient(t, ts, Options{FlushInterval: 10 * time.Millisecond})
+	requests := c.Counter("requests", nil)
+
+	requests.Inc()
+	assert.Eventually(t, func() bool { return ts.counter("requests") == 1 }, 5*time.Second, time.Millisecond)
+
+	requests.Add(2)
+	require.NoError(t, c.Close())
+	assert.Equal(t, int64(3), ts.counter("requests"), "Close flushes the rest")
+	assert.NoError(t, c.Close())
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	ts := newTestServer(t, nil)
+	c := newTestClient(t, ts, Options{FlushInterval: time.Millisecond})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			requests := c.Counter("requests", nil)
+			active := c.Gauge("active", nil)
+			for j := 0; j < 1000; j++ {
+				requests.Inc()
+				active.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, c.Close())
+	assert.Equal(t, int64(8000), ts.counter("requests"))
+	value, _ := ts.gauge("active")
+	assert.Equal(t, 8000.0, value)
+}
+
+func TestSignedRequests(t *testing.T) {
+	keys, err := signature.ParseKeyRing("k1:secret")
+	require.NoError(t, err)
+	ts := newTestServer(t, func(r *http.Request, body []byte) {
+		assert.NoError(t, keys.Verify(body, r.Header.Get(signature.HeaderKeyID), r.Header.Get(signature.HeaderHash)))
+	})
+	c := newTestClient(t, ts, Options{Key: "k1:secret"})
+	c.Counter("requests", nil).Inc()
+	require.NoError(t, c.Flush(context.Background()))
+	assert.Equal(t, int64(1), ts.counter("requests"))
+}
+
+func TestUpdatesDoNotAllocate(t *testing.T) {
+	ts := newTestServer(t, nil)
+	c := newTestClient(t, ts, Options{})
+	requests := c.Counter("requests", Labels{"handler": "login"})
+	temp := c.Gauge("temp", nil)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		requests.Inc()
+		requests.Add(2)
+		temp.Set(1)
+		temp.Add(1)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestInvalidOptionsAndHandles(t *testing.T) {
+	_, err := New(Options{})
+	assert.Error(t, err, "an address is required")
+	_, err = New(Options{Address: "localhost:8080", Labels: Labels{"__name__": "x"}})
+	assert.Error(t, err)
+
+	ts := newTestServer(t, nil)
+	c := newTestClient(t, ts, Options{})
+	assert.Panics(t, func() { c.Counter("", nil) })
+	assert.Panics(t, func() { c.Gauge("temp", Labels{"1host": "a"}) })
+	assert.Panics(t, func() { c.Gauge("temp{a}", Labels{"host": "a"}) })
+}
+
+func BenchmarkCounterInc(b *testing.B) {
+	c, err := New(Options{Address: "localhost:0", FlushInterval: time.Hour})
+	require.NoError(b, err)
+	defer c.Close()
+	requests := c.Counter("requests", nil)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			requests.Inc()
+		}
+	})
+}